@@ -1,18 +1,25 @@
 package api
 
 import (
+	"context"
 	"gateway/configuration"
 	"gateway/db"
 	"gateway/graph"
+	"gateway/keyring"
+	"gateway/mailer"
+	"gateway/messages"
+	"gateway/oidc"
+	"gateway/utils"
 	"gateway/validation"
 	"net/http"
+	"sync"
 
 	"github.com/99designs/gqlgen/graphql/handler"
 	"github.com/99designs/gqlgen/graphql/playground"
-	"github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -24,6 +31,21 @@ type ApiHandler struct {
 	conf       *configuration.Configuration
 	validation *validation.Validation
 	tracer     trace.Tracer
+	keyring    *keyring.Keyring
+	mailer     mailer.Mailer
+	// oidc is nil when no OpenID Connect provider is configured
+	oidc *oidc.Provider
+	// emailThrottle limits the verification mails sent to an address
+	emailThrottle *throttle
+	loginGuard    *loginGuard
+	passwords     *utils.Passwords
+	// unknownUserHash is checked instead of the hash of a username that doesn't exist
+	unknownUserHash string
+	exports         *exportJobs
+	// mails waits for the mails sent in the background
+	mails sync.WaitGroup
+	// publishUserDeleted asks the other services to delete the data of a deleted user
+	publishUserDeleted func(ctx context.Context, l *logrus.Entry, event *messages.UserDeleted) error
 }
 
 func NewApiHandler(dbh db.DBHdandler, amqp *amqp.Connection, conf *configuration.Configuration) *ApiHandler {
@@ -33,14 +55,41 @@ func NewApiHandler(dbh db.DBHdandler, amqp *amqp.Connection, conf *configuration
 			graph.Config{Resolvers: resolver},
 		),
 	)
-	return &ApiHandler{
-		dbh:        dbh,
-		amqp:       amqp,
-		conf:       conf,
-		validation: validation.New(conf),
-		graphql:    graphqlHandler,
-		tracer:     otel.Tracer(conf.OtelServiceName),
+	kr, err := keyring.New(conf)
+	if err != nil {
+		logger.Fatal(err)
 	}
+	var provider *oidc.Provider
+	if conf.OIDCIssuer != "" {
+		provider = oidc.NewProvider(conf)
+	}
+	if conf.TokenCacheTTL > 0 {
+		dbh = newTokenCache(dbh, amqp, conf)
+	}
+	passwords := newPasswords(conf)
+	unknownUserHash, err := passwords.Hash("unknown user")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	api := &ApiHandler{
+		keyring:            kr,
+		oidc:               provider,
+		mailer:             mailer.New(conf),
+		emailThrottle:      newThrottle(conf.EmailResendInterval),
+		loginGuard:         newLoginGuard(conf.LoginBackoff, conf.LoginLockout),
+		passwords:          passwords,
+		unknownUserHash:    unknownUserHash,
+		exports:            newExportJobs(conf.ExportTTL),
+		dbh:                dbh,
+		amqp:               amqp,
+		publishUserDeleted: userDeletedPublisher(amqp),
+		conf:               conf,
+		validation:         validation.New(conf),
+		graphql:            graphqlHandler,
+		tracer:             otel.Tracer(conf.OtelServiceName),
+	}
+	api.promoteAdmins(context.Background())
+	return api
 }
 
 func (api *ApiHandler) Register(v1 *echo.Group, conf *configuration.Configuration) {
@@ -62,6 +111,8 @@ func (api *ApiHandler) Register(v1 *echo.Group, conf *configuration.Configuratio
 		return nil
 	})
 
+	v1.GET("/.well-known/jwks.json", api.getJWKS)
+
 	health := v1.Group("/health")
 	health.GET("/alive", api.getAliveStatus)
 	health.GET("/live", api.getAliveStatus)
@@ -73,52 +124,79 @@ func (api *ApiHandler) Register(v1 *echo.Group, conf *configuration.Configuratio
 	recipes.GET("/user/:username", api.getRecipesByUser)
 	recipes.GET("/ingredient/:id", api.getRecipesByIngredientID)
 	recipes.POST("", api.postRecipe)
-	recipes.DELETE("/:id", api.deleteRecipe)
+	recipes.DELETE("/:id", api.deleteRecipe, api.requireUser(), api.requireRole(RoleAdmin))
 
 	ingredient := v1.Group("/ingredient")
 	ingredient.GET("", api.getIngredients)
-	ingredient.POST("", api.postIngredientCatalog)
+	ingredient.POST("", api.postIngredientCatalog, api.requireScope(ScopeCatalogWrite), api.requireRole(RoleEditor))
 	// recipes.GET("/title/:title", api.getRecipeByTitle)
 	// recipes.POST("", api.saveRecipe)
 	// recipes.PUT("/:id", api.updateRecipe)
 	// recipes.DELETE("/:id", api.deleteRecipe)
 
-	shopping_list := v1.Group("/shopping-list")
+	// The user of the shopping list and the inventory is the authenticated user
+	shopping_list := v1.Group("/shopping-list", api.requireUser())
 	shopping_list.GET("", api.getShoppingList)
 	shopping_list.POST("/recipe/:id", api.postIngredientsForRecipeToShoppingList)
 	shopping_list.POST("/ingredient/:id", api.postIngredientToShoppingList)
 	shopping_list.DELETE("/ingredient/:id", api.deleteIngredientForRecipeFromShoppingList)
 	shopping_list.DELETE("/recipe/:recipe_id/ingredient/:id", api.deleteIngredientForRecipeFromShoppingList)
 
-	inventory := v1.Group("/inventory/ingredient")
+	inventory := v1.Group("/inventory/ingredient", api.requireUser())
 	inventory.GET("", api.getInventory)
 	inventory.GET("/:id", api.getIngredientInventory)
 	inventory.POST("", api.postInventory)
 	inventory.PUT("/:id", api.putInventory)
+	inventory.DELETE("/:id", api.deleteInventory)
 	inventory.DELETE("/:id/user/:userId", api.deleteInventory)
 
 	shop := v1.Group("/shop")
-	shop.POST("", api.createShop)
+	shop.POST("", api.createShop, api.requireUser(), api.requireRole(RoleEditor))
 	shop.GET("", api.getShops)
 	shop.GET("/:id", api.getShop)
-	shop.PUT("/:id", api.updateShop)
-	shop.DELETE("/:id", api.deleteShop)
+	shop.PUT("/:id", api.updateShop, api.requireUser(), api.requireRole(RoleEditor))
+	shop.DELETE("/:id", api.deleteShop, api.requireUser(), api.requireRole(RoleAdmin))
 
 	price := v1.Group("/price")
-	price.POST("", api.postPriceCatalog)
+	price.POST("", api.postPriceCatalog, api.requireScope(ScopePriceWrite), api.requireRole(RoleEditor))
 	price.GET("", api.getPrices)
 
 	app := v1.Group("/api")
 	app.POST("/login", api.login)
+	app.POST("/login/2fa", api.loginTOTP)
 	app.POST("/signup", api.signup)
-
-	config := echojwt.Config{
-		NewClaimsFunc: func(c echo.Context) jwt.Claims {
-			return new(jwtCustomClaims)
-		},
-		SigningKey: []byte(conf.JWTSecret),
+	app.POST("/refresh", api.refresh)
+	app.POST("/password/forgot", api.forgotPassword)
+	app.POST("/password/reset", api.resetPassword)
+	app.GET("/verify-email", api.verifyEmail)
+	app.POST("/verify-email/resend", api.resendVerificationEmail)
+	if api.oidc != nil {
+		app.GET("/oidc/login", api.oidcLogin)
+		app.GET("/oidc/callback", api.oidcCallback)
 	}
-	app.Use(echojwt.WithConfig(config))
-	app.POST("/logout", api.logout)
+
+	app.Use(echojwt.WithConfig(api.jwtConfig()))
+	app.POST("/logout", api.extractUser(api.logout))
+	app.GET("/me", api.extractUser(api.getMe))
+	app.PATCH("/me", api.extractUser(api.updateMe))
+	app.DELETE("/me", api.extractUser(api.deleteMe))
+	app.GET("/me/export", api.extractUser(api.exportMe))
+	app.GET("/me/export/:id", api.extractUser(api.getExport))
+	app.PUT("/me/password", api.extractUser(api.changePassword))
+	app.GET("/me/security-events", api.extractUser(api.getSecurityEvents))
+	app.GET("/sessions", api.extractUser(api.getSessions))
+	app.DELETE("/sessions/:id", api.extractUser(api.deleteSession))
+	app.POST("/keys", api.extractUser(api.createApiKey))
+	app.GET("/keys", api.extractUser(api.getApiKeys))
+	app.DELETE("/keys/:prefix", api.extractUser(api.revokeApiKey))
+	app.POST("/2fa/enroll", api.extractUser(api.enrollTOTP))
+	app.POST("/2fa/confirm", api.extractUser(api.confirmTOTP))
+	app.POST("/2fa/disable", api.extractUser(api.disableTOTP))
 	app.GET("/restricted", api.extractUser(api.restricted))
+
+	admin := app.Group("/admin", api.requireRole(RoleAdmin))
+	admin.PUT("/users/:username/role", api.extractUser(api.updateUserRole))
+	admin.DELETE("/users/:username/lockout", api.extractUser(api.unlockUser))
+	admin.DELETE("/ips/:ip/lockout", api.extractUser(api.unlockIP))
+	admin.GET("/security-events", api.extractUser(api.getAuthEvents))
 }
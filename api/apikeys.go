@@ -0,0 +1,170 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gateway/db"
+	"gateway/utils"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ScopeCatalogWrite = "catalog:write"
+	ScopePriceWrite   = "price:write"
+
+	// apiKeyScheme is the scheme of the Authorization header sent with an API key
+	apiKeyScheme     = "ApiKey"
+	apiKeyPrefix     = "gw_"
+	apiKeySecretSize = 32
+	// apiKeyTouchInterval limits the writes of the last used date like sessionTouchInterval
+	apiKeyTouchInterval = time.Minute
+)
+
+// generateApiKey returns a key made of a visible prefix and a secret, like gw_1a2b3c4d.secret
+func generateApiKey() (key string, prefix string, err error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	prefix = apiKeyPrefix + hex.EncodeToString(b)
+	secret, err := utils.GenerateToken(apiKeySecretSize)
+	if err != nil {
+		return "", "", err
+	}
+	return prefix + "." + secret, prefix, nil
+}
+
+// getApiKey returns the API key authenticating the request, nil if it's authenticated by a bearer token
+func getApiKey(c echo.Context) db.ApiKeyDTO {
+	key, _ := c.Get("apiKey").(db.ApiKeyDTO)
+	return key
+}
+
+// requireScope accepts an API key with the scope or a bearer token of a user session
+func (api *ApiHandler) requireScope(scope string) echo.MiddlewareFunc {
+	bearer := api.requireUser()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withBearer := bearer(next)
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			if value, ok := strings.CutPrefix(auth, apiKeyScheme+" "); ok {
+				return api.authenticateApiKey(c, strings.TrimSpace(value), scope, next)
+			}
+			return withBearer(c)
+		}
+	}
+}
+
+func (api *ApiHandler) authenticateApiKey(c echo.Context, value string, scope string, next echo.HandlerFunc) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "authenticateApiKey")
+	unauthorized := NewUnauthorizedError(errors.New("invalid API key"))
+
+	key, err := api.dbh.GetApiKey(ctx, utils.HashToken(value))
+	if err != nil {
+		if !errors.Is(err, db.ErrApiKeyNotFound) {
+			WarnOnError(l, err, "Failed to get API key")
+		}
+		return unauthorized
+	}
+	now := time.Now()
+	if exp := key.GetExpirationDate(); !exp.IsZero() && now.After(exp) {
+		return unauthorized
+	}
+	if !slices.Contains(key.GetScopes(), scope) {
+		return NewForbiddenError(errors.New("the API key doesn't have the scope " + scope))
+	}
+
+	if now.Sub(key.GetLastUsedAt()) > apiKeyTouchInterval {
+		DebugOnError(l, api.dbh.TouchApiKey(ctx, key.GetPrefix(), now), "Failed to touch API key")
+	}
+	c.Set("apiKey", key)
+	return next(c)
+}
+
+func (api *ApiHandler) createApiKey(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "createApiKey")
+	claims := getClaims(c)
+
+	r := new(ApiKeyCreationRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Body param failed")
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	role, err := api.currentRole(c)
+	if err != nil {
+		return err
+	}
+	for _, scope := range r.Scopes {
+		if !role.Includes(scopeRoles[scope]) {
+			return NewForbiddenError(fmt.Errorf("the %v role is required for the scope %v", scopeRoles[scope], scope))
+		}
+	}
+
+	value, prefix, err := generateApiKey()
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	scopes := slices.Clone(r.Scopes)
+	slices.Sort(scopes)
+	request := &db.ApiKeyRequest{
+		Name:     r.Name,
+		Prefix:   prefix,
+		Hash:     utils.HashToken(value),
+		UserID:   claims.UserID,
+		Username: claims.Username,
+		Scopes:   slices.Compact(scopes),
+	}
+	if r.ExpiresInDays > 0 {
+		request.ExpirationDate = time.Now().AddDate(0, 0, r.ExpiresInDays)
+	}
+	key, err := api.dbh.CreateApiKey(ctx, request)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+
+	response := NewApiKeyResponse(key)
+	response.Key = value
+	return c.JSON(http.StatusCreated, response)
+}
+
+func (api *ApiHandler) getApiKeys(c echo.Context) error {
+	ctx := c.Request().Context()
+	claims := getClaims(c)
+	keys, err := api.dbh.GetApiKeys(ctx, claims.UserID)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	response := make([]ApiKeyResponse, len(keys))
+	for i, k := range keys {
+		response[i] = NewApiKeyResponse(k)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func (api *ApiHandler) revokeApiKey(c echo.Context) error {
+	ctx := c.Request().Context()
+	claims := getClaims(c)
+	prefix := c.Param("prefix")
+	if prefix == "" {
+		return NewBadRequestError(errors.New("prefix is required"))
+	}
+	if err := api.dbh.RevokeApiKey(ctx, claims.UserID, prefix); err != nil {
+		if errors.Is(err, db.ErrApiKeyNotFound) {
+			return NewNotFoundError(err)
+		}
+		return NewInternalServerError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
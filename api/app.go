@@ -1,20 +1,23 @@
 package api
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"gateway/db"
 	"gateway/utils"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/sirupsen/logrus"
 )
 
 func (api *ApiHandler) login(c echo.Context) error {
 
+	ctx, span := api.tracer.Start(c.Request().Context(), "api.login")
+	defer span.End()
 	l := logger.WithField("request", "login")
 
 	u := new(UserConnectionRequest)
@@ -25,67 +28,208 @@ func (api *ApiHandler) login(c echo.Context) error {
 		return err
 	}
 
-	user, err := api.dbh.GetUsername(u.Username)
+	if err := api.checkLoginAllowed(c, span, u.Username); err != nil {
+		return err
+	}
 
+	user, err := api.dbh.GetUsername(ctx, u.Username)
+	// An unknown username is a failure like a wrong password, with the same response and about the same time
+	if errors.Is(err, db.ErrUserNotFound) {
+		api.verifyUnknownPassword(u.Password)
+		api.loginFailed(c, span, nil, u.Username)
+		return NewNotFoundError(errors.New("username or password incorrect"))
+	}
 	if err != nil {
 		return NewInternalServerError(err)
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.GetPassword()), []byte(u.Password))
-
-	if err != nil {
+	if !api.verifyPassword(ctx, user, u.Password) {
+		api.loginFailed(c, span, user, u.Username)
 		return NewNotFoundError(errors.New("username or password incorrect"))
 	}
 
-	expirationDate := time.Now().Add(time.Second * 60 * 24 * 30) // 30 days
-	// Set custom claims
-	claims := &jwtCustomClaims{
-		user.GetUsername(),
-		user.GetEmail(),
-		user.GetId(),
-		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationDate),
-		},
+	// A user with TOTP has not finished to login yet, the failures are only reset by loginTOTP
+	if !user.IsTOTPEnabled() {
+		api.loginSucceeded(u.Username)
+	}
+	return api.completeLogin(ctx, c, user)
+}
+
+// completeLogin finishes the login of an authenticated user, with a password or an identity provider
+func (api *ApiHandler) completeLogin(ctx context.Context, c echo.Context, user db.UserDTO) error {
+	if api.conf.EmailVerifyRequired && !user.IsEmailVerified() {
+		return NewForbiddenError(errors.New("email not verified"))
 	}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	// The tokens are only issued once the second factor is checked by loginTOTP
+	if user.IsTOTPEnabled() {
+		challenge, expiration, err := api.signMFAChallenge(user)
+		if err != nil {
+			return NewInternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, echo.Map{
+			"mfaRequired":    true,
+			"challengeToken": challenge,
+			"expiration":     expiration,
+		})
+	}
 
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString([]byte(api.conf.JWTSecret))
+	tokens, err := api.issueTokens(c, user, "")
 	if err != nil {
+		return NewInternalServerError(err)
+	}
+	api.audit(ctx, c, AuthEventLogin, user.GetId(), user.GetUUID(), user.GetUsername())
+
+	return c.JSON(http.StatusOK, newLoginResponse(user, tokens))
+}
+
+func newLoginResponse(user db.UserDTO, tokens *tokenPair) echo.Map {
+	return echo.Map{
+		"token":             tokens.AccessToken,
+		"refreshToken":      tokens.RefreshToken,
+		"email":             user.GetEmail(),
+		"username":          user.GetUsername(),
+		"id":                user.GetId(),
+		"uuid":              user.GetUUID(),
+		"role":              user.GetRole(),
+		"expiration":        tokens.AccessExpiration,
+		"refreshExpiration": tokens.RefreshExpiration,
+	}
+}
+
+func (api *ApiHandler) refresh(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "refresh")
+
+	r := new(TokenRefreshRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Body param failed")
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
 		return err
 	}
 
-	tokenDb := db.TokenRequest{
-		Value:          t,
-		ExpirationDate: expirationDate,
-		UserID:         user.GetId(),
+	unauthorized := NewUnauthorizedError(errors.New("invalid refresh token"))
+	hash := utils.HashToken(r.RefreshToken)
+	refreshToken, err := api.dbh.GetRefreshToken(ctx, hash)
+	if err != nil {
+		DebugOnError(l, err, "Refresh token not found")
+		return unauthorized
+	}
+	if refreshToken.IsRevoked() || refreshToken.GetExpirationDate().Before(time.Now()) {
+		return unauthorized
+	}
+
+	// A refresh token can only be used once, seeing it again means it has been stolen
+	// so the whole family and the current access token are revoked
+	if refreshToken.IsUsed() {
+		return api.revokeReusedRefreshToken(c, l, refreshToken, unauthorized)
+	}
+	if err := api.dbh.UseRefreshToken(ctx, hash); err != nil {
+		if errors.Is(err, db.ErrRefreshTokenReused) {
+			return api.revokeReusedRefreshToken(c, l, refreshToken, unauthorized)
+		}
+		return NewInternalServerError(err)
+	}
+
+	user, err := api.dbh.GetUsername(ctx, refreshToken.GetUsername())
+	if err != nil {
+		DebugOnError(l, err, "User of the refresh token not found")
+		return unauthorized
 	}
-	//Insert the new token in the DB
-	api.dbh.UpsertToken(&tokenDb)
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"token":      t,
-		"email":      user.GetEmail(),
-		"username":   user.GetUsername(),
-		"id":         user.GetId(),
-		"expiration": expirationDate,
-	})
+	tokens, err := api.issueTokens(c, user, refreshToken.GetFamily())
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusOK, newLoginResponse(user, tokens))
+}
+
+func (api *ApiHandler) revokeReusedRefreshToken(c echo.Context, l *logrus.Entry, refreshToken db.RefreshTokenDTO, unauthorized error) error {
+	ctx := c.Request().Context()
+	l.WithFields(logrus.Fields{
+		"family": refreshToken.GetFamily(),
+		"userId": refreshToken.GetUserID(),
+	}).Warn("Refresh token reuse detected, revoking the session")
+	if err := api.dbh.RevokeRefreshTokenFamily(ctx, refreshToken.GetFamily()); err != nil {
+		return NewInternalServerError(err)
+	}
+	err := api.dbh.DeleteSession(ctx, refreshToken.GetUserID(), refreshToken.GetFamily())
+	if err != nil && !errors.Is(err, db.ErrSessionNotFound) {
+		WarnOnError(l, err, "Failed to delete the session")
+	}
+	// The refresh token doesn't have the UUID that keys the events of the user
+	userUUID := ""
+	if user, err := api.dbh.GetUsername(ctx, refreshToken.GetUsername()); err == nil {
+		userUUID = user.GetUUID()
+	}
+	api.audit(ctx, c, AuthEventTokenRevoked, refreshToken.GetUserID(), userUUID, refreshToken.GetUsername())
+	return unauthorized
 }
 
 func (api *ApiHandler) logout(c echo.Context) error {
+	ctx := c.Request().Context()
 	user := c.Get("user").(*jwt.Token)
 	claims := user.Claims.(*jwtCustomClaims)
-	userID := claims.UserID
-	logger.Infof("UsserID token: %v", userID)
-	// userId := fmt.Sprintf("%d", userID)
-	if err := api.dbh.DeleteToken(userID); err != nil {
+	if err := api.revokeSession(ctx, claims.UserID, claims.SessionID); err != nil {
+		if errors.Is(err, db.ErrSessionNotFound) {
+			return NewNotFoundError(err)
+		}
 		return NewInternalServerError(err)
 	}
+	api.audit(c.Request().Context(), c, AuthEventLogout, claims.UserID, claims.UUID, claims.Username)
 	return c.NoContent(http.StatusNoContent)
 }
 
+func (api *ApiHandler) getSessions(c echo.Context) error {
+	ctx := c.Request().Context()
+	claims := getClaims(c)
+	sessions, err := api.dbh.GetSessions(ctx, claims.UserID)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	response := make([]SessionResponse, len(sessions))
+	for i, s := range sessions {
+		response[i] = NewSessionResponse(s, claims.SessionID)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func (api *ApiHandler) deleteSession(c echo.Context) error {
+	ctx := c.Request().Context()
+	claims := getClaims(c)
+	var request IDParam
+	if err := c.Bind(&request); err != nil {
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	if err := api.revokeSession(ctx, claims.UserID, request.ID); err != nil {
+		if errors.Is(err, db.ErrSessionNotFound) {
+			return NewNotFoundError(err)
+		}
+		return NewInternalServerError(err)
+	}
+	api.audit(c.Request().Context(), c, AuthEventTokenRevoked, claims.UserID, claims.UUID, claims.Username)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// revokeSession deletes the session of the user and revokes the refresh tokens bound to it
+func (api *ApiHandler) revokeSession(ctx context.Context, userID string, sessionID string) error {
+	if err := api.dbh.DeleteSession(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	return api.dbh.RevokeRefreshTokenFamily(ctx, sessionID)
+}
+
+func (api *ApiHandler) getJWKS(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(http.StatusOK, api.keyring.JWKS())
+}
+
 func (api *ApiHandler) restricted(c echo.Context) error {
 	// claims := c.Get("user").(*jwtCustomClaims)
 	claims := c.Get("user").(*jwt.Token)
@@ -95,6 +239,7 @@ func (api *ApiHandler) restricted(c echo.Context) error {
 }
 
 func (api *ApiHandler) signup(c echo.Context) error {
+	ctx := c.Request().Context()
 	l := logger.WithField("request", "sign-up")
 
 	u := new(UserCreationRequest)
@@ -105,10 +250,10 @@ func (api *ApiHandler) signup(c echo.Context) error {
 		return err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	hashedPassword, err := api.hashPassword(u.Password)
 	if err != nil {
-		fmt.Println("Error during hash generation:", err)
-		return err
+		FailOnError(l, err, "Error during hash generation")
+		return NewInternalServerError(err)
 	}
 
 	secretKey, err := utils.GenerateSecretKey()
@@ -119,15 +264,20 @@ func (api *ApiHandler) signup(c echo.Context) error {
 	userRequest := db.UserRequest{
 		Email:         u.Email,
 		Username:      u.Username,
-		Password:      string(hashedPassword),
+		Password:      hashedPassword,
 		FirstName:     u.FirstName,
 		LastName:      u.LastName,
 		EncryptionKey: secretKey,
 	}
 
-	_, err = api.dbh.CreateUser(&userRequest)
+	user, err := api.dbh.CreateUser(ctx, &userRequest)
 	if err != nil {
 		return NewConflictError(err)
 	}
+	api.audit(c.Request().Context(), c, AuthEventSignup, user.GetId(), user.GetUUID(), user.GetUsername())
+
+	// The user is created even if the mail can't be sent, the link can be asked again
+	api.emailThrottle.Allow(strings.ToLower(user.GetEmail()))
+	FailOnError(l, api.sendVerificationEmail(user), "Failed to send the verification mail")
 	return c.NoContent(http.StatusCreated)
 }
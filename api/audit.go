@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"gateway/db"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The types of the authentication events
+const (
+	AuthEventSignup          = "signup"
+	AuthEventLogin           = "login"
+	AuthEventLoginFailed     = "login_failed"
+	AuthEventLogout          = "logout"
+	AuthEventPasswordChanged = "password_changed"
+	AuthEventPasswordReset   = "password_reset"
+	AuthEventTokenRevoked    = "token_revoked"
+)
+
+const defaultAuthEventsLimit = 50
+
+// audit records an authentication event with the client of the request and the trace of the context.
+// The events of a user are keyed by its UUID, which is never given to another user.
+// A failure is only logged, the request isn't refused because its event is missing.
+func (api *ApiHandler) audit(ctx context.Context, c echo.Context, eventType string, userID string, userUUID string, username string) {
+	event := &db.AuthEventRequest{
+		Type:      eventType,
+		UserID:    userID,
+		UserUUID:  userUUID,
+		Username:  username,
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		event.TraceID = spanContext.TraceID().String()
+	}
+	l := logger.WithField("event", eventType).WithField("username", username)
+	WarnOnError(l, api.dbh.CreateAuthEvent(ctx, event), "Failed to record the auth event")
+}
+
+// getSecurityEvents returns the authentication events of the current user
+func (api *ApiHandler) getSecurityEvents(c echo.Context) error {
+	r := new(SecurityEventsRequest)
+	if err := c.Bind(r); err != nil {
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	filter := r.filter()
+	filter.UserUUID = getClaims(c).UUID
+	return api.sendAuthEvents(c, filter)
+}
+
+// getAuthEvents lets an admin search the authentication events of every user
+func (api *ApiHandler) getAuthEvents(c echo.Context) error {
+	r := new(AdminSecurityEventsRequest)
+	if err := c.Bind(r); err != nil {
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	filter := r.filter()
+	filter.UserID = r.UserID
+	filter.Username = r.Username
+	filter.IP = r.IP
+	return api.sendAuthEvents(c, filter)
+}
+
+func (r *SecurityEventsRequest) filter() *db.AuthEventFilter {
+	limit := r.Limit
+	if limit == 0 {
+		limit = defaultAuthEventsLimit
+	}
+	return &db.AuthEventFilter{
+		Type:  r.Type,
+		Since: r.Since,
+		Until: r.Until,
+		Limit: limit,
+	}
+}
+
+func (api *ApiHandler) sendAuthEvents(c echo.Context, filter *db.AuthEventFilter) error {
+	ctx := c.Request().Context()
+	events, err := api.dbh.GetAuthEvents(ctx, filter)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	response := make([]AuthEventResponse, len(events))
+	for i, event := range events {
+		response[i] = NewAuthEventResponse(event)
+	}
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"gateway/db"
+	"gateway/mailer"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const emailVerificationAudience = "email-verification"
+
+type emailVerificationClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+func (api *ApiHandler) signEmailVerification(user db.UserDTO) (string, error) {
+	now := time.Now()
+	claims := &emailVerificationClaims{
+		Email: user.GetEmail(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.GetId(),
+			Audience:  jwt.ClaimStrings{emailVerificationAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(api.conf.EmailVerifyTTL)),
+		},
+	}
+	return api.signInternalToken(claims)
+}
+
+func (api *ApiHandler) parseEmailVerification(token string) (*emailVerificationClaims, error) {
+	claims := new(emailVerificationClaims)
+	if err := api.parseInternalToken(token, claims, emailVerificationAudience); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// sendVerificationEmail sends the verification link to the email of the user
+func (api *ApiHandler) sendVerificationEmail(user db.UserDTO) error {
+	token, err := api.signEmailVerification(user)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%v%v/api/verify-email?token=%v", api.conf.PublicURL, api.conf.ListenRoute, url.QueryEscape(token))
+	return api.mailer.Send(&mailer.Message{
+		To:      user.GetEmail(),
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hello %v,\n\nFollow this link to verify your email, it expires in %v:\n%v",
+			user.GetUsername(), api.conf.EmailVerifyTTL, link),
+	})
+}
+
+// sendInBackground sends a mail off the request path, so the response takes the same time
+// whether a mail is sent or not
+func (api *ApiHandler) sendInBackground(l *logrus.Entry, msg string, send func() error) {
+	api.mails.Add(1)
+	go func() {
+		defer api.mails.Done()
+		FailOnError(l, send(), msg)
+	}()
+}
+
+func (api *ApiHandler) verifyEmail(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "verifyEmail")
+
+	token := c.QueryParam("token")
+	if token == "" {
+		return NewBadRequestError(errors.New("token query param is required"))
+	}
+	invalid := NewBadRequestError(errors.New("invalid or expired verification link"))
+	claims, err := api.parseEmailVerification(token)
+	if err != nil {
+		DebugOnError(l, err, "Invalid verification token")
+		return invalid
+	}
+
+	// The link is refused if the email of the user has changed since it was sent
+	if err := api.dbh.VerifyEmail(ctx, claims.Subject, claims.Email); err != nil {
+		if errors.Is(err, db.ErrEmailMismatch) {
+			return invalid
+		}
+		return NewInternalServerError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"message": "email verified", "email": claims.Email})
+}
+
+func (api *ApiHandler) resendVerificationEmail(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "resendVerificationEmail")
+
+	r := new(ResendVerificationRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Body param failed")
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	// The throttle applies to unknown emails too, to not disclose the registered ones
+	if ok, wait := api.emailThrottle.Allow(strings.ToLower(r.Email)); !ok {
+		setRetryAfter(c, wait)
+		return NewTooManyRequestsError(errors.New("a verification email has already been sent recently"))
+	}
+
+	user, err := api.dbh.GetUserByEmail(ctx, r.Email)
+	if err != nil {
+		if !errors.Is(err, db.ErrUserNotFound) {
+			return NewInternalServerError(err)
+		}
+		DebugOnError(l, err, "No user found for the email")
+		return c.NoContent(http.StatusAccepted)
+	}
+	if !user.IsEmailVerified() {
+		api.sendInBackground(l, "Failed to send the verification mail", func() error {
+			return api.sendVerificationEmail(user)
+		})
+	}
+	return c.NoContent(http.StatusAccepted)
+}
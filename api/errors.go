@@ -63,6 +63,26 @@ func NewUnauthorizedError(err error) error {
 	return echo.NewHTTPError(jsonError.Code, jsonError)
 }
 
+func NewForbiddenError(err error) error {
+	jsonError := EchoError{
+		Code:     http.StatusForbidden,
+		Message:  "Forbidden Error",
+		Error:    err.Error(),
+		IssuedAt: time.Now(),
+	}
+	return echo.NewHTTPError(jsonError.Code, jsonError)
+}
+
+func NewTooManyRequestsError(err error) error {
+	jsonError := EchoError{
+		Code:     http.StatusTooManyRequests,
+		Message:  "Too Many Requests Error",
+		Error:    err.Error(),
+		IssuedAt: time.Now(),
+	}
+	return echo.NewHTTPError(jsonError.Code, jsonError)
+}
+
 func NewBadRequestError(err error) error {
 	jsonError := EchoError{
 		Code:     http.StatusBadRequest,
@@ -73,6 +93,16 @@ func NewBadRequestError(err error) error {
 	return echo.NewHTTPError(jsonError.Code, jsonError)
 }
 
+func NewServiceUnavailableError(err error) error {
+	jsonError := EchoError{
+		Code:     http.StatusServiceUnavailable,
+		Message:  "Service Unavailable Error",
+		Error:    err.Error(),
+		IssuedAt: time.Now(),
+	}
+	return echo.NewHTTPError(jsonError.Code, jsonError)
+}
+
 func NewUnprocessableEntityError(err error) error {
 	jsonError := EchoError{
 		Code:     http.StatusUnprocessableEntity,
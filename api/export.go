@@ -0,0 +1,323 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/db"
+	"gateway/utils"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const exportJobIDSize = 16
+
+// exportArchive is the personal data of a user, the data of the services is kept as they return it
+type exportArchive struct {
+	ExportedAt   time.Time       `json:"exportedAt"`
+	Profile      UserResponse    `json:"profile"`
+	Recipes      json.RawMessage `json:"recipes"`
+	Inventory    json.RawMessage `json:"inventory"`
+	ShoppingList json.RawMessage `json:"shoppingList"`
+}
+
+type exportJob struct {
+	id       string
+	userUUID string
+	format   string
+	filename string
+	// done is closed once the archive or the error is set
+	done      chan struct{}
+	archive   []byte
+	err       error
+	expiresAt time.Time
+}
+
+func (j *exportJob) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// exportJobs keeps the archives built in the background until they expire.
+// Like throttle it's kept in memory, so an export must be downloaded from the replica that built it.
+type exportJobs struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	jobs map[string]*exportJob
+	now  func() time.Time
+}
+
+func newExportJobs(ttl time.Duration) *exportJobs {
+	return &exportJobs{
+		ttl:  ttl,
+		jobs: map[string]*exportJob{},
+		now:  time.Now,
+	}
+}
+
+// Start runs the build in the background, the job expires ttl after the build ends
+func (e *exportJobs) Start(userUUID string, format string, filename string, build func() ([]byte, error)) (*exportJob, error) {
+	id, err := utils.GenerateToken(exportJobIDSize)
+	if err != nil {
+		return nil, err
+	}
+	job := &exportJob{
+		id:       id,
+		userUUID: userUUID,
+		format:   format,
+		filename: filename,
+		done:     make(chan struct{}),
+	}
+
+	e.mu.Lock()
+	e.cleanup()
+	e.jobs[id] = job
+	e.mu.Unlock()
+
+	go func() {
+		archive, err := build()
+		e.mu.Lock()
+		job.archive, job.err = archive, err
+		job.expiresAt = e.now().Add(e.ttl)
+		e.mu.Unlock()
+		close(job.done)
+	}()
+	return job, nil
+}
+
+// Get returns nil if the job doesn't exist, has expired or belongs to another user
+func (e *exportJobs) Get(id string, userUUID string) *exportJob {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cleanup()
+	job, ok := e.jobs[id]
+	if !ok || job.userUUID != userUUID {
+		return nil
+	}
+	return job
+}
+
+// Pending returns the export of the user that is still being built
+func (e *exportJobs) Pending(userUUID string) *exportJob {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, job := range e.jobs {
+		if job.userUUID == userUUID && !job.finished() {
+			return job
+		}
+	}
+	return nil
+}
+
+func (e *exportJobs) Remove(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.jobs, id)
+}
+
+// cleanup removes the expired jobs, the lock must be held
+func (e *exportJobs) cleanup() {
+	now := e.now()
+	for id, job := range e.jobs {
+		if !job.expiresAt.IsZero() && now.After(job.expiresAt) {
+			delete(e.jobs, id)
+		}
+	}
+}
+
+// exportMe returns the archive when it's built within ExportSyncTimeout,
+// otherwise the build continues as a job to download from the Location
+func (api *ApiHandler) exportMe(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "api.exportMe")
+	defer span.End()
+	l := logger.WithField("request", "exportMe")
+
+	r := new(ExportRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Query param failed")
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	if r.Format == "" {
+		r.Format = "json"
+	}
+
+	user, err := api.dbh.GetUsername(ctx, getClaims(c).Username)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+
+	// A user builds one export at a time
+	if job := api.exports.Pending(user.GetUUID()); job != nil {
+		return api.acceptExport(c, job)
+	}
+
+	filename := fmt.Sprintf("export-%v-%v.%v", user.GetUsername(), time.Now().Format("2006-01-02"), r.Format)
+	job, err := api.exports.Start(user.GetUUID(), r.Format, filename, func() ([]byte, error) {
+		// The job outlives the request when it's too long
+		buildCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), api.conf.ExportBuildTimeout)
+		defer cancel()
+		return api.buildExport(buildCtx, user, r.Format)
+	})
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	span.SetAttributes(attribute.String("format", r.Format))
+
+	select {
+	case <-job.done:
+		api.exports.Remove(job.id)
+		return api.sendExport(c, job)
+	case <-time.After(api.conf.ExportSyncTimeout):
+		span.SetAttributes(attribute.Bool("background", true))
+		return api.acceptExport(c, job)
+	}
+}
+
+func (api *ApiHandler) getExport(c echo.Context) error {
+	var request IDParam
+	if err := c.Bind(&request); err != nil {
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	job := api.exports.Get(request.ID, getClaims(c).UUID)
+	if job == nil {
+		return NewNotFoundError(errors.New("export not found or expired"))
+	}
+	if !job.finished() {
+		return api.acceptExport(c, job)
+	}
+	return api.sendExport(c, job)
+}
+
+func (api *ApiHandler) acceptExport(c echo.Context, job *exportJob) error {
+	location := fmt.Sprintf("%v/api/me/export/%v", api.conf.ListenRoute, job.id)
+	c.Response().Header().Set(echo.HeaderLocation, location)
+	return c.JSON(http.StatusAccepted, echo.Map{"id": job.id, "status": "pending", "location": location})
+}
+
+func (api *ApiHandler) sendExport(c echo.Context, job *exportJob) error {
+	if job.err != nil {
+		return NewInternalServerError(job.err)
+	}
+	contentType := echo.MIMEApplicationJSON
+	if job.format == "zip" {
+		contentType = "application/zip"
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", job.filename))
+	return c.Blob(http.StatusOK, contentType, job.archive)
+}
+
+// buildExport gathers the data of the user from the gateway and the services
+func (api *ApiHandler) buildExport(ctx context.Context, user db.UserDTO, format string) ([]byte, error) {
+	ctx, span := api.tracer.Start(ctx, "api.buildExport")
+	defer span.End()
+
+	archive := exportArchive{
+		ExportedAt: time.Now(),
+		Profile:    NewUserResponse(user),
+	}
+	userID := url.QueryEscape(user.GetUUID())
+	sources := []struct {
+		url  string
+		data *json.RawMessage
+	}{
+		{url: fmt.Sprintf("%s/recipe/user/%s", api.conf.RecipeMSURL, url.PathEscape(user.GetUUID())), data: &archive.Recipes},
+		{url: fmt.Sprintf("%s/inventory/ingredient?userId=%s", api.conf.InventoryMSURL, userID), data: &archive.Inventory},
+		{url: fmt.Sprintf("%s/shopping-list?userId=%s", api.conf.ShoppingListMSURL, userID), data: &archive.ShoppingList},
+	}
+	for _, source := range sources {
+		data, err := api.fetchExportData(ctx, source.url)
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		*source.data = data
+	}
+
+	if format == "zip" {
+		return zipExport(&archive)
+	}
+	return json.MarshalIndent(&archive, "", "  ")
+}
+
+// fetchExportData returns the JSON body of the service, a 404 means the user has no data there
+func (api *ApiHandler) fetchExportData(ctx context.Context, dataUrl string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dataUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error querying %v: %w", dataUrl, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return json.RawMessage("[]"), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from %v: %d", dataUrl, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("invalid JSON from %v", dataUrl)
+	}
+	return body, nil
+}
+
+// zipExport writes a file per part of the archive
+func zipExport(archive *exportArchive) ([]byte, error) {
+	profile, err := json.MarshalIndent(map[string]any{
+		"exportedAt": archive.ExportedAt,
+		"profile":    archive.Profile,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{name: "profile.json", data: profile},
+		{name: "recipes.json", data: archive.Recipes},
+		{name: "inventory.json", data: archive.Inventory},
+		{name: "shopping-list.json", data: archive.ShoppingList},
+	}
+
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for _, file := range files {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: archive.ExportedAt})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
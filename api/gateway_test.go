@@ -1,16 +1,37 @@
 package api
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"gateway/configuration"
 	"gateway/db"
+	"gateway/db/dbtest"
+	"gateway/mailer"
+	"gateway/messages"
+	"gateway/oidc"
+	"gateway/oidc/oidctest"
+	"gateway/utils"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/labstack/echo/v4"
+
 	dockertest "github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
 	"github.com/sirupsen/logrus"
@@ -20,6 +41,7 @@ import (
 
 var (
 	postgresClient      *gorm.DB
+	postgresErr         error
 	postgresPool        *dockertest.Pool
 	postgresResource    *dockertest.Resource
 	once                sync.Once
@@ -39,96 +61,101 @@ func SeedDatabase(pg *gorm.DB) {
 	}
 }
 
-// InitTestPostgres initializes a single PostgresDB instance for all tests
+// InitTestPostgres initializes a single PostgresDB instance for all tests, the first call starts it
 func InitTestPostgres() (*gorm.DB, error) {
-	var initErr error
 	once.Do(func() {
-		// Create a new pool
-		pool, err := dockertest.NewPool("")
-		if err != nil {
-			initErr = fmt.Errorf("could not construct pool: %w", err)
-			return
+		postgresErr = initTestPostgres()
+		if postgresErr == nil {
+			SeedDatabase(postgresClient)
 		}
+	})
+	return postgresClient, postgresErr
+}
 
-		postgresPool = pool
+func initTestPostgres() (initErr error) {
+	// Create a new pool
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		initErr = fmt.Errorf("could not construct pool: %w", err)
+		return
+	}
 
-		// Set a timeout for docker operations
-		pool.MaxWait = time.Second * 30
+	postgresPool = pool
 
-		// Start PostgresDB container
-		resource, err := pool.RunWithOptions(&dockertest.RunOptions{
-			Repository: "bitnami/postgresql",
-			Tag:        "latest",
-			Env: []string{
-				fmt.Sprintf("POSTGRESQL_DATABASE=%v", DBName),
-				fmt.Sprintf("POSTGRESQL_USERNAME=%v", DBUser),
-				fmt.Sprintf("POSTGRESQL_PASSWORD=%v", DBPassword),
-			},
-		}, func(config *docker.HostConfig) {
-			config.AutoRemove = true
-			config.RestartPolicy = docker.RestartPolicy{Name: "no"}
-		})
+	// Set a timeout for docker operations
+	pool.MaxWait = time.Second * 30
 
-		if err != nil {
-			initErr = fmt.Errorf("could not start resource: %w", err)
-			return
-		}
+	// Start PostgresDB container
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "bitnami/postgresql",
+		Tag:        "latest",
+		Env: []string{
+			fmt.Sprintf("POSTGRESQL_DATABASE=%v", DBName),
+			fmt.Sprintf("POSTGRESQL_USERNAME=%v", DBUser),
+			fmt.Sprintf("POSTGRESQL_PASSWORD=%v", DBPassword),
+		},
+	}, func(config *docker.HostConfig) {
+		config.AutoRemove = true
+		config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+
+	if err != nil {
+		initErr = fmt.Errorf("could not start resource: %w", err)
+		return
+	}
 
-		postgresResource = resource
-		DBPort = resource.GetPort("5432/tcp")
-		dsn := fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=%v TimeZone=%v ",
-			DBHost,
-			DBPort,
-			DBUser,
-			DBPassword,
-			DBName,
-			"disable",
-			"Europe/Paris")
+	postgresResource = resource
+	DBPort = resource.GetPort("5432/tcp")
+	dsn := fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=%v TimeZone=%v ",
+		DBHost,
+		DBPort,
+		DBUser,
+		DBPassword,
+		DBName,
+		"disable",
+		"Europe/Paris")
 
-		gormLogger := db.NewGormLogger()
+	gormLogger := db.NewGormLogger()
 
-		// Initialize postgres client
-		logger.Info("Connecting to DB: " + dsn)
-		// Retry connection with timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
-		defer cancel()
+	// Initialize postgres client
+	logger.Info("Connecting to DB: " + dsn)
+	// Retry connection with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
 
-		ticker := time.NewTicker(300 * time.Millisecond)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				initErr = fmt.Errorf("timeout waiting for postgresdb to be ready")
-				return
-			case <-ticker.C:
-				client, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-					Logger: gormLogger,
-				})
-				if err != nil {
-					continue
-				}
+	ticker := time.NewTicker(300 * time.Millisecond)
+	defer ticker.Stop()
 
-				// Try to ping
-				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-				defer cancel()
-				db, err := client.WithContext(ctx).DB()
-				if err != nil {
-					continue
-				}
+	for {
+		select {
+		case <-ctx.Done():
+			initErr = fmt.Errorf("timeout waiting for postgresdb to be ready")
+			return
+		case <-ticker.C:
+			client, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+				Logger: gormLogger,
+			})
+			if err != nil {
+				continue
+			}
 
-				if err := db.Ping(); err != nil {
-					_ = db.Close()
-					continue
-				}
+			// Try to ping
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			db, err := client.WithContext(ctx).DB()
+			if err != nil {
+				continue
+			}
 
-				postgresClient = client
-				return
+			if err := db.Ping(); err != nil {
+				_ = db.Close()
+				continue
 			}
-		}
-	})
 
-	return postgresClient, initErr
+			postgresClient = client
+			return
+		}
+	}
 }
 
 // CleanupDatabase removes all data from the test database
@@ -137,60 +164,84 @@ func CleanupDatabase(t *testing.T, client *gorm.DB) {
 	// client.Exec("DROP TABLE tokens")
 }
 
+// setupTest returns a handler on a new memory backend, the handlers are tested without containers
 func setupTest(t *testing.T) (*ApiHandler, func()) {
 	t.Helper()
 
-	// Use existing PostgresDB instance
-	client := postgresClient
-	if client == nil {
-		t.Fatal("PostgresDB client not initialized")
+	// Create API handler
+	conf := &configuration.Configuration{
+		ListenAddress:      "localhost",
+		ListenPort:         "3000",
+		LogLevel:           logrus.DebugLevel,
+		DBName:             DBName,
+		DBUser:             DBUser,
+		DBPassword:         DBPassword,
+		DBPort:             DBPort,
+		DBHost:             DBHost,
+		DBSSLMode:          "disable",
+		DBTimezone:         "Europe/Paris",
+		Environment:        "development",
+		JWTSecret:          "secret",
+		AccessTokenTTL:     time.Hour,
+		RefreshTokenTTL:    time.Hour,
+		MFAChallengeTTL:    time.Minute,
+		LoginMaxFailures:   5,
+		LoginMaxIPFailures: 20,
+		LoginBackoff:       time.Second,
+		LoginLockout:       time.Minute,
+		ExportTTL:          time.Hour,
+		ExportBuildTimeout: time.Minute,
 	}
 
-	// Clean the database
-	//CleanupDatabase(t, client)
+	api := NewApiHandler(db.NewMemoryHandler(), nil, conf)
 
-	// Initialize the database
-	//SeedDatabase(client)
+	// Return cleanup function
+	return api, func() {}
+}
 
-	// Create API handler
-	conf := &configuration.Configuration{
-		ListenAddress: "localhost",
-		ListenPort:    "3000",
-		LogLevel:      logrus.DebugLevel,
-		DBName:        DBName,
-		DBUser:        DBUser,
-		DBPassword:    DBPassword,
-		DBPort:        DBPort,
-		DBHost:        DBHost,
-		DBSSLMode:     "disable",
-		DBTimezone:    "Europe/Paris",
-	}
-
-	db, err := db.NewPostgresHandler(conf)
+// setupPostgres replaces the backend of the handler with the docker PostgresDB, the test is skipped without docker
+func setupPostgres(t *testing.T, api *ApiHandler) {
+	t.Helper()
+	client, err := InitTestPostgres()
 	if err != nil {
-		t.Fatalf("Failed to create PostgresDB handler: %v", err)
+		t.Skipf("PostgresDB not available: %v", err)
 	}
-	api := NewApiHandler(db, nil, conf)
+	CleanupDatabase(t, client)
 
-	// Return cleanup function
-	return api, func() {
-		CleanupDatabase(t, client)
+	api.conf.DBPort = DBPort
+	pg, err := db.NewPostgresHandler(api.conf)
+	if err != nil {
+		t.Fatalf("Failed to create PostgresDB handler: %v", err)
 	}
+	api.dbh = pg
 }
 
-func TestMain(m *testing.M) {
-	// Setup
-	client, err := InitTestPostgres()
-	SeedDatabase(client)
-	if err != nil {
-		log.Fatalf("Could not start PostgresDB: %s", err)
+// setupServer registers the routes of the handler on a new echo server
+func setupServer(api *ApiHandler) *echo.Echo {
+	e := New(api.validation, api.conf)
+	api.Register(e.Group(""), api.conf)
+	return e
+}
+
+// doRequest sends the JSON body to the server and returns the recorded response
+func doRequest(e *echo.Echo, method string, path string, body any, headers ...string) *httptest.ResponseRecorder {
+	encoded, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
 	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
 
-	// Run tests
+func TestMain(m *testing.M) {
+	// Run tests, the PostgresDB is only started by the tests that need it
 	code := m.Run()
 
 	// Cleanup
-	if client != nil {
+	if client := postgresClient; client != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
 		pg, err := client.WithContext(ctx).DB() // Disconnect(ctx)
@@ -224,7 +275,7 @@ func TestDB(t *testing.T) {
 					Username: "user1",
 					Password: "password",
 				}
-				u1, err := api.dbh.CreateUser(&user1)
+				u1, err := api.dbh.CreateUser(context.Background(), &user1)
 				if err != nil {
 					t.Fatalf("Failed to insert user: %v", err)
 				}
@@ -235,7 +286,7 @@ func TestDB(t *testing.T) {
 				}
 
 				// Retrieve the user from the DB
-				u2, err := api.dbh.GetUsername("user1")
+				u2, err := api.dbh.GetUsername(context.Background(), "user1")
 				if err != nil {
 					t.Fatalf("Failed to get user: %v", err)
 				}
@@ -250,14 +301,16 @@ func TestDB(t *testing.T) {
 				api, cleanup := setupTest(t)
 				defer cleanup()
 				userId := "900"
+				sessionId := "session-900"
 				value := "token1"
 				token1 := db.TokenRequest{
+					SessionID:      sessionId,
 					UserID:         userId,
 					Value:          value,
 					ExpirationDate: time.Now().UTC().Add(time.Hour),
 				}
 
-				t1, err := api.dbh.UpsertToken(&token1)
+				t1, err := api.dbh.UpsertToken(context.Background(), &token1)
 				if err != nil {
 					t.Fatalf("Failed to insert token: %v", err)
 				}
@@ -269,11 +322,11 @@ func TestDB(t *testing.T) {
 					t.Fatalf("Token not inserted: %v", t1)
 				}
 
-				t2, err := api.dbh.GetTokenUser(value, userId)
+				t2, err := api.dbh.GetTokenUser(context.Background(), value, userId, sessionId)
 				if err != nil {
 					t.Fatalf("Failed to get token: %v", err)
 				}
-				if t2.GetValue() != value || t2.GetUserID() != userId {
+				if t2.GetValue() != value || t2.GetUserID() != userId || t2.GetSessionID() != sessionId {
 					t.Fatalf("Token not retrieved: %v", t2)
 				}
 
@@ -300,21 +353,23 @@ func TestDB(t *testing.T) {
 				exp2 := time.Now().UTC().Add(time.Hour * 2)
 
 				t1 := &db.TokenRequest{
+					SessionID:      "session-1004",
 					UserID:         userId1,
 					Value:          value1,
 					ExpirationDate: exp1,
 				}
 				t2 := &db.TokenRequest{
+					SessionID:      "session-1005",
 					UserID:         userId2,
 					Value:          value2,
 					ExpirationDate: exp2,
 				}
 
-				_, err := api.dbh.UpsertToken(t1)
+				_, err := api.dbh.UpsertToken(context.Background(), t1)
 				if err != nil {
 					t.Fatalf("Failed to insert token: %v", err)
 				}
-				_, err = api.dbh.UpsertToken(t2)
+				_, err = api.dbh.UpsertToken(context.Background(), t2)
 				if err != nil {
 					t.Fatalf("Failed to insert token: %v", err)
 				}
@@ -323,12 +378,12 @@ func TestDB(t *testing.T) {
 				t1.Value = "newToken"
 				newExp := time.Now().UTC().Add(time.Hour * 3)
 				t1.ExpirationDate = newExp
-				_, err = api.dbh.UpsertToken(t1)
+				_, err = api.dbh.UpsertToken(context.Background(), t1)
 				if err != nil {
 					t.Fatalf("Failed to insert token: %v", err)
 				}
 				// Ensure the first token has changed
-				t5, err := api.dbh.GetTokenUser("newToken", userId1)
+				t5, err := api.dbh.GetTokenUser(context.Background(), "newToken", userId1, t1.SessionID)
 				if err != nil {
 					t.Fatalf("Failed to get token: %v", err)
 				}
@@ -337,7 +392,7 @@ func TestDB(t *testing.T) {
 				}
 
 				// Retrieve the 2nd token and check if it's the same
-				t6, err := api.dbh.GetTokenUser(value2, userId2)
+				t6, err := api.dbh.GetTokenUser(context.Background(), value2, userId2, t2.SessionID)
 				if err != nil {
 					t.Fatalf("Failed to get token: %v", err)
 				}
@@ -354,26 +409,128 @@ func TestDB(t *testing.T) {
 				userId := "11"
 				value := "token"
 				token := db.TokenRequest{
+					SessionID:      "session-11",
 					UserID:         userId,
 					Value:          value,
 					ExpirationDate: time.Now().UTC().Add(time.Hour),
 				}
-				_, err := api.dbh.UpsertToken(&token)
+				_, err := api.dbh.UpsertToken(context.Background(), &token)
 				if err != nil {
 					t.Fatalf("Failed to insert token: %v", err)
 				}
-				err = api.dbh.DeleteToken(userId)
+				err = api.dbh.DeleteToken(context.Background(), userId)
 				if err != nil {
 					t.Fatalf("Failed to delete token: %v", err)
 				}
 
 				// Check if the token has been deleted
-				t2, err := api.dbh.GetTokenUser(value, userId)
+				t2, err := api.dbh.GetTokenUser(context.Background(), value, userId, token.SessionID)
 				if err == nil {
 					t.Fatalf("Token not deleted: %v", t2)
 				}
 			},
 		},
+		{
+			name: "A user can have several sessions and delete one of them",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				userId := "30"
+				laptop := db.TokenRequest{
+					SessionID:      "session-30-laptop",
+					UserID:         userId,
+					Value:          "laptop-token",
+					ExpirationDate: time.Now().UTC().Add(time.Hour),
+					UserAgent:      "laptop",
+					IP:             "10.0.0.1",
+				}
+				phone := laptop
+				phone.SessionID = "session-30-phone"
+				phone.Value = "phone-token"
+				phone.UserAgent = "phone"
+
+				for _, s := range []*db.TokenRequest{&laptop, &phone} {
+					if _, err := api.dbh.UpsertToken(context.Background(), s); err != nil {
+						t.Fatalf("Failed to insert session: %v", err)
+					}
+				}
+
+				sessions, err := api.dbh.GetSessions(context.Background(), userId)
+				if err != nil {
+					t.Fatalf("Failed to get sessions: %v", err)
+				}
+				if len(sessions) != 2 {
+					t.Fatalf("Expected 2 sessions, got %v", len(sessions))
+				}
+
+				// A session of another user can't be deleted
+				if err := api.dbh.DeleteSession(context.Background(), "31", laptop.SessionID); !errors.Is(err, db.ErrSessionNotFound) {
+					t.Fatalf("Expected session not found, got %v", err)
+				}
+
+				if err := api.dbh.DeleteSession(context.Background(), userId, phone.SessionID); err != nil {
+					t.Fatalf("Failed to delete session: %v", err)
+				}
+				if _, err := api.dbh.GetTokenUser(context.Background(), phone.Value, userId, phone.SessionID); err == nil {
+					t.Fatalf("Session not deleted: %v", phone.SessionID)
+				}
+				l, err := api.dbh.GetTokenUser(context.Background(), laptop.Value, userId, laptop.SessionID)
+				if err != nil {
+					t.Fatalf("Failed to get session: %v", err)
+				}
+				if l.GetUserAgent() != laptop.UserAgent || l.GetIP() != laptop.IP {
+					t.Fatalf("Session device not saved: %v", l)
+				}
+			},
+		},
+		{
+			name: "Refresh token can only be used once and its family can be revoked",
+			test: func(t *testing.T) {
+				api, cleanup := setupTest(t)
+				defer cleanup()
+				family := "family-1"
+				rt1 := db.RefreshTokenRequest{
+					Hash:           "hash-1",
+					Family:         family,
+					UserID:         "20",
+					Username:       "user20",
+					ExpirationDate: time.Now().UTC().Add(time.Hour),
+				}
+				rt2 := rt1
+				rt2.Hash = "hash-2"
+
+				for _, rt := range []*db.RefreshTokenRequest{&rt1, &rt2} {
+					if _, err := api.dbh.CreateRefreshToken(context.Background(), rt); err != nil {
+						t.Fatalf("Failed to insert refresh token: %v", err)
+					}
+				}
+
+				if err := api.dbh.UseRefreshToken(context.Background(), rt1.Hash); err != nil {
+					t.Fatalf("Failed to use refresh token: %v", err)
+				}
+				if err := api.dbh.UseRefreshToken(context.Background(), rt1.Hash); !errors.Is(err, db.ErrRefreshTokenReused) {
+					t.Fatalf("Expected reuse error, got %v", err)
+				}
+
+				if err := api.dbh.RevokeRefreshTokenFamily(context.Background(), family); err != nil {
+					t.Fatalf("Failed to revoke refresh token family: %v", err)
+				}
+				r2, err := api.dbh.GetRefreshToken(context.Background(), rt2.Hash)
+				if err != nil {
+					t.Fatalf("Failed to get refresh token: %v", err)
+				}
+				if !r2.IsRevoked() || r2.IsUsed() || r2.GetFamily() != family || r2.GetUserID() != rt2.UserID {
+					t.Fatalf("Refresh token not revoked: %v", r2)
+				}
+
+				if err := api.dbh.DeleteRefreshTokens(context.Background(), rt1.UserID); err != nil {
+					t.Fatalf("Failed to delete refresh tokens: %v", err)
+				}
+				if r, err := api.dbh.GetRefreshToken(context.Background(), rt1.Hash); err == nil {
+					t.Fatalf("Refresh token not deleted: %v", r)
+				}
+			},
+		},
 	}
 	for _, tt := range tests {
 		tt := tt // capture range variable
@@ -383,3 +540,1282 @@ func TestDB(t *testing.T) {
 		})
 	}
 }
+
+func TestPasswordReset(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	api.conf.PasswordResetTTL = time.Hour
+	e := setupServer(api)
+
+	username, email := "resetuser", "resetuser@test.me"
+	rec := doRequest(e, http.MethodPost, "/api/signup", echo.Map{
+		"username": username,
+		"email":    email,
+		"password": "oldPassword",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to sign up: %v", rec.Body.String())
+	}
+	// The mails are only recorded after the verification mail of the signup
+	mailFile := filepath.Join(t.TempDir(), "mails")
+	api.mailer = mailer.NewLogMailer(mailFile)
+
+	// An unknown email is accepted the same way but no mail is sent
+	rec = doRequest(e, http.MethodPost, "/api/password/forgot", echo.Map{"email": "unknown@test.me"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected %v, got %v", http.StatusAccepted, rec.Code)
+	}
+	api.mails.Wait()
+	if _, err := os.Stat(mailFile); err == nil {
+		t.Fatalf("A mail has been sent to an unknown email")
+	}
+
+	rec = doRequest(e, http.MethodPost, "/api/password/forgot", echo.Map{"email": email})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected %v, got %v", http.StatusAccepted, rec.Code)
+	}
+	api.mails.Wait()
+	content, err := os.ReadFile(mailFile)
+	if err != nil {
+		t.Fatalf("Failed to read mail: %v", err)
+	}
+	match := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`).FindStringSubmatch(string(content))
+	if match == nil {
+		t.Fatalf("No token in the mail: %v", string(content))
+	}
+	reset := echo.Map{"token": match[1], "password": "newPassword"}
+
+	// A password with the username is refused without consuming the token
+	rec = doRequest(e, http.MethodPost, "/api/password/reset", echo.Map{"token": match[1], "password": username + "Password"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v for a password with the username, got %v", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = doRequest(e, http.MethodPost, "/api/password/reset", reset)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Failed to reset password: %v", rec.Body.String())
+	}
+	// The token can only be used once
+	rec = doRequest(e, http.MethodPost, "/api/password/reset", reset)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v when reusing the token, got %v", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": username, "password": "oldPassword"})
+	if rec.Code == http.StatusOK {
+		t.Fatalf("Old password still accepted")
+	}
+	rec = doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": username, "password": "newPassword"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to login with the new password: %v", rec.Body.String())
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	mailFile := filepath.Join(t.TempDir(), "mails")
+	api.mailer = mailer.NewLogMailer(mailFile)
+	api.conf.EmailVerifyRequired = true
+	api.conf.EmailVerifyTTL = time.Hour
+	api.emailThrottle = newThrottle(time.Hour)
+	e := setupServer(api)
+
+	username, email, password := "verifyuser", "verifyuser@test.me", "password"
+	rec := doRequest(e, http.MethodPost, "/api/signup", echo.Map{
+		"username": username,
+		"email":    email,
+		"password": password,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to sign up: %v", rec.Body.String())
+	}
+
+	login := echo.Map{"username": username, "password": password}
+	rec = doRequest(e, http.MethodPost, "/api/login", login)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected %v before the verification, got %v", http.StatusForbidden, rec.Code)
+	}
+
+	// The signup mail counts for the throttling
+	rec = doRequest(e, http.MethodPost, "/api/verify-email/resend", echo.Map{"email": email})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected %v with Retry-After, got %v", http.StatusTooManyRequests, rec.Code)
+	}
+	// Once the throttle has passed, the mail is sent again
+	api.emailThrottle = newThrottle(time.Hour)
+	rec = doRequest(e, http.MethodPost, "/api/verify-email/resend", echo.Map{"email": email})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected %v, got %v", http.StatusAccepted, rec.Code)
+	}
+	api.mails.Wait()
+
+	content, err := os.ReadFile(mailFile)
+	if err != nil {
+		t.Fatalf("Failed to read mail: %v", err)
+	}
+	if strings.Count(string(content), "Verify your email") != 2 {
+		t.Fatalf("Expected the signup and the resent mails: %v", string(content))
+	}
+	link := regexp.MustCompile(`/api/verify-email\?token=\S+`).FindString(string(content))
+	if link == "" {
+		t.Fatalf("No link in the mail: %v", string(content))
+	}
+
+	rec = doRequest(e, http.MethodGet, link+"tampered", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v for a tampered link, got %v", http.StatusBadRequest, rec.Code)
+	}
+	rec = doRequest(e, http.MethodGet, link, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to verify email: %v", rec.Body.String())
+	}
+
+	rec = doRequest(e, http.MethodPost, "/api/login", login)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to login after the verification: %v", rec.Body.String())
+	}
+}
+
+// signupAndLogin creates a user and returns the body of its login response
+func signupAndLogin(t *testing.T, e *echo.Echo, username string, password string) map[string]any {
+	t.Helper()
+	rec := doRequest(e, http.MethodPost, "/api/signup", echo.Map{
+		"username": username,
+		"email":    username + "@test.me",
+		"password": password,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to sign up: %v", rec.Body.String())
+	}
+	rec = doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": username, "password": password})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to login: %v", rec.Body.String())
+	}
+	body := map[string]any{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode login response: %v", err)
+	}
+	return body
+}
+
+// loginWithRole gives the role to the user and logs in again to get it in the token
+func loginWithRole(t *testing.T, api *ApiHandler, e *echo.Echo, username string, password string, role Role) map[string]any {
+	t.Helper()
+	user, err := api.dbh.GetUsername(context.Background(), username)
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if err := api.dbh.UpdateRole(context.Background(), user.GetId(), string(role)); err != nil {
+		t.Fatalf("Failed to update role: %v", err)
+	}
+	rec := doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": username, "password": password})
+	body := map[string]any{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["role"] != string(role) {
+		t.Fatalf("Failed to login with the role %v: %v", role, rec.Body.String())
+	}
+	return body
+}
+
+func TestTOTP(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	e := setupServer(api)
+
+	username, password := "totpuser", "password"
+	login := signupAndLogin(t, e, username, password)
+	auth := []string{echo.HeaderAuthorization, "Bearer " + login["token"].(string)}
+
+	rec := doRequest(e, http.MethodPost, "/api/2fa/enroll", nil, auth...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to enroll: %v", rec.Body.String())
+	}
+	enrollment := map[string]string{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &enrollment)
+	secret := enrollment["secret"]
+	if !strings.HasPrefix(enrollment["uri"], "otpauth://totp/") {
+		t.Fatalf("Unexpected otpauth URI: %v", enrollment["uri"])
+	}
+
+	rec = doRequest(e, http.MethodPost, "/api/2fa/confirm", echo.Map{"code": "000000"}, auth...)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v for a wrong code, got %v", http.StatusUnauthorized, rec.Code)
+	}
+	code, _ := utils.TOTPCode(secret, time.Now())
+	rec = doRequest(e, http.MethodPost, "/api/2fa/confirm", echo.Map{"code": code}, auth...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to confirm: %v", rec.Body.String())
+	}
+	confirmation := map[string][]string{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &confirmation)
+	if len(confirmation["recoveryCodes"]) != recoveryCodesCount {
+		t.Fatalf("Unexpected recovery codes: %v", confirmation)
+	}
+
+	// The password step only returns a challenge
+	rec = doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": username, "password": password})
+	challenge := map[string]any{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &challenge)
+	if rec.Code != http.StatusOK || challenge["mfaRequired"] != true || challenge["token"] != nil {
+		t.Fatalf("Expected a challenge, got %v", rec.Body.String())
+	}
+
+	// The code of the confirmation can't be replayed, the next one is still accepted
+	rec = doRequest(e, http.MethodPost, "/api/login/2fa", echo.Map{"challengeToken": challenge["challengeToken"], "code": code})
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v when reusing a TOTP code, got %v", http.StatusUnauthorized, rec.Code)
+	}
+	code, _ = utils.TOTPCode(secret, time.Now().Add(utils.TOTPPeriod*time.Second))
+	rec = doRequest(e, http.MethodPost, "/api/login/2fa", echo.Map{"challengeToken": challenge["challengeToken"], "code": code})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to login with the code: %v", rec.Body.String())
+	}
+
+	recovery := echo.Map{"challengeToken": challenge["challengeToken"], "recoveryCode": confirmation["recoveryCodes"][0]}
+	rec = doRequest(e, http.MethodPost, "/api/login/2fa", recovery)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to login with a recovery code: %v", rec.Body.String())
+	}
+	rec = doRequest(e, http.MethodPost, "/api/login/2fa", recovery)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v when reusing a recovery code, got %v", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+// oidcLogin goes through the authorization code flow of the stub provider and returns the callback response
+func oidcLogin(t *testing.T, e *echo.Echo, state string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := doRequest(e, http.MethodGet, "/api/oidc/login", nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, got %v: %v", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly flow cookie, got %v", cookies)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(rec.Header().Get(echo.HeaderLocation))
+	if err != nil {
+		t.Fatalf("Failed to authorize at the provider: %v", err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get(echo.HeaderLocation))
+	if err != nil {
+		t.Fatalf("Invalid callback: %v", err)
+	}
+	query := callback.Query()
+	if state != "" {
+		query.Set("state", state)
+	}
+	return doRequest(e, http.MethodGet, callback.Path+"?"+query.Encode(), nil, "Cookie", cookies[0].String())
+}
+
+func TestOIDC(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+
+	idp, err := oidctest.NewServer("gateway")
+	if err != nil {
+		t.Fatalf("Failed to start the stub provider: %v", err)
+	}
+	defer idp.Close()
+	api.conf.OIDCIssuer = idp.URL
+	api.conf.OIDCClientID = "gateway"
+	api.conf.OIDCRedirectURL = "http://gateway.test/api/oidc/callback"
+	api.oidc = oidc.NewProvider(api.conf)
+	e := setupServer(api)
+
+	decode := func(rec *httptest.ResponseRecorder) map[string]any {
+		body := map[string]any{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return body
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "First login creates the user",
+			test: func(t *testing.T) {
+				idp.SetUser(oidctest.User{Subject: "new-sub", Email: "oidcnew@test.me", EmailVerified: true, PreferredUsername: "OIDC New"})
+				rec := oidcLogin(t, e, "")
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to login: %v", rec.Body.String())
+				}
+				first := decode(rec)
+				if first["username"] != "oidcnew" || first["token"] == "" {
+					t.Fatalf("Unexpected login response %v", first)
+				}
+
+				rec = oidcLogin(t, e, "")
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to login again: %v", rec.Body.String())
+				}
+				if second := decode(rec); second["id"] != first["id"] {
+					t.Fatalf("Expected the same user, got %v and %v", first["id"], second["id"])
+				}
+			},
+		},
+		{
+			name: "Verified email links the existing user",
+			test: func(t *testing.T) {
+				local := signupAndLogin(t, e, "oidclocal", "password")
+				idp.SetUser(oidctest.User{Subject: "local-sub", Email: "oidclocal@test.me", EmailVerified: true})
+				rec := oidcLogin(t, e, "")
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to login: %v", rec.Body.String())
+				}
+				if body := decode(rec); body["id"] != local["id"] {
+					t.Fatalf("Expected the identity to be linked to %v, got %v", local["id"], body["id"])
+				}
+			},
+		},
+		{
+			name: "Unverified email doesn't take over the existing user",
+			test: func(t *testing.T) {
+				signupAndLogin(t, e, "oidcvictim", "password")
+				idp.SetUser(oidctest.User{Subject: "attacker-sub", Email: "oidcvictim@test.me"})
+				rec := oidcLogin(t, e, "")
+				if rec.Code != http.StatusConflict {
+					t.Fatalf("Expected %v, got %v: %v", http.StatusConflict, rec.Code, rec.Body.String())
+				}
+			},
+		},
+		{
+			name: "Wrong state is rejected",
+			test: func(t *testing.T) {
+				idp.SetUser(oidctest.User{Subject: "state-sub", Email: "oidcstate@test.me", EmailVerified: true})
+				rec := oidcLogin(t, e, "forged")
+				if rec.Code != http.StatusUnauthorized {
+					t.Fatalf("Expected %v, got %v", http.StatusUnauthorized, rec.Code)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.test)
+	}
+}
+
+func TestApiKeys(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	e := setupServer(api)
+	// The catalog routes publish to the other services, a probe route checks the authentication only
+	e.POST("/probe", func(c echo.Context) error {
+		if key := getApiKey(c); key != nil {
+			return c.String(http.StatusOK, key.GetUsername())
+		}
+		return c.String(http.StatusOK, getClaims(c).Username)
+	}, api.requireScope(ScopePriceWrite))
+
+	signupAndLogin(t, e, "keyuser", "password")
+	login := loginWithRole(t, api, e, "keyuser", "password", RoleEditor)
+	auth := []string{echo.HeaderAuthorization, "Bearer " + login["token"].(string)}
+
+	createKey := func(scopes ...string) ApiKeyResponse {
+		t.Helper()
+		rec := doRequest(e, http.MethodPost, "/api/keys", echo.Map{"name": "script", "scopes": scopes}, auth...)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Failed to create key: %v", rec.Body.String())
+		}
+		key := ApiKeyResponse{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &key)
+		if !strings.HasPrefix(key.Key, key.Prefix+".") {
+			t.Fatalf("Expected the key to start with its prefix, got %v", key)
+		}
+		return key
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "Unknown scope is rejected",
+			test: func(t *testing.T) {
+				rec := doRequest(e, http.MethodPost, "/api/keys", echo.Map{"name": "script", "scopes": []string{"admin"}}, auth...)
+				if rec.Code == http.StatusCreated {
+					t.Fatal("Expected the unknown scope to be rejected")
+				}
+			},
+		},
+		{
+			name: "Key with the scope is accepted",
+			test: func(t *testing.T) {
+				key := createKey(ScopePriceWrite)
+				rec := doRequest(e, http.MethodPost, "/probe", nil, echo.HeaderAuthorization, "ApiKey "+key.Key)
+				if rec.Code != http.StatusOK || rec.Body.String() != "keyuser" {
+					t.Fatalf("Expected the key to be accepted, got %v: %v", rec.Code, rec.Body.String())
+				}
+			},
+		},
+		{
+			name: "Bearer token is still accepted",
+			test: func(t *testing.T) {
+				rec := doRequest(e, http.MethodPost, "/probe", nil, auth...)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Expected the bearer token to be accepted, got %v", rec.Code)
+				}
+			},
+		},
+		{
+			name: "Key without the scope is forbidden",
+			test: func(t *testing.T) {
+				key := createKey(ScopeCatalogWrite)
+				rec := doRequest(e, http.MethodPost, "/probe", nil, echo.HeaderAuthorization, "ApiKey "+key.Key)
+				if rec.Code != http.StatusForbidden {
+					t.Fatalf("Expected %v, got %v", http.StatusForbidden, rec.Code)
+				}
+			},
+		},
+		{
+			name: "List and revoke",
+			test: func(t *testing.T) {
+				key := createKey(ScopePriceWrite)
+				rec := doRequest(e, http.MethodGet, "/api/keys", nil, auth...)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Failed to list keys: %v", rec.Body.String())
+				}
+				if strings.Contains(rec.Body.String(), key.Key) {
+					t.Fatal("The list must not expose the keys")
+				}
+
+				rec = doRequest(e, http.MethodDelete, "/api/keys/"+key.Prefix, nil, auth...)
+				if rec.Code != http.StatusNoContent {
+					t.Fatalf("Failed to revoke key: %v", rec.Body.String())
+				}
+				rec = doRequest(e, http.MethodPost, "/probe", nil, echo.HeaderAuthorization, "ApiKey "+key.Key)
+				if rec.Code != http.StatusUnauthorized {
+					t.Fatalf("Expected %v after the revocation, got %v", http.StatusUnauthorized, rec.Code)
+				}
+				rec = doRequest(e, http.MethodDelete, "/api/keys/"+key.Prefix, nil, auth...)
+				if rec.Code != http.StatusNotFound {
+					t.Fatalf("Expected %v, got %v", http.StatusNotFound, rec.Code)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.test)
+	}
+}
+
+func TestRBAC(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	e := setupServer(api)
+
+	bearer := func(login map[string]any) []string {
+		return []string{echo.HeaderAuthorization, "Bearer " + login["token"].(string)}
+	}
+	user := bearer(signupAndLogin(t, e, "rbacuser", "password"))
+	signupAndLogin(t, e, "rbaceditor", "password")
+	editor := bearer(loginWithRole(t, api, e, "rbaceditor", "password", RoleEditor))
+	signupAndLogin(t, e, "rbacadmin", "password")
+	admin := bearer(loginWithRole(t, api, e, "rbacadmin", "password", RoleAdmin))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		auth   []string
+		code   int
+	}{
+		{name: "Anonymous shop deletion", method: http.MethodDelete, path: "/shop/1", code: http.StatusUnauthorized},
+		{name: "User shop deletion", method: http.MethodDelete, path: "/shop/1", auth: user, code: http.StatusForbidden},
+		{name: "Editor shop deletion", method: http.MethodDelete, path: "/shop/1", auth: editor, code: http.StatusForbidden},
+		{name: "User recipe deletion", method: http.MethodDelete, path: "/recipe/1", auth: user, code: http.StatusForbidden},
+		{name: "User shop creation", method: http.MethodPost, path: "/shop", auth: user, code: http.StatusForbidden},
+		{name: "User catalog", method: http.MethodPost, path: "/ingredient", auth: user, code: http.StatusForbidden},
+		{name: "User price", method: http.MethodPost, path: "/price", auth: user, code: http.StatusForbidden},
+		{name: "User API key with a scope", method: http.MethodPost, path: "/api/keys", body: echo.Map{"name": "script", "scopes": []string{ScopePriceWrite}}, auth: user, code: http.StatusForbidden},
+		{name: "Editor role update", method: http.MethodPut, path: "/api/admin/users/rbacuser/role", body: echo.Map{"role": "admin"}, auth: editor, code: http.StatusForbidden},
+		{name: "Admin own role update", method: http.MethodPut, path: "/api/admin/users/rbacadmin/role", body: echo.Map{"role": "user"}, auth: admin, code: http.StatusForbidden},
+		{name: "Admin unknown role", method: http.MethodPut, path: "/api/admin/users/rbacuser/role", body: echo.Map{"role": "owner"}, auth: admin, code: http.StatusBadRequest},
+		{name: "Admin role update", method: http.MethodPut, path: "/api/admin/users/rbacuser/role", body: echo.Map{"role": "editor"}, auth: admin, code: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(e, tt.method, tt.path, tt.body, tt.auth...)
+			if rec.Code != tt.code {
+				t.Fatalf("Expected %v, got %v: %v", tt.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	rec := doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": "rbacuser", "password": "password"})
+	if !strings.Contains(rec.Body.String(), `"role":"editor"`) {
+		t.Fatalf("Expected the new role after the login, got %v", rec.Body.String())
+	}
+
+	// The token of a demoted editor keeps the role in its claims but loses its rights
+	if rec := doRequest(e, http.MethodPut, "/api/admin/users/rbaceditor/role", echo.Map{"role": "user"}, admin...); rec.Code != http.StatusNoContent {
+		t.Fatalf("Failed to demote the editor: %v", rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodPost, "/price", nil, editor...); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected the demoted editor to be refused, got %v: %v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestInventoryOwnership(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+
+	// The stub inventory service records the user of the last request
+	var mu sync.Mutex
+	var lastURL string
+	inventoryMS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastURL = r.URL.String()
+		mu.Unlock()
+		w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		w.Write([]byte("[]"))
+	}))
+	defer inventoryMS.Close()
+	api.conf.InventoryMSURL = inventoryMS.URL
+	e := setupServer(api)
+
+	login := signupAndLogin(t, e, "owneruser", "password")
+	uuid := login["uuid"].(string)
+	auth := []string{echo.HeaderAuthorization, "Bearer " + login["token"].(string)}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   []string
+		code   int
+		url    string
+	}{
+		{name: "Anonymous inventory", method: http.MethodGet, path: "/inventory/ingredient", code: http.StatusUnauthorized},
+		{name: "Anonymous shopping list", method: http.MethodGet, path: "/shopping-list", code: http.StatusUnauthorized},
+		{name: "Inventory of the token user", method: http.MethodGet, path: "/inventory/ingredient", auth: auth, code: http.StatusOK, url: "/inventory/ingredient?userId=" + uuid},
+		{name: "Explicit matching userId", method: http.MethodGet, path: "/inventory/ingredient?userId=" + uuid, auth: auth, code: http.StatusOK, url: "/inventory/ingredient?userId=" + uuid},
+		{name: "Explicit other userId", method: http.MethodGet, path: "/inventory/ingredient?userId=other", auth: auth, code: http.StatusForbidden},
+		{name: "Ingredient of another user", method: http.MethodGet, path: "/inventory/ingredient/1?userId=other", auth: auth, code: http.StatusForbidden},
+		{name: "Delete for another user", method: http.MethodDelete, path: "/inventory/ingredient/1/user/other", auth: auth, code: http.StatusForbidden},
+		{name: "Delete for the token user", method: http.MethodDelete, path: "/inventory/ingredient/1", auth: auth, code: http.StatusOK, url: "/inventory/ingredient/1/" + uuid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(e, tt.method, tt.path, nil, tt.auth...)
+			if rec.Code != tt.code {
+				t.Fatalf("Expected %v, got %v: %v", tt.code, rec.Code, rec.Body.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.url != "" && lastURL != tt.url {
+				t.Fatalf("Expected the inventory service to be called with %v, got %v", tt.url, lastURL)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	e := setupServer(api)
+
+	now := time.Now()
+	api.loginGuard.now = func() time.Time { return now }
+
+	signupAndLogin(t, e, "lockeduser", "password")
+	signupAndLogin(t, e, "lockadmin", "password")
+	admin := loginWithRole(t, api, e, "lockadmin", "password", RoleAdmin)
+
+	wrong := echo.Map{"username": "lockeduser", "password": "wrong-password"}
+	right := echo.Map{"username": "lockeduser", "password": "password"}
+
+	for i := 0; i < backoffStart(api.conf.LoginMaxFailures); i++ {
+		if rec := doRequest(e, http.MethodPost, "/api/login", wrong); rec.Code != http.StatusNotFound {
+			t.Fatalf("Expected %v for the failure %v, got %v", http.StatusNotFound, i+1, rec.Code)
+		}
+	}
+
+	// The backoff applies to the right password too
+	rec := doRequest(e, http.MethodPost, "/api/login", right)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected %v with a backoff of 1s, got %v %v", http.StatusTooManyRequests, rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	for i := backoffStart(api.conf.LoginMaxFailures); i < api.conf.LoginMaxFailures; i++ {
+		now = now.Add(api.conf.LoginLockout / 2)
+		if rec := doRequest(e, http.MethodPost, "/api/login", wrong); rec.Code != http.StatusNotFound {
+			t.Fatalf("Expected %v for the failure %v, got %v", http.StatusNotFound, i+1, rec.Code)
+		}
+	}
+	rec = doRequest(e, http.MethodPost, "/api/login", right)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("Expected the user to be locked out, got %v %v", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Other users can still login from the same IP
+	if rec := doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": "lockadmin", "password": "password"}); rec.Code != http.StatusOK {
+		t.Fatalf("Expected another user to login, got %v", rec.Code)
+	}
+
+	auth := []string{echo.HeaderAuthorization, "Bearer " + admin["token"].(string)}
+	rec = doRequest(e, http.MethodDelete, "/api/admin/users/lockeduser/lockout", nil, auth...)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Failed to unlock: %v", rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/login", right); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the user to login after the unlock, got %v", rec.Code)
+	}
+	rec = doRequest(e, http.MethodDelete, "/api/admin/users/lockeduser/lockout", nil, auth...)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v for a user not locked out, got %v", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestLoginLockoutUnknownUsers(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	// The requests of httptest come from 192.0.2.1, it's the proxy that sets X-Forwarded-For
+	_, proxy, _ := net.ParseCIDR("192.0.2.0/24")
+	api.conf.TrustedProxies = []*net.IPNet{proxy}
+	e := setupServer(api)
+
+	signupAndLogin(t, e, "sprayeduser", "password")
+	ip := []string{echo.HeaderXForwardedFor, "203.0.113.7"}
+
+	// Each attempt tries another username, only the IP counts the failures
+	for i := 0; i < backoffStart(api.conf.LoginMaxIPFailures); i++ {
+		rec := doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": fmt.Sprintf("sprayed%v", i), "password": "password"}, ip...)
+		if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "username or password incorrect") {
+			t.Fatalf("Expected the unknown user to be a failed login, got %v: %v", rec.Code, rec.Body.String())
+		}
+	}
+
+	right := echo.Map{"username": "sprayeduser", "password": "password"}
+	if rec := doRequest(e, http.MethodPost, "/api/login", right, ip...); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the IP to be blocked, got %v", rec.Code)
+	}
+	// X-Real-IP isn't trusted, it doesn't change the IP of the client
+	spoofed := append([]string{echo.HeaderXRealIP, "198.51.100.1"}, ip...)
+	if rec := doRequest(e, http.MethodPost, "/api/login", right, spoofed...); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the IP to stay blocked with X-Real-IP, got %v", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/login", right); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the user to login from another IP, got %v", rec.Code)
+	}
+
+	// Without a trusted proxy the header is ignored, the IP is the one of the connection
+	api.conf.TrustedProxies = nil
+	e = setupServer(api)
+	if rec := doRequest(e, http.MethodPost, "/api/login", right, ip...); rec.Code != http.StatusOK {
+		t.Fatalf("Expected X-Forwarded-For to be ignored, got %v", rec.Code)
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	e := setupServer(api)
+
+	legacy, err := utils.NewBcryptHasher(0).Hash("password")
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	_, err = api.dbh.CreateUser(context.Background(), &db.UserRequest{
+		Email:    "bcryptuser@test.me",
+		Username: "bcryptuser",
+		Password: legacy,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	rec := doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": "bcryptuser", "password": "password"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to login with the bcrypt hash: %v", rec.Body.String())
+	}
+	user, err := api.dbh.GetUsername(context.Background(), "bcryptuser")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if !strings.HasPrefix(user.GetPassword(), "$argon2id$") {
+		t.Fatalf("Expected the password to be rehashed with argon2id, got %v", user.GetPassword())
+	}
+
+	rec = doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": "bcryptuser", "password": "password"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to login with the argon2id hash: %v", rec.Body.String())
+	}
+}
+
+func TestMe(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	mailFile := filepath.Join(t.TempDir(), "mails")
+	api.mailer = mailer.NewLogMailer(mailFile)
+	api.emailThrottle = newThrottle(time.Hour)
+	e := setupServer(api)
+
+	login := signupAndLogin(t, e, "meuser", "password")
+	auth := []string{echo.HeaderAuthorization, "Bearer " + login["token"].(string)}
+	signupAndLogin(t, e, "meother", "password")
+	user, err := api.dbh.GetUsername(context.Background(), "meuser")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if err := api.dbh.VerifyEmail(context.Background(), user.GetId(), user.GetEmail()); err != nil {
+		t.Fatalf("Failed to verify email: %v", err)
+	}
+
+	me := func(rec *httptest.ResponseRecorder) UserResponse {
+		t.Helper()
+		var response UserResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode profile: %v", err)
+		}
+		return response
+	}
+
+	rec := doRequest(e, http.MethodGet, "/api/me", nil, auth...)
+	if rec.Code != http.StatusOK || me(rec).Username != "meuser" || me(rec).Email != "meuser@test.me" {
+		t.Fatalf("Failed to get the profile: %v", rec.Body.String())
+	}
+
+	t.Run("Update the name", func(t *testing.T) {
+		rec := doRequest(e, http.MethodPatch, "/api/me", echo.Map{"firstName": "Me"}, auth...)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Failed to update the profile: %v", rec.Body.String())
+		}
+		if profile := me(rec); profile.FirstName != "Me" || !profile.EmailVerified {
+			t.Fatalf("Expected the name to change and the email to stay verified, got %+v", profile)
+		}
+	})
+
+	t.Run("Email of another user", func(t *testing.T) {
+		rec := doRequest(e, http.MethodPatch, "/api/me", echo.Map{"email": "meother@test.me"}, auth...)
+		if rec.Code != http.StatusConflict {
+			t.Fatalf("Expected %v, got %v", http.StatusConflict, rec.Code)
+		}
+	})
+
+	t.Run("Invalid email", func(t *testing.T) {
+		rec := doRequest(e, http.MethodPatch, "/api/me", echo.Map{"email": ""}, auth...)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v, got %v", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Update the email", func(t *testing.T) {
+		rec := doRequest(e, http.MethodPatch, "/api/me", echo.Map{"email": "menew@test.me"}, auth...)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Failed to update the email: %v", rec.Body.String())
+		}
+		if profile := me(rec); profile.Email != "menew@test.me" || profile.EmailVerified || profile.FirstName != "Me" {
+			t.Fatalf("Expected the new email to not be verified, got %+v", profile)
+		}
+		content, err := os.ReadFile(mailFile)
+		if err != nil || !strings.Contains(string(content), "menew@test.me") {
+			t.Fatalf("No verification mail sent to the new email: %v", string(content))
+		}
+	})
+
+	t.Run("Change the password", func(t *testing.T) {
+		other := map[string]any{}
+		rec := doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": "meuser", "password": "password"})
+		if err := json.Unmarshal(rec.Body.Bytes(), &other); err != nil {
+			t.Fatalf("Failed to login: %v", rec.Body.String())
+		}
+
+		rec = doRequest(e, http.MethodPut, "/api/me/password", echo.Map{"currentPassword": "wrong", "password": "another password"}, auth...)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("Expected %v with a wrong current password, got %v", http.StatusForbidden, rec.Code)
+		}
+		rec = doRequest(e, http.MethodPut, "/api/me/password", echo.Map{"currentPassword": "password", "password": "another password"}, auth...)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("Failed to change the password: %v", rec.Body.String())
+		}
+
+		// Only the other session is logged out
+		rec = doRequest(e, http.MethodPost, "/api/refresh", echo.Map{"refreshToken": other["refreshToken"]})
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected %v for the other session, got %v", http.StatusUnauthorized, rec.Code)
+		}
+		rec = doRequest(e, http.MethodPost, "/api/refresh", echo.Map{"refreshToken": login["refreshToken"]})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Failed to refresh the current session: %v", rec.Body.String())
+		}
+		rec = doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": "meuser", "password": "another password"})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Failed to login with the new password: %v", rec.Body.String())
+		}
+	})
+}
+
+func TestDeleteMe(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	api.conf.UserDeletionGrace = time.Hour
+	e := setupServer(api)
+
+	signupAndLogin(t, e, "deleteduser", "password")
+	login := loginWithRole(t, api, e, "deleteduser", "password", RoleEditor)
+	auth := []string{echo.HeaderAuthorization, "Bearer " + login["token"].(string)}
+	rec := doRequest(e, http.MethodPost, "/api/keys", echo.Map{"name": "script", "scopes": []string{"price:write"}}, auth...)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to create an API key: %v", rec.Body.String())
+	}
+	var key ApiKeyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &key); err != nil {
+		t.Fatalf("Failed to decode API key: %v", err)
+	}
+
+	// Without RabbitMQ the event can't be published and the user is restored
+	rec = doRequest(e, http.MethodDelete, "/api/me", nil, auth...)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %v without a broker, got %v", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/me", nil, auth...); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the user to be kept when the event isn't published, got %v", rec.Code)
+	}
+
+	var published []*messages.UserDeleted
+	api.publishUserDeleted = func(ctx context.Context, l *logrus.Entry, event *messages.UserDeleted) error {
+		// The user is soft-deleted before the event is published
+		if _, err := api.dbh.GetUsername(ctx, event.Username); !errors.Is(err, db.ErrUserNotFound) {
+			t.Errorf("Expected the user to be deleted before the event, got %v", err)
+		}
+		published = append(published, event)
+		return nil
+	}
+	rec = doRequest(e, http.MethodDelete, "/api/me", nil, auth...)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Failed to delete the user: %v", rec.Body.String())
+	}
+	if len(published) != 1 || published[0].Username != "deleteduser" {
+		t.Fatalf("Expected the user-deleted event to be published, got %v", published)
+	}
+
+	rec = doRequest(e, http.MethodGet, "/api/me", nil, auth...)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v with the token of a deleted user, got %v", http.StatusUnauthorized, rec.Code)
+	}
+	rec = doRequest(e, http.MethodPost, "/api/refresh", echo.Map{"refreshToken": login["refreshToken"]})
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v with the refresh token of a deleted user, got %v", http.StatusUnauthorized, rec.Code)
+	}
+	rec = doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": "deleteduser", "password": "password"})
+	if rec.Code == http.StatusOK {
+		t.Fatalf("A deleted user must not login")
+	}
+	if _, err := api.dbh.GetApiKey(context.Background(), utils.HashToken(key.Key)); !errors.Is(err, db.ErrApiKeyNotFound) {
+		t.Fatalf("Expected the API key to be revoked, got %v", err)
+	}
+
+	if purged := api.purgeDeletedUsers(context.Background(), time.Now()); purged != 0 {
+		t.Fatalf("Expected no purge during the grace period, got %v", purged)
+	}
+	if purged := api.purgeDeletedUsers(context.Background(), time.Now().Add(2*time.Hour)); purged != 1 {
+		t.Fatalf("Expected the user to be purged after the grace period, got %v", purged)
+	}
+
+	// The username is free again once the user is purged, the events of the purged user are gone
+	login = signupAndLogin(t, e, "deleteduser", "password")
+	rec = doRequest(e, http.MethodGet, "/api/me/security-events", nil, echo.HeaderAuthorization, "Bearer "+login["token"].(string))
+	var events []AuthEventResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatalf("Failed to decode the events: %v", rec.Body.String())
+	}
+	if len(events) != 2 || events[0].Type != AuthEventLogin || events[1].Type != AuthEventSignup {
+		t.Fatalf("Expected only the events of the new user, got %+v", events)
+	}
+}
+
+func TestExport(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	api.conf.ExportSyncTimeout = 5 * time.Second
+
+	// The stub services hold their responses until release is closed
+	var mu sync.Mutex
+	release := make(chan struct{})
+	services := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		wait := release
+		mu.Unlock()
+		<-wait
+		w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/recipe/user/"):
+			w.Write([]byte(`[{"id":"recipe-1","name":"Choucroute"}]`))
+		case r.URL.Path == "/inventory/ingredient":
+			w.Write([]byte(`[{"id":"cabbage","amount":1,"unit":"kg"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer services.Close()
+	close(release)
+	api.conf.RecipeMSURL = services.URL
+	api.conf.InventoryMSURL = services.URL
+	api.conf.ShoppingListMSURL = services.URL
+	e := setupServer(api)
+
+	login := signupAndLogin(t, e, "exportuser", "password")
+	auth := []string{echo.HeaderAuthorization, "Bearer " + login["token"].(string)}
+	other := signupAndLogin(t, e, "exportother", "password")
+	otherAuth := []string{echo.HeaderAuthorization, "Bearer " + other["token"].(string)}
+
+	t.Run("JSON", func(t *testing.T) {
+		rec := doRequest(e, http.MethodGet, "/api/me/export", nil, auth...)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Failed to export: %v", rec.Body.String())
+		}
+		var archive exportArchive
+		if err := json.Unmarshal(rec.Body.Bytes(), &archive); err != nil {
+			t.Fatalf("Failed to decode the archive: %v", err)
+		}
+		if archive.Profile.Username != "exportuser" || !strings.Contains(string(archive.Recipes), "recipe-1") ||
+			!strings.Contains(string(archive.Inventory), "cabbage") || string(archive.ShoppingList) != "[]" {
+			t.Fatalf("Unexpected archive: %v", rec.Body.String())
+		}
+	})
+
+	t.Run("ZIP", func(t *testing.T) {
+		rec := doRequest(e, http.MethodGet, "/api/me/export?format=zip", nil, auth...)
+		if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "application/zip" {
+			t.Fatalf("Failed to export: %v", rec.Body.String())
+		}
+		r, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil {
+			t.Fatalf("Failed to open the archive: %v", err)
+		}
+		names := []string{}
+		for _, f := range r.File {
+			names = append(names, f.Name)
+		}
+		if strings.Join(names, ",") != "profile.json,recipes.json,inventory.json,shopping-list.json" {
+			t.Fatalf("Unexpected files in the archive: %v", names)
+		}
+	})
+
+	t.Run("Invalid format", func(t *testing.T) {
+		rec := doRequest(e, http.MethodGet, "/api/me/export?format=xml", nil, auth...)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v, got %v", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		mu.Lock()
+		release = make(chan struct{})
+		mu.Unlock()
+		api.conf.ExportSyncTimeout = 10 * time.Millisecond
+
+		rec := doRequest(e, http.MethodGet, "/api/me/export", nil, auth...)
+		location := rec.Header().Get(echo.HeaderLocation)
+		if rec.Code != http.StatusAccepted || location == "" {
+			t.Fatalf("Expected %v with a Location, got %v: %v", http.StatusAccepted, rec.Code, rec.Body.String())
+		}
+		rec = doRequest(e, http.MethodGet, "/api/me/export", nil, auth...)
+		if rec.Code != http.StatusAccepted || rec.Header().Get(echo.HeaderLocation) != location {
+			t.Fatalf("Expected the pending export to be returned, got %v", rec.Header().Get(echo.HeaderLocation))
+		}
+		rec = doRequest(e, http.MethodGet, location, nil, otherAuth...)
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("Expected %v for the export of another user, got %v", http.StatusNotFound, rec.Code)
+		}
+
+		mu.Lock()
+		close(release)
+		mu.Unlock()
+		for i := 0; ; i++ {
+			rec = doRequest(e, http.MethodGet, location, nil, auth...)
+			if rec.Code == http.StatusOK {
+				break
+			}
+			if rec.Code != http.StatusAccepted || i == 100 {
+				t.Fatalf("Failed to download the export: %v %v", rec.Code, rec.Body.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !strings.Contains(rec.Body.String(), "recipe-1") {
+			t.Fatalf("Unexpected archive: %v", rec.Body.String())
+		}
+	})
+}
+
+func TestEncryption(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	setupPostgres(t, api)
+	e := setupServer(api)
+
+	rec := doRequest(e, http.MethodPost, "/api/signup", echo.Map{
+		"username":  "cryptuser",
+		"email":     "cryptuser@test.me",
+		"password":  "password",
+		"firstName": "Jean",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to sign up: %v", rec.Body.String())
+	}
+	stored := func() (firstName string, lastName string, key string) {
+		t.Helper()
+		row := postgresClient.Raw(`SELECT u.first_name, u.last_name, k.secret_key FROM users u
+			JOIN encryption_keys k ON k.user_id = u.id WHERE u.username = ?`, "cryptuser").Row()
+		if err := row.Scan(&firstName, &lastName, &key); err != nil {
+			t.Fatalf("Failed to read the user: %v", err)
+		}
+		return firstName, lastName, key
+	}
+
+	firstName, _, key := stored()
+	if !strings.HasPrefix(firstName, "enc:") || !strings.HasPrefix(key, "jwt-secret:") {
+		t.Fatalf("Expected the name and the data key to be encrypted, got %v and %v", firstName, key)
+	}
+	user, err := api.dbh.GetUsername(context.Background(), "cryptuser")
+	if err != nil || user.GetFirstName() != "Jean" {
+		t.Fatalf("Expected the name to be decrypted, got %v", err)
+	}
+
+	// A field written before the encryption is encrypted by the rotation
+	postgresClient.Exec("UPDATE users SET last_name = 'Legacy' WHERE username = ?", "cryptuser")
+
+	derived := sha256.Sum256([]byte(api.conf.JWTSecret))
+	newKey, err := utils.GenerateSecretKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	rotation := *api.conf
+	rotation.MasterKeys = "jwt-secret:" + base64.StdEncoding.EncodeToString(derived[:]) + ",next:" + newKey
+	rotation.MasterKeyID = "next"
+	rotating, err := db.NewPostgresHandler(&rotation)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	if rotated, err := rotating.RotateEncryptionKeys(context.Background()); err != nil || rotated < 1 {
+		t.Fatalf("Failed to rotate the keys: %v %v", rotated, err)
+	}
+	if rotated, err := rotating.RotateEncryptionKeys(context.Background()); err != nil || rotated != 0 {
+		t.Fatalf("Expected nothing left to rotate, got %v %v", rotated, err)
+	}
+
+	_, lastName, key := stored()
+	if !strings.HasPrefix(lastName, "enc:") || !strings.HasPrefix(key, "next:") {
+		t.Fatalf("Expected the key to be rewrapped and the field encrypted, got %v and %v", lastName, key)
+	}
+
+	// The retired master key isn't needed anymore
+	retired := rotation
+	retired.MasterKeys = "next:" + newKey
+	rotated, err := db.NewPostgresHandler(&retired)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	user, err = rotated.GetUsername(context.Background(), "cryptuser")
+	if err != nil || user.GetFirstName() != "Jean" || user.GetLastName() != "Legacy" {
+		t.Fatalf("Failed to read the user with the new master key: %v", err)
+	}
+}
+
+func TestSecurityEvents(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	e := setupServer(api)
+
+	signupAndLogin(t, e, "audited", "password")
+	signupAndLogin(t, e, "auditadmin", "password")
+	admin := loginWithRole(t, api, e, "auditadmin", "password", RoleAdmin)
+
+	login := func(password string, code int) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := doRequest(e, http.MethodPost, "/api/login", echo.Map{"username": "audited", "password": password}, "User-Agent", "audit-agent")
+		if rec.Code != code {
+			t.Fatalf("Expected %v for the login, got %v", code, rec.Code)
+		}
+		return rec
+	}
+	login("wrong-password", http.StatusNotFound)
+	body := map[string]any{}
+	if err := json.Unmarshal(login("password", http.StatusOK).Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode login response: %v", err)
+	}
+	auth := []string{echo.HeaderAuthorization, "Bearer " + body["token"].(string)}
+
+	getEvents := func(path string, auth []string) []AuthEventResponse {
+		t.Helper()
+		rec := doRequest(e, http.MethodGet, path, nil, auth...)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Failed to get the events from %v: %v", path, rec.Body.String())
+		}
+		events := []AuthEventResponse{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+			t.Fatalf("Failed to decode the events: %v", err)
+		}
+		return events
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "The user gets its own events, the most recent first",
+			test: func(t *testing.T) {
+				events := getEvents("/api/me/security-events", auth)
+				types := []string{}
+				for _, event := range events {
+					if event.Username != "audited" {
+						t.Errorf("Expected only the events of the user, got %v", event.Username)
+					}
+					types = append(types, event.Type)
+				}
+				expected := []string{AuthEventLogin, AuthEventLoginFailed, AuthEventLogin, AuthEventSignup}
+				if strings.Join(types, ",") != strings.Join(expected, ",") {
+					t.Fatalf("Expected the events %v, got %v", expected, types)
+				}
+				if events[1].IP == "" || events[1].UserAgent == "" {
+					t.Errorf("Expected the client of the failed login, got %+v", events[1])
+				}
+			},
+		},
+		{
+			name: "The events are filtered by type and limited",
+			test: func(t *testing.T) {
+				events := getEvents("/api/me/security-events?type=login&limit=1", auth)
+				if len(events) != 1 || events[0].Type != AuthEventLogin {
+					t.Fatalf("Expected the last login, got %+v", events)
+				}
+				future := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+				if events := getEvents("/api/me/security-events?since="+future, auth); len(events) != 0 {
+					t.Fatalf("Expected no event in the future, got %+v", events)
+				}
+			},
+		},
+		{
+			name: "The logout is recorded",
+			test: func(t *testing.T) {
+				session := map[string]any{}
+				if err := json.Unmarshal(login("password", http.StatusOK).Body.Bytes(), &session); err != nil {
+					t.Fatalf("Failed to decode login response: %v", err)
+				}
+				sessionAuth := []string{echo.HeaderAuthorization, "Bearer " + session["token"].(string)}
+				if rec := doRequest(e, http.MethodPost, "/api/logout", nil, sessionAuth...); rec.Code != http.StatusNoContent {
+					t.Fatalf("Failed to logout: %v", rec.Body.String())
+				}
+				events := getEvents("/api/me/security-events?type=logout", auth)
+				if len(events) != 1 {
+					t.Fatalf("Expected the logout, got %+v", events)
+				}
+			},
+		},
+		{
+			name: "An admin searches the events of every user",
+			test: func(t *testing.T) {
+				adminAuth := []string{echo.HeaderAuthorization, "Bearer " + admin["token"].(string)}
+				events := getEvents("/api/admin/security-events?username=audited&type=login_failed", adminAuth)
+				if len(events) != 1 || events[0].Username != "audited" {
+					t.Fatalf("Expected the failed login of the user, got %+v", events)
+				}
+				if events := getEvents("/api/admin/security-events?type=signup", adminAuth); len(events) != 2 {
+					t.Fatalf("Expected the signups of both users, got %+v", events)
+				}
+				if rec := doRequest(e, http.MethodGet, "/api/admin/security-events?ip=not-an-ip", nil, adminAuth...); rec.Code != http.StatusBadRequest {
+					t.Fatalf("Expected %v for an invalid IP, got %v", http.StatusBadRequest, rec.Code)
+				}
+				if rec := doRequest(e, http.MethodGet, "/api/admin/security-events", nil, auth...); rec.Code != http.StatusForbidden {
+					t.Fatalf("Expected %v for a user, got %v", http.StatusForbidden, rec.Code)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.test)
+	}
+}
+
+func TestPostgresContract(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	setupPostgres(t, api)
+
+	dbtest.Run(t, func(t *testing.T) db.DBHdandler {
+		return api.dbh
+	})
+}
+
+func TestTokenPurge(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	api.conf.TokenPurgeInterval = time.Hour
+	e := setupServer(api)
+
+	login := signupAndLogin(t, e, "purgeduser", "password")
+	auth := []string{echo.HeaderAuthorization, "Bearer " + login["token"].(string)}
+	user, err := api.dbh.GetUsername(context.Background(), "purgeduser")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	expired := db.TokenRequest{
+		SessionID:      "expired-session",
+		Value:          "expired",
+		ExpirationDate: time.Now().Add(-time.Minute),
+		UserID:         user.GetId(),
+	}
+	if _, err := api.dbh.UpsertToken(context.Background(), &expired); err != nil {
+		t.Fatalf("Failed to upsert token: %v", err)
+	}
+
+	if purged := api.purgeExpiredTokens(context.Background(), "other-replica", time.Now()); purged != 1 {
+		t.Fatalf("Expected the expired token to be purged, got %v", purged)
+	}
+	// The lock is held by the other replica until the next interval
+	if _, err := api.dbh.UpsertToken(context.Background(), &expired); err != nil {
+		t.Fatalf("Failed to upsert token: %v", err)
+	}
+	if purged := api.purgeExpiredTokens(context.Background(), "replica", time.Now()); purged != 0 {
+		t.Fatalf("Expected a single replica to purge, got %v", purged)
+	}
+	if purged := api.purgeExpiredTokens(context.Background(), "other-replica", time.Now()); purged != 1 {
+		t.Fatalf("Expected the lock holder to purge again, got %v", purged)
+	}
+
+	rec := doRequest(e, http.MethodGet, "/api/me", nil, auth...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the valid session to be kept, got %v", rec.Code)
+	}
+}
+
+// rotationCounter counts the rotations that reach the database
+type rotationCounter struct {
+	db.DBHdandler
+	rotations int
+}
+
+func (rc *rotationCounter) RotateEncryptionKeys(ctx context.Context) (int, error) {
+	rc.rotations++
+	return 1, nil
+}
+
+func TestKeyRotationLock(t *testing.T) {
+	api, cleanup := setupTest(t)
+	defer cleanup()
+	counter := &rotationCounter{DBHdandler: api.dbh}
+	api.dbh = counter
+
+	if rotated := api.rotateEncryptionKeys(context.Background(), "replica"); rotated != 1 {
+		t.Fatalf("Expected the lock holder to rotate, got %v", rotated)
+	}
+	// Another replica starting during the rotation skips it
+	if rotated := api.rotateEncryptionKeys(context.Background(), "other-replica"); rotated != 0 || counter.rotations != 1 {
+		t.Fatalf("Expected a single replica to rotate, got %v rotations", counter.rotations)
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"errors"
+	"gateway/db"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type loginFailures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+// loginGuard counts the failed logins per key, a username or an IP. After half of the failures allowed
+// the next attempts wait for an exponential backoff, and the key is locked out when it reaches its maximum.
+// Like throttle it's kept in memory, so each replica of the gateway counts on its own.
+type loginGuard struct {
+	mu          sync.Mutex
+	backoff     time.Duration
+	lockout     time.Duration
+	failures    map[string]*loginFailures
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+func newLoginGuard(backoff time.Duration, lockout time.Duration) *loginGuard {
+	return &loginGuard{
+		backoff:  backoff,
+		lockout:  lockout,
+		failures: map[string]*loginFailures{},
+		now:      time.Now,
+	}
+}
+
+// backoffStart returns the number of failures from which the backoff applies
+func backoffStart(maxFailures int) int {
+	return (maxFailures + 1) / 2
+}
+
+func loginUserKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Wait returns how long the keys are still blocked
+func (g *loginGuard) Wait(keys ...string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	var wait time.Duration
+	for _, key := range keys {
+		if f, ok := g.failures[key]; ok && f.blockedUntil.After(now) {
+			wait = max(wait, f.blockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Fail records a failure for the key, it returns true if the key is now locked out
+func (g *loginGuard) Fail(key string, maxFailures int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	g.cleanup(now)
+
+	f, ok := g.failures[key]
+	if !ok || now.Sub(f.last) > g.lockout {
+		f = &loginFailures{}
+		g.failures[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count >= maxFailures {
+		f.blockedUntil = now.Add(g.lockout)
+		return true
+	}
+	if start := backoffStart(maxFailures); f.count >= start {
+		delay := g.backoff << (f.count - start)
+		if delay <= 0 || delay > g.lockout {
+			delay = g.lockout
+		}
+		f.blockedUntil = now.Add(delay)
+	}
+	return false
+}
+
+// Reset forgets the failures of the key, it returns false if it had none
+func (g *loginGuard) Reset(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.failures[key]
+	delete(g.failures, key)
+	return ok
+}
+
+func (g *loginGuard) cleanup(now time.Time) {
+	if now.Sub(g.lastCleanup) < g.lockout {
+		return
+	}
+	for k, f := range g.failures {
+		if now.Sub(f.last) > g.lockout && now.After(f.blockedUntil) {
+			delete(g.failures, k)
+		}
+	}
+	g.lastCleanup = now
+}
+
+func setRetryAfter(c echo.Context, wait time.Duration) {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// checkLoginAllowed refuses the login attempt while the username or the IP is blocked
+func (api *ApiHandler) checkLoginAllowed(c echo.Context, span trace.Span, username string) error {
+	wait := api.loginGuard.Wait(loginUserKey(username), loginIPKey(c.RealIP()))
+	if wait <= 0 {
+		return nil
+	}
+	span.AddEvent("security.login_blocked", trace.WithAttributes(
+		attribute.String("username", username),
+		attribute.String("ip", c.RealIP()),
+		attribute.Float64("retryAfterSeconds", wait.Seconds()),
+	))
+	setRetryAfter(c, wait)
+	return NewTooManyRequestsError(errors.New("too many failed login attempts, retry later"))
+}
+
+// loginFailed records the failed attempt for the username and the IP, user is nil for an unknown username
+func (api *ApiHandler) loginFailed(c echo.Context, span trace.Span, user db.UserDTO, username string) {
+	attributes := trace.WithAttributes(
+		attribute.String("username", username),
+		attribute.String("ip", c.RealIP()),
+	)
+	span.AddEvent("security.login_failed", attributes)
+	userID, userUUID := "", ""
+	if user != nil {
+		userID, userUUID = user.GetId(), user.GetUUID()
+	}
+	api.audit(trace.ContextWithSpan(c.Request().Context(), span), c, AuthEventLoginFailed, userID, userUUID, username)
+
+	userLocked := api.loginGuard.Fail(loginUserKey(username), api.conf.LoginMaxFailures)
+	ipLocked := api.loginGuard.Fail(loginIPKey(c.RealIP()), api.conf.LoginMaxIPFailures)
+	if userLocked || ipLocked {
+		span.AddEvent("security.login_lockout", attributes, trace.WithAttributes(
+			attribute.Bool("usernameLocked", userLocked),
+			attribute.Bool("ipLocked", ipLocked),
+		))
+		logger.WithField("username", username).WithField("ip", c.RealIP()).Warn("Login locked out after too many failures")
+	}
+}
+
+func (api *ApiHandler) loginSucceeded(username string) {
+	api.loginGuard.Reset(loginUserKey(username))
+}
+
+func (api *ApiHandler) unlockUser(c echo.Context) error {
+	username := c.Param("username")
+	if !api.loginGuard.Reset(loginUserKey(username)) {
+		return NewNotFoundError(errors.New("the user isn't locked out"))
+	}
+	logger.WithField("username", username).WithField("admin", getClaims(c).Username).Info("Unlocked user")
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *ApiHandler) unlockIP(c echo.Context) error {
+	ip := c.Param("ip")
+	if !api.loginGuard.Reset(loginIPKey(ip)) {
+		return NewNotFoundError(errors.New("the IP isn't locked out"))
+	}
+	logger.WithField("ip", ip).WithField("admin", getClaims(c).Username).Info("Unlocked IP")
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"gateway/db"
+	"gateway/messages"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+func (api *ApiHandler) getMe(c echo.Context) error {
+	ctx := c.Request().Context()
+	user, err := api.dbh.GetUsername(ctx, getClaims(c).Username)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	return c.JSON(http.StatusOK, NewUserResponse(user))
+}
+
+func (api *ApiHandler) updateMe(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "updateMe")
+
+	r := new(ProfileUpdateRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Body param failed")
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	user, err := api.dbh.GetUsername(ctx, getClaims(c).Username)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+
+	emailChanged := r.Email != nil && *r.Email != user.GetEmail()
+	if emailChanged {
+		other, err := api.dbh.GetUserByEmail(ctx, *r.Email)
+		if err == nil && other.GetId() != user.GetId() {
+			return NewConflictError(errors.New("the email is already used"))
+		}
+		if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+			return NewInternalServerError(err)
+		}
+	}
+
+	user, err = api.dbh.UpdateUser(ctx, user.GetId(), &db.UserUpdateRequest{
+		Email:     r.Email,
+		FirstName: r.FirstName,
+		LastName:  r.LastName,
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			return NewNotFoundError(err)
+		}
+		return NewInternalServerError(err)
+	}
+
+	// The new email is not verified, the login is refused until the link is followed
+	if emailChanged {
+		api.emailThrottle.Allow(strings.ToLower(user.GetEmail()))
+		FailOnError(l, api.sendVerificationEmail(user), "Failed to send the verification mail")
+	}
+	return c.JSON(http.StatusOK, NewUserResponse(user))
+}
+
+func (api *ApiHandler) changePassword(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "api.changePassword")
+	defer span.End()
+	l := logger.WithField("request", "changePassword")
+	claims := getClaims(c)
+
+	r := new(PasswordChangeRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Body param failed")
+		return NewBadRequestError(err)
+	}
+
+	user, err := api.dbh.GetUsername(ctx, claims.Username)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	r.Username = user.GetUsername()
+	r.Email = user.GetEmail()
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	// A stolen session must not be enough to guess the current password
+	if err := api.checkLoginAllowed(c, span, user.GetUsername()); err != nil {
+		return err
+	}
+	if !api.verifyPassword(ctx, user, r.CurrentPassword) {
+		api.loginFailed(c, span, user, user.GetUsername())
+		return NewForbiddenError(errors.New("current password incorrect"))
+	}
+
+	hashedPassword, err := api.hashPassword(r.Password)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	if err := api.dbh.UpdatePassword(ctx, user.GetId(), hashedPassword); err != nil {
+		return NewInternalServerError(err)
+	}
+	api.audit(ctx, c, AuthEventPasswordChanged, user.GetId(), user.GetUUID(), user.GetUsername())
+
+	// The other sessions are logged out, the current one stays signed in
+	sessions, err := api.dbh.GetSessions(ctx, user.GetId())
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	for _, session := range sessions {
+		if session.GetSessionID() == claims.SessionID {
+			continue
+		}
+		err := api.revokeSession(ctx, user.GetId(), session.GetSessionID())
+		if err != nil && !errors.Is(err, db.ErrSessionNotFound) {
+			return NewInternalServerError(err)
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// errNoBroker is returned when the user-deleted event can't be published without RabbitMQ
+var errNoBroker = errors.New("no RabbitMQ connection to publish the user deletion")
+
+// userDeletedConfirmTimeout bounds the wait for the broker to confirm the user-deleted event
+const userDeletedConfirmTimeout = 10 * time.Second
+
+// userDeletedPublisher publishes the user-deleted events on the connection and waits for their confirmation
+func userDeletedPublisher(conn *amqp.Connection) func(ctx context.Context, l *logrus.Entry, event *messages.UserDeleted) error {
+	return func(ctx context.Context, l *logrus.Entry, event *messages.UserDeleted) error {
+		if conn == nil {
+			return errNoBroker
+		}
+		ctx, cancel := context.WithTimeout(ctx, userDeletedConfirmTimeout)
+		defer cancel()
+		return messages.PublishUserDeleted(ctx, l, conn, event)
+	}
+}
+
+// deleteMe soft-deletes the user, the other services delete its data when they get the event
+// and the user is purged after the grace period by purgeDeletedUsers.
+// The user is restored if the broker doesn't confirm the event, a deletion the other services
+// don't hear about would keep their data forever.
+func (api *ApiHandler) deleteMe(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "deleteMe")
+
+	user, err := api.dbh.GetUsername(ctx, getClaims(c).Username)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	if err := api.dbh.DeleteUser(ctx, user.GetId()); err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			return NewNotFoundError(err)
+		}
+		return NewInternalServerError(err)
+	}
+
+	event := &messages.UserDeleted{
+		UserID:    user.GetId(),
+		UUID:      user.GetUUID(),
+		Username:  user.GetUsername(),
+		DeletedAt: time.Now(),
+	}
+	if err := api.publishUserDeleted(ctx, l, event); err != nil {
+		l = l.WithField("username", user.GetUsername())
+		FailOnError(l, err, "Failed to publish the user deletion")
+		// The request may be cancelled, the user is restored anyway
+		if err := api.dbh.RestoreUser(context.WithoutCancel(ctx), user.GetId()); err != nil {
+			FailOnError(l, err, "Failed to restore the user after the failed deletion")
+			return NewInternalServerError(err)
+		}
+		return NewServiceUnavailableError(errors.New("the deletion can't be processed, retry later"))
+	}
+
+	if err := api.dbh.DeleteToken(ctx, user.GetId()); err != nil {
+		return NewInternalServerError(err)
+	}
+	if err := api.dbh.DeleteRefreshTokens(ctx, user.GetId()); err != nil {
+		return NewInternalServerError(err)
+	}
+	keys, err := api.dbh.GetApiKeys(ctx, user.GetId())
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	for _, key := range keys {
+		err := api.dbh.RevokeApiKey(ctx, user.GetId(), key.GetPrefix())
+		if err != nil && !errors.Is(err, db.ErrApiKeyNotFound) {
+			return NewInternalServerError(err)
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
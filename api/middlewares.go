@@ -3,25 +3,61 @@ package api
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 )
 
+const sessionTouchInterval = time.Minute
+
 type jwtCustomClaims struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	UserID   string `json:"userId"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	UserID    string `json:"userId"`
+	UUID      string `json:"uuid"`
+	SessionID string `json:"sessionId"`
+	Role      Role   `json:"role"`
 	jwt.RegisteredClaims
 }
 
+// getClaims returns the claims of the access token validated by the jwt middleware
+func getClaims(c echo.Context) *jwtCustomClaims {
+	return c.Get("user").(*jwt.Token).Claims.(*jwtCustomClaims)
+}
+
+// authenticatedUUID returns the UUID of the authenticated user to send to the other services.
+// The userId given explicitly by the client is only accepted if it's the same.
+func authenticatedUUID(c echo.Context, explicit string) (string, error) {
+	uuid := getClaims(c).UUID
+	if uuid == "" {
+		return "", NewUnauthorizedError(errors.New("the token doesn't identify the user, please login again"))
+	}
+	if explicit != "" && explicit != uuid {
+		return "", NewForbiddenError(errors.New("userId doesn't match the authenticated user"))
+	}
+	return uuid, nil
+}
+
+// jwtConfig verifies the access tokens signed by the keyring
+func (api *ApiHandler) jwtConfig() echojwt.Config {
+	return echojwt.Config{
+		NewClaimsFunc: func(c echo.Context) jwt.Claims {
+			return new(jwtCustomClaims)
+		},
+		KeyFunc: api.keyring.Keyfunc,
+	}
+}
+
 func (api *ApiHandler) extractUser(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		ctx := c.Request().Context()
 		user := c.Get("user").(*jwt.Token)
 		claims := user.Claims.(*jwtCustomClaims)
 		logger.Debugln(claims.ID)
 		userId := fmt.Sprintf("%v", claims.UserID)
-		t, err := api.dbh.GetTokenUser(user.Raw, userId)
+		t, err := api.dbh.GetTokenUser(ctx, user.Raw, userId, claims.SessionID)
 		if err != nil {
 			logger.WithError(err).Debug("Failed to get token")
 			return NewUnauthorizedError(errors.New("You are not authorized to access this resource"))
@@ -31,6 +67,11 @@ func (api *ApiHandler) extractUser(next echo.HandlerFunc) echo.HandlerFunc {
 			return NewUnauthorizedError(errors.New("You are not authorized to access this resource"))
 		}
 
+		// Only refresh the last seen date from time to time to avoid a write on every request
+		if now := time.Now(); now.Sub(t.GetLastSeenAt()) > sessionTouchInterval {
+			DebugOnError(logger, api.dbh.TouchSession(ctx, claims.SessionID, now), "Failed to touch session")
+		}
+
 		c.Set("user", user) // Set the user into the context
 		return next(c)
 	}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"gateway/db"
+	"gateway/oidc"
+	"gateway/utils"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	oidcFlowAudience = "oidc-flow"
+	oidcFlowCookie   = "oidc_flow"
+	oidcFlowTTL      = 10 * time.Minute
+	// oidcUsernameAttempts is the number of random suffixes tried when the username is already taken
+	oidcUsernameAttempts = 3
+)
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// oidcFlowClaims keep the state of the authorization between the redirect to the provider and the callback.
+// They're stored in an HttpOnly cookie so the PKCE verifier never goes through the provider.
+type oidcFlowClaims struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+func (api *ApiHandler) oidcCookiePath() string {
+	return api.conf.ListenRoute + "/api/oidc"
+}
+
+func (api *ApiHandler) oidcLogin(c echo.Context) error {
+	l := logger.WithField("request", "oidcLogin")
+
+	flow := new(oidcFlowClaims)
+	for _, v := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		value, err := oidc.GenerateVerifier()
+		if err != nil {
+			return NewInternalServerError(err)
+		}
+		*v = value
+	}
+	now := time.Now()
+	flow.RegisteredClaims = jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{oidcFlowAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(oidcFlowTTL)),
+	}
+	cookie, err := api.signInternalToken(flow)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+
+	authURL, err := api.oidc.AuthCodeURL(c.Request().Context(), flow.State, flow.Nonce, flow.Verifier)
+	if err != nil {
+		WarnOnError(l, err, "Failed to discover the OIDC provider")
+		return NewInternalServerError(errors.New("identity provider unavailable"))
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    cookie,
+		Path:     api.oidcCookiePath(),
+		Expires:  now.Add(oidcFlowTTL),
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+func (api *ApiHandler) oidcCallback(c echo.Context) error {
+	l := logger.WithField("request", "oidcCallback")
+
+	if e := c.QueryParam("error"); e != "" {
+		return NewUnauthorizedError(fmt.Errorf("identity provider refused the login: %v", e))
+	}
+	code := c.QueryParam("code")
+	state := c.QueryParam("state")
+	if code == "" || state == "" {
+		return NewBadRequestError(errors.New("code and state query params are required"))
+	}
+
+	invalid := NewUnauthorizedError(errors.New("invalid or expired login attempt"))
+	cookie, err := c.Cookie(oidcFlowCookie)
+	if err != nil {
+		return invalid
+	}
+	// The flow can only be used once
+	c.SetCookie(&http.Cookie{
+		Name:     oidcFlowCookie,
+		Path:     api.oidcCookiePath(),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	flow := new(oidcFlowClaims)
+	if err := api.parseInternalToken(cookie.Value, flow, oidcFlowAudience); err != nil {
+		DebugOnError(l, err, "Invalid OIDC flow cookie")
+		return invalid
+	}
+	if subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return invalid
+	}
+
+	ctx := c.Request().Context()
+	rawIDToken, err := api.oidc.Exchange(ctx, code, flow.Verifier)
+	if err != nil {
+		WarnOnError(l, err, "Failed to exchange the authorization code")
+		return invalid
+	}
+	claims, err := api.oidc.VerifyIDToken(ctx, rawIDToken, flow.Nonce)
+	if err != nil {
+		WarnOnError(l, err, "Invalid ID token")
+		return invalid
+	}
+
+	user, err := api.linkOIDCIdentity(ctx, claims)
+	if err != nil {
+		return err
+	}
+	return api.completeLogin(ctx, c, user)
+}
+
+// linkOIDCIdentity returns the user linked to the subject of the ID token.
+// On the first login the identity is linked to the user with the same email if the provider verified it,
+// otherwise a new user is created.
+func (api *ApiHandler) linkOIDCIdentity(ctx context.Context, claims *oidc.IDTokenClaims) (db.UserDTO, error) {
+	l := logger.WithField("request", "linkOIDCIdentity")
+
+	identity, err := api.dbh.GetIdentity(ctx, api.oidc.Issuer(), claims.Subject)
+	if err == nil {
+		user, err := api.dbh.GetUsername(ctx, identity.GetUsername())
+		if err != nil {
+			return nil, NewInternalServerError(err)
+		}
+		return user, nil
+	}
+	if !errors.Is(err, db.ErrIdentityNotFound) {
+		return nil, NewInternalServerError(err)
+	}
+
+	if claims.Email == "" {
+		return nil, NewUnprocessableEntityError(errors.New("the identity provider didn't share an email"))
+	}
+
+	var user db.UserDTO
+	if claims.EmailVerified {
+		user, err = api.dbh.GetUserByEmail(ctx, claims.Email)
+		if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+			return nil, NewInternalServerError(err)
+		}
+	}
+	if user == nil {
+		user, err = api.createOIDCUser(ctx, claims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = api.dbh.CreateIdentity(ctx, &db.IdentityRequest{
+		Issuer:   api.oidc.Issuer(),
+		Subject:  claims.Subject,
+		UserID:   user.GetId(),
+		Username: user.GetUsername(),
+	})
+	if err != nil {
+		return nil, NewInternalServerError(err)
+	}
+	l.WithField("username", user.GetUsername()).Info("Linked OIDC identity")
+	return user, nil
+}
+
+// createOIDCUser creates the user of an identity seen for the first time, it has a random password
+// that can be replaced with the password reset flow
+func (api *ApiHandler) createOIDCUser(ctx context.Context, claims *oidc.IDTokenClaims) (db.UserDTO, error) {
+	l := logger.WithField("request", "createOIDCUser")
+
+	password, err := utils.GenerateToken(refreshTokenSize)
+	if err != nil {
+		return nil, NewInternalServerError(err)
+	}
+	hashedPassword, err := api.hashPassword(password)
+	if err != nil {
+		return nil, NewInternalServerError(err)
+	}
+	secretKey, err := utils.GenerateSecretKey()
+	if err != nil {
+		return nil, NewInternalServerError(err)
+	}
+
+	base := oidcUsername(claims)
+	username := base
+	var user db.UserDTO
+	for i := 0; i <= oidcUsernameAttempts; i++ {
+		user, err = api.dbh.CreateUser(ctx, &db.UserRequest{
+			Email:         claims.Email,
+			Username:      username,
+			Password:      hashedPassword,
+			FirstName:     claims.GivenName,
+			LastName:      claims.FamilyName,
+			EncryptionKey: secretKey,
+		})
+		if err == nil {
+			break
+		}
+		suffix, err := utils.GenerateToken(3)
+		if err != nil {
+			return nil, NewInternalServerError(err)
+		}
+		username = base + "-" + strings.ToLower(usernameInvalidChars.ReplaceAllString(suffix, ""))
+	}
+	if err != nil {
+		return nil, NewConflictError(errors.New("an account already uses this email"))
+	}
+
+	if claims.EmailVerified {
+		if err := api.dbh.VerifyEmail(ctx, user.GetId(), user.GetEmail()); err != nil {
+			return nil, NewInternalServerError(err)
+		}
+		return api.dbh.GetUsername(ctx, user.GetUsername())
+	}
+	api.emailThrottle.Allow(strings.ToLower(user.GetEmail()))
+	FailOnError(l, api.sendVerificationEmail(user), "Failed to send the verification mail")
+	return user, nil
+}
+
+// oidcUsername derives a username from the preferred username or the email of the ID token
+func oidcUsername(claims *oidc.IDTokenClaims) string {
+	username := claims.PreferredUsername
+	if username == "" {
+		username, _, _ = strings.Cut(claims.Email, "@")
+	}
+	username = usernameInvalidChars.ReplaceAllString(strings.ToLower(username), "")
+	if len(username) < 4 {
+		username = "user-" + username
+	}
+	return username
+}
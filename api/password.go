@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/configuration"
+	"gateway/db"
+	"gateway/mailer"
+	"gateway/utils"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const passwordResetTokenSize = 32
+
+// newPasswords hashes with the configured hasher and keeps the other one to verify the older hashes
+func newPasswords(conf *configuration.Configuration) *utils.Passwords {
+	argon2id := utils.NewArgon2idHasher(uint32(conf.Argon2Memory), uint32(conf.Argon2Iterations), uint8(conf.Argon2Parallelism))
+	bcrypt := utils.NewBcryptHasher(conf.BcryptCost)
+	if conf.PasswordHasher == "bcrypt" {
+		return utils.NewPasswords(bcrypt, argon2id)
+	}
+	return utils.NewPasswords(argon2id, bcrypt)
+}
+
+func (api *ApiHandler) hashPassword(password string) (string, error) {
+	return api.passwords.Hash(password)
+}
+
+// verifyUnknownPassword checks the password against a hash of the current hasher, so the login
+// of an unknown username takes as long as a wrong password
+func (api *ApiHandler) verifyUnknownPassword(password string) {
+	api.passwords.Verify(password, api.unknownUserHash)
+}
+
+// verifyPassword checks the password of the user and upgrades its hash when it was made
+// with another algorithm or older parameters
+func (api *ApiHandler) verifyPassword(ctx context.Context, user db.UserDTO, password string) bool {
+	l := logger.WithField("request", "verifyPassword")
+	ok, rehash, err := api.passwords.Verify(password, user.GetPassword())
+	if err != nil {
+		DebugOnError(l, err, "Failed to verify password")
+		return false
+	}
+	if ok && rehash {
+		hashedPassword, err := api.hashPassword(password)
+		if WarnOnError(l, err, "Failed to rehash password") {
+			return ok
+		}
+		if !WarnOnError(l, api.dbh.UpdatePassword(ctx, user.GetId(), hashedPassword), "Failed to store the rehashed password") {
+			l.WithField("username", user.GetUsername()).Info("Upgraded password hash")
+		}
+	}
+	return ok
+}
+
+func (api *ApiHandler) forgotPassword(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "forgotPassword")
+
+	r := new(ForgotPasswordRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Body param failed")
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	// The response is the same whether the email exists or not, to not disclose the registered emails
+	user, err := api.dbh.GetUserByEmail(ctx, r.Email)
+	if err != nil {
+		if !errors.Is(err, db.ErrUserNotFound) {
+			return NewInternalServerError(err)
+		}
+		DebugOnError(l, err, "No user found for the email")
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	token, err := utils.GenerateToken(passwordResetTokenSize)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	_, err = api.dbh.CreatePasswordResetToken(ctx, &db.PasswordResetTokenRequest{
+		Hash:           utils.HashToken(token),
+		UserID:         user.GetId(),
+		Username:       user.GetUsername(),
+		ExpirationDate: time.Now().Add(api.conf.PasswordResetTTL),
+	})
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+
+	api.sendInBackground(l, "Failed to send the password reset mail", func() error {
+		return api.mailer.Send(&mailer.Message{
+			To:      user.GetEmail(),
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hello %v,\n\nFollow this link to choose a new password, it expires in %v:\n%v/reset-password?token=%v\n\nIf you didn't ask for it, you can ignore this message.",
+				user.GetUsername(), api.conf.PasswordResetTTL, api.conf.AppURL, token),
+		})
+	})
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (api *ApiHandler) resetPassword(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "resetPassword")
+
+	r := new(ResetPasswordRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Body param failed")
+		return NewBadRequestError(err)
+	}
+
+	// The token is only consumed once the new password is valid
+	invalid := NewBadRequestError(errors.New("invalid or expired password reset token"))
+	hash := utils.HashToken(r.Token)
+	resetToken, err := api.dbh.GetPasswordResetToken(ctx, hash)
+	if err != nil {
+		if errors.Is(err, db.ErrPasswordResetTokenInvalid) {
+			return invalid
+		}
+		return NewInternalServerError(err)
+	}
+	if resetToken.GetExpirationDate().Before(time.Now()) {
+		return invalid
+	}
+	user, err := api.dbh.GetUsername(ctx, resetToken.GetUsername())
+	if err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			return invalid
+		}
+		return NewInternalServerError(err)
+	}
+	r.Username = user.GetUsername()
+	r.Email = user.GetEmail()
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	if _, err := api.dbh.UsePasswordResetToken(ctx, hash); err != nil {
+		if errors.Is(err, db.ErrPasswordResetTokenInvalid) {
+			return invalid
+		}
+		return NewInternalServerError(err)
+	}
+
+	hashedPassword, err := api.hashPassword(r.Password)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	userID := resetToken.GetUserID()
+	if err := api.dbh.UpdatePassword(ctx, userID, hashedPassword); err != nil {
+		return NewInternalServerError(err)
+	}
+
+	// Whoever had access to the account must be logged out
+	if err := api.dbh.DeleteToken(ctx, userID); err != nil {
+		return NewInternalServerError(err)
+	}
+	if err := api.dbh.DeleteRefreshTokens(ctx, userID); err != nil {
+		return NewInternalServerError(err)
+	}
+	api.audit(c.Request().Context(), c, AuthEventPasswordReset, userID, user.GetUUID(), user.GetUsername())
+	return c.NoContent(http.StatusNoContent)
+}
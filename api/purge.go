@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// tokenPurgeLock is held by the replica that purges the expired tokens
+const tokenPurgeLock = "token-purge"
+
+// RunUserPurge hard-deletes the users whose grace period is over, every UserPurgeInterval until the context is done.
+// The interval must be positive.
+func (api *ApiHandler) RunUserPurge(ctx context.Context) {
+	ticker := time.NewTicker(api.conf.UserPurgeInterval)
+	defer ticker.Stop()
+	for {
+		api.purgeDeletedUsers(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeDeletedUsers returns the number of purged users, a user that fails is retried by the next run
+func (api *ApiHandler) purgeDeletedUsers(ctx context.Context, now time.Time) int {
+	l := logger.WithField("job", "purgeDeletedUsers")
+
+	users, err := api.dbh.GetDeletedUsers(ctx, now.Add(-api.conf.UserDeletionGrace))
+	if FailOnError(l, err, "Failed to get the deleted users") {
+		return 0
+	}
+	purged := 0
+	for _, user := range users {
+		if FailOnError(l.WithField("username", user.GetUsername()), api.dbh.PurgeUser(ctx, user.GetId()), "Failed to purge the user") {
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		l.WithField("count", purged).Info("Purged the deleted users")
+	}
+	return purged
+}
+
+// RunTokenPurge deletes the expired tokens every TokenPurgeInterval until the context is done.
+// The replicas compete for a lock held for an interval, only the one holding it purges.
+func (api *ApiHandler) RunTokenPurge(ctx context.Context) {
+	l := logger.WithField("job", "purgeExpiredTokens")
+	owner := replicaID()
+	purged, err := otel.Meter(api.conf.OtelServiceName).Int64Counter("gateway.tokens.purged",
+		metric.WithDescription("Number of expired tokens purged"),
+	)
+	WarnOnError(l, err, "Failed to create the purge metrics")
+
+	ticker := time.NewTicker(api.conf.TokenPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if count := api.purgeExpiredTokens(ctx, owner, time.Now()); count > 0 && purged != nil {
+			purged.Add(ctx, int64(count))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeExpiredTokens returns the number of purged tokens, nothing is purged unless owner holds the lock
+func (api *ApiHandler) purgeExpiredTokens(ctx context.Context, owner string, now time.Time) int {
+	l := logger.WithField("job", "purgeExpiredTokens")
+
+	acquired, err := api.dbh.AcquireLock(ctx, tokenPurgeLock, owner, api.conf.TokenPurgeInterval)
+	if FailOnError(l, err, "Failed to acquire the purge lock") || !acquired {
+		return 0
+	}
+	count, err := api.dbh.PurgeExpiredTokens(ctx, now)
+	if FailOnError(l, err, "Failed to purge the expired tokens") {
+		return 0
+	}
+	if count > 0 {
+		l.WithField("count", count).Info("Purged the expired tokens")
+	}
+	return count
+}
+
+// replicaID identifies the replica in the locks, the hostname is only there to read them
+func replicaID() string {
+	hostname, _ := os.Hostname()
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hostname + "-" + hex.EncodeToString(b)
+}
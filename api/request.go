@@ -12,9 +12,10 @@ type postIngredientCatalogRequest struct {
 	Type     string `json:"type" validate:"required,oneof=vegetable fruit meat fish dairy spice sugar cereals nuts other"`
 }
 
+// The userId of the requests is optional, it's the authenticated user if it's missing
 type postIngredientInventoryRequest struct {
 	ID     string  `json:"id" validate:"required"`
-	UserID string  `json:"userId" validate:"required"`
+	UserID string  `json:"userId" validate:"omitempty"`
 	Name   string  `json:"name" validate:"omitempty"`
 	Amount float64 `json:"amount" validate:"required,min=0.1"`
 	Unit   string  `json:"unit" validate:"oneof=i is cup tbsp tsp g kg ml l"`
@@ -36,7 +37,7 @@ const (
 
 type putIngredientInventoryRequest struct {
 	ID     string      `param:"id" validate:"required"`
-	UserID string      `json:"userId" validate:"required"`
+	UserID string      `json:"userId" validate:"omitempty"`
 	Name   string      `json:"name" validate:"omitempty"`
 	Amount float64     `json:"amount" validate:"required,min=0.1"`
 	Unit   UnitRequest `json:"unit" validate:"oneof=i is cup tbsp tsp g kg ml l"`
@@ -44,12 +45,12 @@ type putIngredientInventoryRequest struct {
 
 type deleteIngredientInventoryRequest struct {
 	ID     string `param:"id" validate:"required"`
-	UserID string `param:"userId" validate:"required"`
+	UserID string `param:"userId" validate:"omitempty"`
 }
 
 type postIngredientShoppingListRequest struct {
 	ID     string      `param:"id" validate:"required"`
-	UserID string      `json:"userId" validate:"required"`
+	UserID string      `json:"userId" validate:"omitempty"`
 	Amount float64     `json:"amount" validate:"required,min=0.1"`
 	Unit   UnitRequest `json:"unit" validate:"oneof=i is cup tbsp tsp g kg ml l"`
 }
@@ -94,7 +95,7 @@ type UpdateShopRequest struct {
 type UserCreationRequest struct {
 	Email     string `json:"email" validate:"required,email"`
 	Username  string `json:"username" validate:"required,min=4"`
-	Password  string `json:"password" validate:"required,min=8"`
+	Password  string `json:"password" validate:"required,min=8,password_strength,password_personal,password_breached"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 }
@@ -103,3 +104,82 @@ type UserConnectionRequest struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
 }
+
+type TokenRefreshRequest struct {
+	RefreshToken string `json:"refreshToken" validate:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,password_strength,password_personal,password_breached"`
+	// Username and Email are taken from the user of the token for the password_personal check
+	Username string `json:"-"`
+	Email    string `json:"-"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+type SecondFactorRequest struct {
+	Code         string `json:"code" validate:"required_without=RecoveryCode,omitempty,len=6,numeric"`
+	RecoveryCode string `json:"recoveryCode" validate:"required_without=Code"`
+}
+
+type MFALoginRequest struct {
+	ChallengeToken string `json:"challengeToken" validate:"required"`
+	SecondFactorRequest
+}
+
+type ApiKeyCreationRequest struct {
+	Name          string   `json:"name" validate:"required,max=64"`
+	Scopes        []string `json:"scopes" validate:"required,min=1,dive,oneof=catalog:write price:write"`
+	ExpiresInDays int      `json:"expiresInDays" validate:"omitempty,min=1,max=3650"`
+}
+
+type RoleUpdateRequest struct {
+	Username string `param:"username" validate:"required"`
+	Role     string `json:"role" validate:"required,oneof=user editor admin"`
+}
+
+// ProfileUpdateRequest only changes the fields that are sent
+type ProfileUpdateRequest struct {
+	Email     *string `json:"email" validate:"omitnil,email"`
+	FirstName *string `json:"firstName" validate:"omitnil,max=64"`
+	LastName  *string `json:"lastName" validate:"omitnil,max=64"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	Password        string `json:"password" validate:"required,min=8,password_strength,password_personal,password_breached"`
+	// Username and Email are taken from the user for the password_personal check
+	Username string `json:"-"`
+	Email    string `json:"-"`
+}
+
+// SecurityEventsRequest filters the authentication events, the dates are RFC 3339
+type SecurityEventsRequest struct {
+	Type  string    `query:"type" validate:"omitempty,oneof=signup login login_failed logout password_changed password_reset token_revoked"`
+	Since time.Time `query:"since"`
+	Until time.Time `query:"until"`
+	Limit int       `query:"limit" validate:"omitempty,min=1,max=500"`
+}
+
+type AdminSecurityEventsRequest struct {
+	SecurityEventsRequest
+	UserID   string `query:"userId"`
+	Username string `query:"username"`
+	IP       string `query:"ip" validate:"omitempty,ip"`
+}
+
+type ExportRequest struct {
+	Format string `query:"format" validate:"omitempty,oneof=json zip"`
+}
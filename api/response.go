@@ -1,6 +1,7 @@
 package api
 
 import (
+	"gateway/db"
 	"gateway/services"
 	"time"
 )
@@ -78,3 +79,102 @@ type IngredientInventoryResponse struct {
 	UpdatedAt time.Time `json:"updatedAt"`
 	InventoryQuantity
 }
+
+type SessionResponse struct {
+	ID             string    `json:"id"`
+	UserAgent      string    `json:"userAgent"`
+	IP             string    `json:"ip"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LastSeenAt     time.Time `json:"lastSeenAt"`
+	ExpirationDate time.Time `json:"expirationDate"`
+	Current        bool      `json:"current"`
+}
+
+func NewSessionResponse(session db.TokenDTO, currentSessionID string) SessionResponse {
+	return SessionResponse{
+		ID:             session.GetSessionID(),
+		UserAgent:      session.GetUserAgent(),
+		IP:             session.GetIP(),
+		CreatedAt:      session.GetCreatedAt(),
+		LastSeenAt:     session.GetLastSeenAt(),
+		ExpirationDate: session.GetExpirationDate(),
+		Current:        session.GetSessionID() == currentSessionID,
+	}
+}
+
+type AuthEventResponse struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	UserID    string    `json:"userId"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	TraceID   string    `json:"traceId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func NewAuthEventResponse(event db.AuthEventDTO) AuthEventResponse {
+	return AuthEventResponse{
+		ID:        event.GetId(),
+		Type:      event.GetType(),
+		UserID:    event.GetUserID(),
+		Username:  event.GetUsername(),
+		IP:        event.GetIP(),
+		UserAgent: event.GetUserAgent(),
+		TraceID:   event.GetTraceID(),
+		CreatedAt: event.GetCreatedAt(),
+	}
+}
+
+type ApiKeyResponse struct {
+	Prefix         string     `json:"prefix"`
+	Name           string     `json:"name"`
+	Scopes         []string   `json:"scopes"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	LastUsedAt     *time.Time `json:"lastUsedAt,omitempty"`
+	ExpirationDate *time.Time `json:"expirationDate,omitempty"`
+	// Key is only returned once, when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+func NewApiKeyResponse(key db.ApiKeyDTO) ApiKeyResponse {
+	response := ApiKeyResponse{
+		Prefix:    key.GetPrefix(),
+		Name:      key.GetName(),
+		Scopes:    key.GetScopes(),
+		CreatedAt: key.GetCreatedAt(),
+	}
+	if t := key.GetLastUsedAt(); !t.IsZero() {
+		response.LastUsedAt = &t
+	}
+	if t := key.GetExpirationDate(); !t.IsZero() {
+		response.ExpirationDate = &t
+	}
+	return response
+}
+
+type UserResponse struct {
+	ID            string `json:"id"`
+	UUID          string `json:"uuid"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	FirstName     string `json:"firstName"`
+	LastName      string `json:"lastName"`
+	Role          string `json:"role"`
+	TOTPEnabled   bool   `json:"totpEnabled"`
+}
+
+func NewUserResponse(user db.UserDTO) UserResponse {
+	return UserResponse{
+		ID:            user.GetId(),
+		UUID:          user.GetUUID(),
+		Username:      user.GetUsername(),
+		Email:         user.GetEmail(),
+		EmailVerified: user.IsEmailVerified(),
+		FirstName:     user.GetFirstName(),
+		LastName:      user.GetLastName(),
+		Role:          user.GetRole(),
+		TOTPEnabled:   user.IsTOTPEnabled(),
+	}
+}
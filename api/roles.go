@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/db"
+	"net/http"
+
+	echojwt "github.com/labstack/echo-jwt/v4"
+	"github.com/labstack/echo/v4"
+)
+
+type Role string
+
+const (
+	RoleUser   Role = db.DefaultRole
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+// roleLevels orders the roles, a role has the rights of the roles below it
+var roleLevels = map[Role]int{
+	RoleUser:   0,
+	RoleEditor: 1,
+	RoleAdmin:  2,
+}
+
+// scopeRoles is the role needed to create an API key with the scope
+var scopeRoles = map[string]Role{
+	ScopeCatalogWrite: RoleEditor,
+	ScopePriceWrite:   RoleEditor,
+}
+
+// Includes tells if the role has the rights of the other role, unknown roles have no rights
+func (r Role) Includes(other Role) bool {
+	level, ok := roleLevels[r]
+	if !ok {
+		return false
+	}
+	return level >= roleLevels[other]
+}
+
+// requireUser authenticates the request with the bearer token of a user session
+func (api *ApiHandler) requireUser() echo.MiddlewareFunc {
+	bearer := echojwt.WithConfig(api.jwtConfig())
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return bearer(api.extractUser(next))
+	}
+}
+
+// requireRole refuses the authenticated requests without the role,
+// it goes after requireUser or requireScope
+func (api *ApiHandler) requireRole(role Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			current, err := api.currentRole(c)
+			if err != nil {
+				return err
+			}
+			if !current.Includes(role) {
+				return NewForbiddenError(fmt.Errorf("the %v role is required", role))
+			}
+			return next(c)
+		}
+	}
+}
+
+// currentRole returns the current role of the user, or of the owner of the API key. The role in the claims
+// is only informative, a demoted user loses its rights before its token expires.
+func (api *ApiHandler) currentRole(c echo.Context) (Role, error) {
+	ctx := c.Request().Context()
+	if key := getApiKey(c); key != nil {
+		owner, err := api.dbh.GetUsername(ctx, key.GetUsername())
+		if err != nil {
+			logger.WithError(err).Debug("Failed to get the owner of the API key")
+			return "", NewUnauthorizedError(errors.New("invalid API key"))
+		}
+		return Role(owner.GetRole()), nil
+	}
+	user, err := api.dbh.GetUsername(ctx, getClaims(c).Username)
+	if err != nil {
+		logger.WithError(err).Debug("Failed to get the user of the token")
+		return "", NewUnauthorizedError(errors.New("You are not authorized to access this resource"))
+	}
+	return Role(user.GetRole()), nil
+}
+
+// promoteAdmins gives the admin role to the configured users
+func (api *ApiHandler) promoteAdmins(ctx context.Context) {
+	l := logger.WithField("request", "promoteAdmins")
+	for _, username := range api.conf.AdminUsernames {
+		user, err := api.dbh.GetUsername(ctx, username)
+		if err != nil || user == nil || user.GetUsername() == "" {
+			l.WithField("username", username).Warn("Admin user not found")
+			continue
+		}
+		if Role(user.GetRole()) == RoleAdmin {
+			continue
+		}
+		if !WarnOnError(l, api.dbh.UpdateRole(ctx, user.GetId(), string(RoleAdmin)), "Failed to promote admin") {
+			l.WithField("username", username).Info("Promoted user to admin")
+		}
+	}
+}
+
+func (api *ApiHandler) updateUserRole(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "updateUserRole")
+
+	r := new(RoleUpdateRequest)
+	if err := c.Bind(r); err != nil {
+		FailOnError(l, err, "Body param failed")
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	user, err := api.dbh.GetUsername(ctx, r.Username)
+	if err != nil || user == nil || user.GetUsername() == "" {
+		return NewNotFoundError(errors.New("user not found"))
+	}
+	if user.GetId() == getClaims(c).UserID {
+		return NewForbiddenError(errors.New("admins can't change their own role"))
+	}
+	if err := api.dbh.UpdateRole(ctx, user.GetId(), r.Role); err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			return NewNotFoundError(err)
+		}
+		return NewInternalServerError(err)
+	}
+	l.WithField("username", user.GetUsername()).WithField("role", r.Role).Info("Updated user role")
+	return c.NoContent(http.StatusNoContent)
+}
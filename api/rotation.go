@@ -0,0 +1,38 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// keyRotationLock is held by the replica that rotates the encryption keys
+const keyRotationLock = "key-rotation"
+
+// keyRotationLockTTL bounds the rotation, the lock of a replica stopped during it is taken again after the TTL
+const keyRotationLockTTL = time.Hour
+
+// RotateEncryptionKeys wraps the data keys with the current master key again, on a single replica.
+// The replicas starting while the lock is held skip it, the rotation in progress covers their keys.
+func (api *ApiHandler) RotateEncryptionKeys(ctx context.Context) {
+	api.rotateEncryptionKeys(ctx, replicaID())
+}
+
+// rotateEncryptionKeys returns the number of rotated users, nothing is rotated unless owner holds the lock
+func (api *ApiHandler) rotateEncryptionKeys(ctx context.Context, owner string) int {
+	l := logger.WithField("job", "rotateEncryptionKeys")
+
+	acquired, err := api.dbh.AcquireLock(ctx, keyRotationLock, owner, keyRotationLockTTL)
+	if FailOnError(l, err, "Failed to acquire the rotation lock") {
+		return 0
+	}
+	if !acquired {
+		l.Info("The encryption keys are rotated by another replica")
+		return 0
+	}
+	rotated, err := api.dbh.RotateEncryptionKeys(ctx)
+	if FailOnError(l, err, "Failed to rotate the encryption keys") {
+		return 0
+	}
+	l.WithField("users", rotated).Info("Rotated the encryption keys")
+	return rotated
+}
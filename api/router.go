@@ -1,7 +1,9 @@
 package api
 
 import (
+	"gateway/configuration"
 	"gateway/validation"
+	"net"
 	"net/http"
 	"time"
 
@@ -41,8 +43,23 @@ func (cv *CustomValidator) Validate(i interface{}) error {
 	return nil
 }
 
-func New(validation *validation.Validation) *echo.Echo {
+// ipExtractor only trusts the X-Forwarded-For header when the request comes from one of the proxies,
+// a client could else choose its IP and escape the lockout
+func ipExtractor(trustedProxies []*net.IPNet) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	// The loopback, link local and private ranges are trusted by default, only the configured ones are kept
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+func New(validation *validation.Validation, conf *configuration.Configuration) *echo.Echo {
 	e := echo.New()
+	e.IPExtractor = ipExtractor(conf.TrustedProxies)
 	var validate *validator.Validate
 	validate, trans = validation.Validate, validation.Trans
 
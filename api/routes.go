@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"gateway/db"
 	"gateway/messages"
 	"gateway/services"
 	"net/http"
+	"net/url"
 	"reflect"
 	"sync"
 
@@ -17,7 +19,6 @@ import (
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
-	"gorm.io/gorm"
 )
 
 var logger = logrus.WithField("context", "api/routes")
@@ -47,12 +48,13 @@ func (api *ApiHandler) getServicesList() []string {
 }
 
 func (api *ApiHandler) getReadyStatus(c echo.Context) error {
+	ctx := c.Request().Context()
 	l := logger.WithField("request", "getReadyStatus")
 
 	status := ReadyStatus
 	httpStatus := http.StatusOK
 
-	err := api.dbh.Ping()
+	err := api.dbh.Ping(ctx)
 
 	if err != nil {
 		FailOnError(l, err, "Error when trying to ping database")
@@ -529,15 +531,19 @@ func (api *ApiHandler) postIngredientToShoppingList(c echo.Context) error {
 		FailOnError(l, err, "Request validation failed")
 		return NewBadRequestError(err)
 	}
+	userId, err := authenticatedUUID(c, request.UserID)
+	if err != nil {
+		return err
+	}
 	ingredientInventory := messages.IngredientShoppingList{
 		ID:     request.ID,
-		UserID: request.UserID,
+		UserID: userId,
 		Amount: request.Amount,
 		Unit:   string(request.Unit),
 	}
 	publishCtx, publishSpan := api.tracer.Start(context, "messages.PublishInventoryShoppingListQueue")
 	l.WithContext(publishCtx).WithField("ingredientInventory", ingredientInventory).Debug("Publishing ingredient to shopping list")
-	err := messages.PublishInventoryShoppingListQueue(l, api.amqp, ingredientInventory)
+	err = messages.PublishInventoryShoppingListQueue(l, api.amqp, ingredientInventory)
 	publishSpan.End()
 	if err != nil {
 		span.RecordError(err)
@@ -555,9 +561,9 @@ func (api *ApiHandler) postIngredientsForRecipeToShoppingList(c echo.Context) er
 
 	id := c.Param("id")
 
-	userId := c.QueryParam("userId")
-	if userId == "" {
-		return NewBadRequestError(errors.New("userId query param is required"))
+	userId, err := authenticatedUUID(c, c.QueryParam("userId"))
+	if err != nil {
+		return err
 	}
 
 	recipe := services.Recipe{}
@@ -653,7 +659,11 @@ func (api *ApiHandler) getShoppingList(c echo.Context) error {
 
 	l := logger.WithContext(ctx).WithField("request", "getShoppingList")
 
-	shoppingList, err := api.fetchShoppingList(ctx)
+	userId, err := authenticatedUUID(c, c.QueryParam("userId"))
+	if err != nil {
+		return err
+	}
+	shoppingList, err := api.fetchShoppingList(ctx, userId)
 	if err != nil {
 		return api.handleError(ctx, l, err, "Error fetching shopping list")
 	}
@@ -676,11 +686,11 @@ func (api *ApiHandler) getShoppingList(c echo.Context) error {
 	return c.JSON(http.StatusOK, response)
 }
 
-func (api *ApiHandler) fetchShoppingList(ctx context.Context) ([]services.IngredientsShoppingList, error) {
+func (api *ApiHandler) fetchShoppingList(ctx context.Context, userId string) ([]services.IngredientsShoppingList, error) {
 	ctx, span := api.tracer.Start(ctx, "api.fetchShoppingList")
 	defer span.End()
 
-	resp, err := http.Get(api.conf.ShoppingListMSURL + "/shopping-list")
+	resp, err := http.Get(api.conf.ShoppingListMSURL + "/shopping-list?userId=" + url.QueryEscape(userId))
 	if err != nil {
 		span.RecordError(err)
 		return nil, fmt.Errorf("error querying shopping list MS: %w", err)
@@ -959,6 +969,7 @@ func (api *ApiHandler) getPrices(c echo.Context) error {
 // TODO: Recipe author is now the UUID of the user
 // TODO Add visibility to the recipe
 func (api *ApiHandler) getRecipesByUser(c echo.Context) error {
+	ctx := c.Request().Context()
 
 	// Ensure the param id is not empty
 	if c.Param("username") == "" {
@@ -966,9 +977,9 @@ func (api *ApiHandler) getRecipesByUser(c echo.Context) error {
 	}
 
 	// Get the user ID
-	user, err := api.dbh.GetUsername(c.Param("username"))
+	user, err := api.dbh.GetUsername(ctx, c.Param("username"))
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
+		if errors.Is(err, db.ErrUserNotFound) {
 			return NewNotFoundError(errors.New("user not found"))
 		}
 		return NewInternalServerError(err)
@@ -1276,10 +1287,15 @@ func (api *ApiHandler) deleteIngredientForRecipeFromShoppingList(c echo.Context)
 
 	l := logger.WithField("request", "deleteIngredientForRecipeFromShoppingList")
 
-	slUrl := api.conf.ShoppingListMSURL + "/ingredient/" + ingredientId
+	userId, err := authenticatedUUID(c, c.QueryParam("userId"))
+	if err != nil {
+		return err
+	}
+	slUrl := api.conf.ShoppingListMSURL + "/ingredient/" + url.PathEscape(ingredientId)
 	if recipeId != "" {
-		slUrl = api.conf.ShoppingListMSURL + "/recipe/" + recipeId + "/ingredient/" + ingredientId
+		slUrl = api.conf.ShoppingListMSURL + "/recipe/" + url.PathEscape(recipeId) + "/ingredient/" + url.PathEscape(ingredientId)
 	}
+	slUrl += "?userId=" + url.QueryEscape(userId)
 	req, err := http.NewRequest(http.MethodDelete, slUrl, nil)
 	if err != nil {
 		FailOnError(l, err, "Error when trying to create DELETE request")
@@ -1309,12 +1325,12 @@ func (api *ApiHandler) deleteIngredientForRecipeFromShoppingList(c echo.Context)
 
 func (api *ApiHandler) getIngredientInventory(c echo.Context) error {
 	l := logger.WithField("request", "getIngredientInventory")
-	userId := c.QueryParam("userId")
-	if userId == "" {
-		return NewBadRequestError(errors.New("userId is required"))
+	userId, err := authenticatedUUID(c, c.QueryParam("userId"))
+	if err != nil {
+		return err
 	}
 	id := c.Param("id")
-	invUrl := fmt.Sprintf("%s/inventory/ingredient/%s?userId=%s", api.conf.InventoryMSURL, id, userId)
+	invUrl := fmt.Sprintf("%s/inventory/ingredient/%s?userId=%s", api.conf.InventoryMSURL, url.PathEscape(id), url.QueryEscape(userId))
 
 	resp, err := http.Get(invUrl)
 	if err != nil {
@@ -1331,11 +1347,11 @@ func (api *ApiHandler) getIngredientInventory(c echo.Context) error {
 
 func (api *ApiHandler) getInventory(c echo.Context) error {
 	l := logger.WithField("request", "getInventory")
-	userId := c.QueryParam("userId")
-	if userId == "" {
-		return NewBadRequestError(errors.New("userId is required"))
+	userId, err := authenticatedUUID(c, c.QueryParam("userId"))
+	if err != nil {
+		return err
 	}
-	invUrl := fmt.Sprintf("%s/inventory/ingredient?userId=%s", api.conf.InventoryMSURL, userId)
+	invUrl := fmt.Sprintf("%s/inventory/ingredient?userId=%s", api.conf.InventoryMSURL, url.QueryEscape(userId))
 
 	resp, err := http.Get(invUrl)
 	if err != nil {
@@ -1378,6 +1394,11 @@ func (api *ApiHandler) postInventory(c echo.Context) error {
 	if err := c.Validate(request); err != nil {
 		return NewBadRequestError(err)
 	}
+	userId, err := authenticatedUUID(c, request.UserID)
+	if err != nil {
+		return err
+	}
+	request.UserID = userId
 
 	json_marshal, err := json.Marshal(request)
 	if err != nil {
@@ -1416,8 +1437,13 @@ func (api *ApiHandler) putInventory(c echo.Context) error {
 		// TODO Change to UnprocessableEntityError
 		return NewBadRequestError(err)
 	}
+	userId, err := authenticatedUUID(c, request.UserID)
+	if err != nil {
+		return err
+	}
+	request.UserID = userId
 
-	invUrl := fmt.Sprintf("%s/inventory/ingredient/%s?userId=%s", api.conf.InventoryMSURL, request.ID, request.UserID)
+	invUrl := fmt.Sprintf("%s/inventory/ingredient/%s?userId=%s", api.conf.InventoryMSURL, url.PathEscape(request.ID), url.QueryEscape(request.UserID))
 
 	encodedRequest, err := json.Marshal(request)
 	if err != nil {
@@ -1459,7 +1485,11 @@ func (api *ApiHandler) deleteInventory(c echo.Context) error {
 	if err := c.Validate(delete); err != nil {
 		return NewBadRequestError(err)
 	}
-	invUrl := fmt.Sprintf("%s/inventory/ingredient/%s/%s", api.conf.InventoryMSURL, delete.ID, delete.UserID)
+	userId, err := authenticatedUUID(c, delete.UserID)
+	if err != nil {
+		return err
+	}
+	invUrl := fmt.Sprintf("%s/inventory/ingredient/%s/%s", api.conf.InventoryMSURL, url.PathEscape(delete.ID), url.PathEscape(userId))
 
 	req, err := http.NewRequest(http.MethodDelete, invUrl, nil)
 	if err != nil {
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// throttle allows one action per key during the interval, it's kept in memory so
+// each replica of the gateway throttles on its own
+type throttle struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	last        map[string]time.Time
+	lastCleanup time.Time
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{
+		interval: interval,
+		last:     map[string]time.Time{},
+	}
+}
+
+// Allow records the action for the key, when it's throttled it returns false and the time to wait
+func (t *throttle) Allow(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastCleanup) > t.interval {
+		for k, last := range t.last {
+			if now.Sub(last) > t.interval {
+				delete(t.last, k)
+			}
+		}
+		t.lastCleanup = now
+	}
+
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.interval {
+		return false, t.interval - now.Sub(last)
+	}
+	t.last[key] = now
+	return true, 0
+}
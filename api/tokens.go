@@ -0,0 +1,129 @@
+package api
+
+import (
+	"gateway/configuration"
+	"gateway/db"
+	"gateway/messages"
+	"gateway/utils"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const refreshTokenSize = 32
+
+type tokenPair struct {
+	AccessToken       string
+	AccessExpiration  time.Time
+	RefreshToken      string
+	RefreshExpiration time.Time
+}
+
+// issueTokens signs a new access token for the user session and creates a refresh token in its family.
+// An empty sessionID starts a new session, which happens on every fresh login.
+// The session ID is also the family of its refresh tokens.
+func (api *ApiHandler) issueTokens(c echo.Context, user db.UserDTO, sessionID string) (*tokenPair, error) {
+	ctx := c.Request().Context()
+	if sessionID == "" {
+		sid, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		sessionID = sid.String()
+	}
+
+	now := time.Now()
+	accessExpiration := now.Add(api.conf.AccessTokenTTL)
+	claims := &jwtCustomClaims{
+		Username:  user.GetUsername(),
+		Email:     user.GetEmail(),
+		UserID:    user.GetId(),
+		UUID:      user.GetUUID(),
+		SessionID: sessionID,
+		Role:      Role(user.GetRole()),
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(accessExpiration),
+		},
+	}
+
+	t, err := api.keyring.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	//Insert the new token in the DB
+	_, err = api.dbh.UpsertToken(ctx, &db.TokenRequest{
+		SessionID:      sessionID,
+		Value:          t,
+		ExpirationDate: accessExpiration,
+		UserID:         user.GetId(),
+		UserAgent:      c.Request().UserAgent(),
+		IP:             c.RealIP(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := utils.GenerateToken(refreshTokenSize)
+	if err != nil {
+		return nil, err
+	}
+	refreshExpiration := now.Add(api.conf.RefreshTokenTTL)
+	_, err = api.dbh.CreateRefreshToken(ctx, &db.RefreshTokenRequest{
+		Hash:           utils.HashToken(refreshToken),
+		Family:         sessionID,
+		UserID:         user.GetId(),
+		Username:       user.GetUsername(),
+		ExpirationDate: refreshExpiration,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenPair{
+		AccessToken:       t,
+		AccessExpiration:  accessExpiration,
+		RefreshToken:      refreshToken,
+		RefreshExpiration: refreshExpiration,
+	}, nil
+}
+
+// signInternalToken signs claims that are only verified by the gateway, like the links sent by mail.
+// They use the JWT secret so they can't be mistaken for an access token signed by the keyring.
+func (api *ApiHandler) signInternalToken(claims jwt.Claims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(api.conf.JWTSecret))
+}
+
+// parseInternalToken verifies a token of signInternalToken, the audience tells what the token is for
+func (api *ApiHandler) parseInternalToken(token string, claims jwt.Claims, audience string) error {
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(api.conf.JWTSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(audience))
+	return err
+}
+
+// newTokenCache caches the access tokens checked by extractUser, the revocations are shared with
+// the other replicas through RabbitMQ
+func newTokenCache(dbh db.DBHdandler, conn *amqp.Connection, conf *configuration.Configuration) db.DBHdandler {
+	cache := db.NewTokenCache(dbh, conf.TokenCacheTTL, conf.TokenCacheSize)
+	if conn == nil {
+		return cache
+	}
+	l := logger.WithField("context", "tokenCache")
+	err := messages.ConsumeTokenRevoked(conn, func(revoked *messages.TokenRevoked) {
+		cache.Invalidate(revoked.UserID, revoked.SessionID)
+	})
+	// Without the revocations of the other replicas the cache would accept their revoked tokens
+	if FailOnError(l, err, "Failed to consume the token revocations, the tokens are not cached") {
+		return dbh
+	}
+	cache.OnRevoke = func(userID string, sessionID string) {
+		revoked := &messages.TokenRevoked{UserID: userID, SessionID: sessionID}
+		WarnOnError(l, messages.PublishTokenRevoked(l, conn, revoked), "Failed to publish the token revocation")
+	}
+	return cache
+}
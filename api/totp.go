@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"gateway/db"
+	"gateway/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	mfaChallengeAudience = "mfa-challenge"
+	recoveryCodesCount   = 10
+)
+
+var errInvalidSecondFactor = errors.New("invalid authentication code")
+
+func (api *ApiHandler) signMFAChallenge(user db.UserDTO) (string, time.Time, error) {
+	now := time.Now()
+	expiration := now.Add(api.conf.MFAChallengeTTL)
+	token, err := api.signInternalToken(&jwt.RegisteredClaims{
+		Subject:   user.GetUsername(),
+		Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiration),
+	})
+	return token, expiration, err
+}
+
+// generateRecoveryCode returns a code like 1a2b3-c4d5e, easy to copy by hand
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	return code[:5] + "-" + code[5:], nil
+}
+
+func hashRecoveryCode(code string) string {
+	return utils.HashToken(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// verifySecondFactor accepts either a TOTP code or a recovery code, which is consumed
+func (api *ApiHandler) verifySecondFactor(ctx context.Context, l *logrus.Entry, user db.UserDTO, code string, recoveryCode string) error {
+	if recoveryCode != "" {
+		err := api.dbh.UseRecoveryCode(ctx, user.GetId(), hashRecoveryCode(recoveryCode))
+		if errors.Is(err, db.ErrRecoveryCodeInvalid) {
+			return NewUnauthorizedError(errInvalidSecondFactor)
+		}
+		if err != nil {
+			return NewInternalServerError(err)
+		}
+		l.WithField("username", user.GetUsername()).Info("Recovery code used")
+		return nil
+	}
+
+	secret, err := utils.Decrypt(user.GetTOTPSecret(), user.GetEncryptionKey())
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	step, ok := utils.MatchTOTP(secret, code, time.Now())
+	if !ok {
+		return NewUnauthorizedError(errInvalidSecondFactor)
+	}
+	err = api.dbh.UseTOTPStep(ctx, user.GetId(), step)
+	if errors.Is(err, db.ErrTOTPCodeReused) {
+		return NewUnauthorizedError(errInvalidSecondFactor)
+	}
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	return nil
+}
+
+func (api *ApiHandler) enrollTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "enrollTOTP")
+	claims := getClaims(c)
+
+	user, err := api.dbh.GetUsername(ctx, claims.Username)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	if user.IsTOTPEnabled() {
+		return NewConflictError(errors.New("two-factor authentication already enabled"))
+	}
+	if user.GetEncryptionKey() == "" {
+		return NewInternalServerError(errors.New("the user has no encryption key"))
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	encrypted, err := utils.Encrypt(secret, user.GetEncryptionKey())
+	if err != nil {
+		FailOnError(l, err, "Failed to encrypt the TOTP secret")
+		return NewInternalServerError(err)
+	}
+	// The TOTP is only enabled once a first code is confirmed
+	if err := api.dbh.UpdateTOTP(ctx, user.GetId(), &db.TOTPRequest{Secret: encrypted}); err != nil {
+		return NewInternalServerError(err)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"secret": secret,
+		"uri":    utils.TOTPURI(api.conf.TOTPIssuer, user.GetUsername(), secret),
+	})
+}
+
+func (api *ApiHandler) confirmTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "confirmTOTP")
+	claims := getClaims(c)
+
+	r := new(TOTPCodeRequest)
+	if err := c.Bind(r); err != nil {
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	user, err := api.dbh.GetUsername(ctx, claims.Username)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	if user.IsTOTPEnabled() {
+		return NewConflictError(errors.New("two-factor authentication already enabled"))
+	}
+	if user.GetTOTPSecret() == "" {
+		return NewBadRequestError(errors.New("two-factor authentication enrollment not started"))
+	}
+	if err := api.verifySecondFactor(ctx, l, user, r.Code, ""); err != nil {
+		return err
+	}
+
+	codes := make([]string, recoveryCodesCount)
+	hashes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		if codes[i], err = generateRecoveryCode(); err != nil {
+			return NewInternalServerError(err)
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	err = api.dbh.UpdateTOTP(ctx, user.GetId(), &db.TOTPRequest{
+		Secret:        user.GetTOTPSecret(),
+		Enabled:       true,
+		RecoveryCodes: hashes,
+	})
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+
+	// The recovery codes are only stored hashed, it's the only time they are shown
+	return c.JSON(http.StatusOK, echo.Map{"recoveryCodes": codes})
+}
+
+func (api *ApiHandler) disableTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+	l := logger.WithField("request", "disableTOTP")
+	claims := getClaims(c)
+
+	r := new(SecondFactorRequest)
+	if err := c.Bind(r); err != nil {
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	user, err := api.dbh.GetUsername(ctx, claims.Username)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	if !user.IsTOTPEnabled() {
+		return NewBadRequestError(errors.New("two-factor authentication not enabled"))
+	}
+	if err := api.verifySecondFactor(ctx, l, user, r.Code, r.RecoveryCode); err != nil {
+		return err
+	}
+	if err := api.dbh.UpdateTOTP(ctx, user.GetId(), &db.TOTPRequest{}); err != nil {
+		return NewInternalServerError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// loginTOTP is the second step of the login of the users with the two-factor authentication
+func (api *ApiHandler) loginTOTP(c echo.Context) error {
+	ctx, span := api.tracer.Start(c.Request().Context(), "api.loginTOTP")
+	defer span.End()
+	l := logger.WithField("request", "loginTOTP")
+
+	r := new(MFALoginRequest)
+	if err := c.Bind(r); err != nil {
+		return NewBadRequestError(err)
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	claims := new(jwt.RegisteredClaims)
+	if err := api.parseInternalToken(r.ChallengeToken, claims, mfaChallengeAudience); err != nil {
+		DebugOnError(l, err, "Invalid challenge token")
+		return NewUnauthorizedError(errors.New("invalid or expired challenge token"))
+	}
+
+	// The codes share the failures of the passwords, so they can't be guessed with one challenge
+	if err := api.checkLoginAllowed(c, span, claims.Subject); err != nil {
+		return err
+	}
+
+	user, err := api.dbh.GetUsername(ctx, claims.Subject)
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	if !user.IsTOTPEnabled() {
+		return NewUnauthorizedError(errors.New("invalid or expired challenge token"))
+	}
+	if err := api.verifySecondFactor(ctx, l, user, r.Code, r.RecoveryCode); err != nil {
+		api.loginFailed(c, span, user, claims.Subject)
+		return err
+	}
+	api.loginSucceeded(claims.Subject)
+
+	tokens, err := api.issueTokens(c, user, "")
+	if err != nil {
+		return NewInternalServerError(err)
+	}
+	api.audit(ctx, c, AuthEventLogin, user.GetId(), user.GetUUID(), user.GetUsername())
+	return c.JSON(http.StatusOK, newLoginResponse(user, tokens))
+}
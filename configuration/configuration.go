@@ -1,8 +1,11 @@
 package configuration
 
 import (
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -16,6 +19,7 @@ type Configuration struct {
 	ListenAddress       string
 	ListenRoute         string
 	LogLevel            logrus.Level
+	Environment         string
 	DBName              string
 	DBUser              string
 	DBPassword          string
@@ -31,12 +35,64 @@ type Configuration struct {
 	RabbitURL           string
 	TranslateValidation bool
 	JWTSecret           string
+	JWTKeysDir          string
+	JWTSigningKeyID     string
+	MasterKeys          string
+	MasterKeyID         string
+	AccessTokenTTL      time.Duration
+	RefreshTokenTTL     time.Duration
+	TokenCacheTTL       time.Duration
+	TokenCacheSize      int
+	PasswordResetTTL    time.Duration
+	EmailVerifyRequired bool
+	EmailVerifyTTL      time.Duration
+	EmailResendInterval time.Duration
+	MFAChallengeTTL     time.Duration
+	TOTPIssuer          string
+	AdminUsernames      []string
+	PasswordHasher      string
+	PasswordMinEntropy  int
+	BreachedPasswords   string
+	Argon2Memory        int
+	Argon2Iterations    int
+	Argon2Parallelism   int
+	BcryptCost          int
+	LoginMaxFailures    int
+	LoginMaxIPFailures  int
+	LoginBackoff        time.Duration
+	LoginLockout        time.Duration
+	TrustedProxies      []*net.IPNet
+	UserDeletionGrace   time.Duration
+	UserPurgeInterval   time.Duration
+	TokenPurgeInterval  time.Duration
+	ExportSyncTimeout   time.Duration
+	ExportTTL           time.Duration
+	ExportBuildTimeout  time.Duration
+	OIDCIssuer          string
+	OIDCClientID        string
+	OIDCClientSecret    string
+	OIDCRedirectURL     string
+	OIDCScopes          string
+	AppURL              string
+	PublicURL           string
+	Mailer              string
+	MailFrom            string
+	MailFile            string
+	SMTPHost            string
+	SMTPPort            string
+	SMTPUsername        string
+	SMTPPassword        string
 	OtelServiceName     string
+	StorageBackend      string
 	SurrealDBURL        string
 	SurrealDBUsername   string
 	SurrealDBPassword   string
 	SurrealDBDatabase   string
 	SurrealDBNamespace  string
+	SurrealDBMigrate    bool
+	SurrealDBCheck      time.Duration
+	SurrealDBBackoff    time.Duration
+	SurrealDBMaxBackoff time.Duration
 }
 
 func New() *Configuration {
@@ -64,6 +120,16 @@ func New() *Configuration {
 		conf.LogLevel = logrus.WarnLevel
 	}
 
+	// The development environment allows the settings that are not safe in production
+	conf.Environment = os.Getenv("ENVIRONMENT")
+	if len(conf.Environment) < 1 {
+		conf.Environment = "production"
+	}
+	if conf.Environment != "production" && conf.Environment != "development" {
+		logger.Error("ENVIRONMENT must be production or development")
+		os.Exit(1)
+	}
+
 	conf.ListenPort = os.Getenv("API_PORT")
 	conf.ListenAddress = os.Getenv("API_ADDRESS")
 	conf.ListenRoute = os.Getenv("API_ROUTE")
@@ -97,6 +163,106 @@ func New() *Configuration {
 		os.Exit(1)
 	}
 
+	conf.JWTKeysDir = os.Getenv("JWT_KEYS_DIR")
+	conf.JWTSigningKeyID = os.Getenv("JWT_SIGNING_KEY_ID")
+
+	conf.MasterKeys = os.Getenv("ENCRYPTION_MASTER_KEYS")
+	conf.MasterKeyID = os.Getenv("ENCRYPTION_MASTER_KEY_ID")
+
+	conf.AccessTokenTTL = parseDuration("JWT_ACCESS_TOKEN_TTL", 15*time.Minute)
+	conf.RefreshTokenTTL = parseDuration("JWT_REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	conf.PasswordResetTTL = parseDuration("PASSWORD_RESET_TTL", time.Hour)
+	// A TTL of 0 disables the cache of the access tokens
+	conf.TokenCacheTTL = parseDuration("TOKEN_CACHE_TTL", 30*time.Second)
+	conf.TokenCacheSize = parseInt("TOKEN_CACHE_SIZE", 10000)
+
+	conf.EmailVerifyTTL = parseDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	conf.EmailResendInterval = parseDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+	conf.EmailVerifyRequired = true
+	if requireEmailVerification := os.Getenv("REQUIRE_EMAIL_VERIFICATION"); len(requireEmailVerification) > 0 {
+		conf.EmailVerifyRequired, err = strconv.ParseBool(requireEmailVerification)
+		if err != nil {
+			logger.Error("Failed to parse bool for REQUIRE_EMAIL_VERIFICATION")
+			os.Exit(1)
+		}
+	}
+
+	conf.MFAChallengeTTL = parseDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+	conf.TOTPIssuer = os.Getenv("TOTP_ISSUER")
+	if len(conf.TOTPIssuer) < 1 {
+		conf.TOTPIssuer = "Choucroute"
+	}
+
+	// The passwords hashed with the other hasher are rehashed on login
+	conf.PasswordHasher = os.Getenv("PASSWORD_HASHER")
+	if len(conf.PasswordHasher) < 1 {
+		conf.PasswordHasher = "argon2id"
+	}
+	if conf.PasswordHasher != "argon2id" && conf.PasswordHasher != "bcrypt" {
+		logger.Error("PASSWORD_HASHER must be argon2id or bcrypt")
+		os.Exit(1)
+	}
+	conf.PasswordMinEntropy = parseInt("PASSWORD_MIN_ENTROPY", 50)
+	conf.BreachedPasswords = os.Getenv("BREACHED_PASSWORDS_FILE")
+	conf.Argon2Memory = parseInt("ARGON2_MEMORY_KIB", 19*1024)
+	conf.Argon2Iterations = parseInt("ARGON2_ITERATIONS", 2)
+	conf.Argon2Parallelism = parseInt("ARGON2_PARALLELISM", 1)
+	conf.BcryptCost = parseInt("BCRYPT_COST", 10)
+
+	conf.LoginMaxFailures = parseInt("LOGIN_MAX_FAILURES", 5)
+	// An IP is shared by many users behind a NAT, it gets more attempts than a username
+	conf.LoginMaxIPFailures = parseInt("LOGIN_MAX_IP_FAILURES", 20)
+	conf.LoginBackoff = parseDuration("LOGIN_BACKOFF", time.Second)
+	conf.LoginLockout = parseDuration("LOGIN_LOCKOUT", 15*time.Minute)
+	// The client IP is read from X-Forwarded-For behind these proxies, else it's the address of the connection
+	for _, cidr := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Error("TRUSTED_PROXIES must be a list of CIDR ranges")
+			os.Exit(1)
+		}
+		conf.TrustedProxies = append(conf.TrustedProxies, ipNet)
+	}
+
+	// A deleted user is kept for the grace period before it's purged
+	conf.UserDeletionGrace = parseDuration("USER_DELETION_GRACE", 30*24*time.Hour)
+	// 0 disables the purge, the deleted users are then kept
+	conf.UserPurgeInterval = parseDuration("USER_PURGE_INTERVAL", time.Hour)
+	// The expired tokens are purged by a single replica, 0 disables the purge
+	conf.TokenPurgeInterval = parseDuration("TOKEN_PURGE_INTERVAL", time.Hour)
+
+	// An export that takes longer than the timeout continues as a background job
+	conf.ExportSyncTimeout = parseDuration("EXPORT_SYNC_TIMEOUT", 5*time.Second)
+	conf.ExportTTL = parseDuration("EXPORT_TTL", time.Hour)
+	// The build of an export is cancelled after the timeout, even in the background
+	conf.ExportBuildTimeout = parsePositiveDuration("EXPORT_BUILD_TIMEOUT", 5*time.Minute)
+
+	// The users promoted to admin at startup, the other roles are given by an admin
+	for _, username := range strings.Split(os.Getenv("ADMIN_USERNAMES"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			conf.AdminUsernames = append(conf.AdminUsernames, username)
+		}
+	}
+
+	conf.OIDCIssuer = os.Getenv("OIDC_ISSUER")
+	conf.OIDCClientID = os.Getenv("OIDC_CLIENT_ID")
+	conf.OIDCClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	conf.OIDCRedirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	conf.OIDCScopes = os.Getenv("OIDC_SCOPES")
+
+	conf.AppURL = os.Getenv("APP_URL")
+	conf.PublicURL = os.Getenv("API_PUBLIC_URL")
+	conf.Mailer = os.Getenv("MAILER")
+	conf.MailFrom = os.Getenv("MAIL_FROM")
+	conf.MailFile = os.Getenv("MAIL_FILE")
+	conf.SMTPHost = os.Getenv("SMTP_HOST")
+	conf.SMTPPort = os.Getenv("SMTP_PORT")
+	conf.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	conf.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+
 	conf.OtelServiceName = os.Getenv("OTEL_SERVICE_NAME")
 
 	if len(conf.OtelServiceName) < 1 {
@@ -104,11 +270,70 @@ func New() *Configuration {
 		os.Exit(1)
 	}
 
+	// The memory backend loses the data on restart, it's meant for development and tests
+	conf.StorageBackend = os.Getenv("STORAGE_BACKEND")
+	if len(conf.StorageBackend) < 1 {
+		conf.StorageBackend = "surrealdb"
+	}
+	if conf.StorageBackend != "surrealdb" && conf.StorageBackend != "postgres" && conf.StorageBackend != "memory" {
+		logger.Error("STORAGE_BACKEND must be surrealdb, postgres or memory")
+		os.Exit(1)
+	}
+
 	conf.SurrealDBDatabase = os.Getenv("SURREALDB_DATABASE")
 	conf.SurrealDBNamespace = os.Getenv("SURREALDB_NAMESPACE")
 	conf.SurrealDBPassword = os.Getenv("SURREALDB_PASSWORD")
 	conf.SurrealDBURL = os.Getenv("SURREALDB_URL")
 	conf.SurrealDBUsername = os.Getenv("SURREALDB_USERNAME")
+	// Without the migrations at startup, they are applied with `go run main.go migrate up`
+	conf.SurrealDBMigrate = true
+	if migrate := os.Getenv("SURREALDB_AUTO_MIGRATE"); len(migrate) > 0 {
+		conf.SurrealDBMigrate, err = strconv.ParseBool(migrate)
+		if err != nil {
+			logger.Error("Failed to parse bool for SURREALDB_AUTO_MIGRATE")
+			os.Exit(1)
+		}
+	}
+	// The connection is checked every SURREALDB_CHECK_INTERVAL, a lost one is reopened with an exponential backoff
+	conf.SurrealDBCheck = parseDuration("SURREALDB_CHECK_INTERVAL", 10*time.Second)
+	conf.SurrealDBBackoff = parseDuration("SURREALDB_RECONNECT_BACKOFF", 500*time.Millisecond)
+	conf.SurrealDBMaxBackoff = parseDuration("SURREALDB_RECONNECT_MAX_BACKOFF", 30*time.Second)
 
 	return &conf
 }
+
+// parseDuration reads a duration from the env variable and falls back to the default value when unset
+func parseDuration(env string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(env)
+	if len(value) < 1 {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Error("Failed to parse duration for " + env)
+		os.Exit(1)
+	}
+	return d
+}
+
+func parsePositiveDuration(env string, defaultValue time.Duration) time.Duration {
+	d := parseDuration(env, defaultValue)
+	if d <= 0 {
+		logger.Error("Failed to parse positive duration for " + env)
+		os.Exit(1)
+	}
+	return d
+}
+
+func parseInt(env string, defaultValue int) int {
+	value := os.Getenv(env)
+	if len(value) < 1 {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 1 {
+		logger.Error("Failed to parse positive int for " + env)
+		os.Exit(1)
+	}
+	return i
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type cachedToken struct {
+	TokenDTO
+	lastSeenAt time.Time
+}
+
+// GetLastSeenAt returns the date of the last TouchSession, which doesn't reload the token
+func (ct *cachedToken) GetLastSeenAt() time.Time {
+	return ct.lastSeenAt
+}
+
+type tokenCacheEntry struct {
+	sessionID string
+	token     *cachedToken
+	expiresAt time.Time
+}
+
+// pendingRead is a GetTokenUser reading the database, it's revoked by the invalidations of its session
+type pendingRead struct {
+	userID  string
+	revoked bool
+}
+
+// TokenCache keeps the tokens found by GetTokenUser for a TTL to avoid a query on every authenticated request.
+// The least recently used token is evicted when the cache is full. The sessions revoked through the cache are
+// invalidated at once, OnRevoke tells the other replicas to call Invalidate, and the TTL bounds how long
+// a revocation they missed is ignored. A token read from the database while its session is revoked isn't cached.
+type TokenCache struct {
+	DBHdandler
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+	// pending holds the reads in progress by session, an invalidation keeps them out of the cache
+	pending map[string][]*pendingRead
+	// OnRevoke is called after the sessions of the user are revoked, an empty sessionID means all of them
+	OnRevoke func(userID string, sessionID string)
+}
+
+func NewTokenCache(dbh DBHdandler, ttl time.Duration, size int) *TokenCache {
+	return &TokenCache{
+		DBHdandler: dbh,
+		ttl:        ttl,
+		size:       size,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		now:        time.Now,
+		pending:    map[string][]*pendingRead{},
+	}
+}
+
+func (tc *TokenCache) GetTokenUser(ctx context.Context, value string, userID string, sessionID string) (TokenDTO, error) {
+	tc.mu.Lock()
+	if element, ok := tc.entries[sessionID]; ok {
+		entry := element.Value.(*tokenCacheEntry)
+		now := tc.now()
+		if now.Before(entry.expiresAt) && now.Before(entry.token.GetExpirationDate()) &&
+			entry.token.GetValue() == value && entry.token.GetUserID() == userID {
+			tc.lru.MoveToFront(element)
+			tc.mu.Unlock()
+			return entry.token, nil
+		}
+		tc.remove(element)
+	}
+	read := &pendingRead{userID: userID}
+	tc.pending[sessionID] = append(tc.pending[sessionID], read)
+	tc.mu.Unlock()
+
+	// The tokens that aren't found are not cached, a revoked token always reaches the database
+	token, err := tc.DBHdandler.GetTokenUser(ctx, value, userID, sessionID)
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.donePending(sessionID, read)
+	if err != nil || token == nil {
+		return token, err
+	}
+	cached := &cachedToken{TokenDTO: token, lastSeenAt: token.GetLastSeenAt()}
+	// The token may have been revoked after it was read, the next request checks it again
+	if read.revoked {
+		return cached, nil
+	}
+	if element, ok := tc.entries[sessionID]; ok {
+		tc.remove(element)
+	}
+	tc.entries[sessionID] = tc.lru.PushFront(&tokenCacheEntry{
+		sessionID: sessionID,
+		token:     cached,
+		expiresAt: tc.now().Add(tc.ttl),
+	})
+	for tc.lru.Len() > tc.size {
+		tc.remove(tc.lru.Back())
+	}
+	return cached, nil
+}
+
+func (tc *TokenCache) TouchSession(ctx context.Context, sessionID string, lastSeenAt time.Time) error {
+	if err := tc.DBHdandler.TouchSession(ctx, sessionID, lastSeenAt); err != nil {
+		return err
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if element, ok := tc.entries[sessionID]; ok {
+		element.Value.(*tokenCacheEntry).token.lastSeenAt = lastSeenAt
+	}
+	return nil
+}
+
+// UpsertToken replaces the token of the session, the previous token must not be accepted anymore.
+// A new session has no previous token, the revocation is only for the existing ones.
+func (tc *TokenCache) UpsertToken(ctx context.Context, token *TokenRequest) (TokenDTO, error) {
+	sessions, err := tc.DBHdandler.GetSessions(ctx, token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	replaced := false
+	for _, session := range sessions {
+		replaced = replaced || session.GetSessionID() == token.SessionID
+	}
+	t, err := tc.DBHdandler.UpsertToken(ctx, token)
+	if err != nil {
+		return t, err
+	}
+	if replaced {
+		tc.revoke(token.UserID, token.SessionID)
+	}
+	return t, nil
+}
+
+func (tc *TokenCache) DeleteSession(ctx context.Context, userID string, sessionID string) error {
+	if err := tc.DBHdandler.DeleteSession(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	tc.revoke(userID, sessionID)
+	return nil
+}
+
+func (tc *TokenCache) DeleteToken(ctx context.Context, userID string) error {
+	if err := tc.DBHdandler.DeleteToken(ctx, userID); err != nil {
+		return err
+	}
+	tc.revoke(userID, "")
+	return nil
+}
+
+func (tc *TokenCache) revoke(userID string, sessionID string) {
+	tc.Invalidate(userID, sessionID)
+	if tc.OnRevoke != nil {
+		tc.OnRevoke(userID, sessionID)
+	}
+}
+
+// Invalidate removes the session from the cache, or every session of the user when sessionID is empty
+func (tc *TokenCache) Invalidate(userID string, sessionID string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for id, reads := range tc.pending {
+		for _, read := range reads {
+			if id == sessionID || sessionID == "" && read.userID == userID {
+				read.revoked = true
+			}
+		}
+	}
+	if sessionID != "" {
+		if element, ok := tc.entries[sessionID]; ok {
+			tc.remove(element)
+		}
+		return
+	}
+	for element := tc.lru.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*tokenCacheEntry).token.GetUserID() == userID {
+			tc.remove(element)
+		}
+		element = next
+	}
+}
+
+// donePending forgets a finished read, the lock must be held
+func (tc *TokenCache) donePending(sessionID string, read *pendingRead) {
+	reads := tc.pending[sessionID]
+	for i, r := range reads {
+		if r == read {
+			reads = append(reads[:i], reads[i+1:]...)
+			break
+		}
+	}
+	if len(reads) == 0 {
+		delete(tc.pending, sessionID)
+		return
+	}
+	tc.pending[sessionID] = reads
+}
+
+// remove deletes an entry, the lock must be held
+func (tc *TokenCache) remove(element *list.Element) {
+	tc.lru.Remove(element)
+	delete(tc.entries, element.Value.(*tokenCacheEntry).sessionID)
+}
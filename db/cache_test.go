@@ -0,0 +1,250 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeTokens answers GetTokenUser from a map of sessions and counts the queries
+type fakeTokens struct {
+	DBHdandler
+	sessions map[string]*Token
+	queries  int
+	// afterQuery runs once the token is read, before it's returned
+	afterQuery func()
+}
+
+func (f *fakeTokens) GetTokenUser(ctx context.Context, value string, userID string, sessionID string) (TokenDTO, error) {
+	f.queries++
+	t, ok := f.sessions[sessionID]
+	if !ok || t.Value != value || t.GetUserID() != userID {
+		return nil, errors.New("record not found")
+	}
+	if f.afterQuery != nil {
+		f.afterQuery()
+	}
+	return t, nil
+}
+
+func (f *fakeTokens) TouchSession(ctx context.Context, sessionID string, lastSeenAt time.Time) error {
+	return nil
+}
+
+func (f *fakeTokens) DeleteSession(ctx context.Context, userID string, sessionID string) error {
+	delete(f.sessions, sessionID)
+	return nil
+}
+
+func (f *fakeTokens) DeleteToken(ctx context.Context, userID string) error {
+	for id, t := range f.sessions {
+		if t.GetUserID() == userID {
+			delete(f.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (f *fakeTokens) GetSessions(ctx context.Context, userID string) ([]TokenDTO, error) {
+	sessions := []TokenDTO{}
+	for _, t := range f.sessions {
+		if t.GetUserID() == userID {
+			sessions = append(sessions, t)
+		}
+	}
+	return sessions, nil
+}
+
+func (f *fakeTokens) UpsertToken(ctx context.Context, token *TokenRequest) (TokenDTO, error) {
+	t, ok := f.sessions[token.SessionID]
+	if !ok {
+		userID, _ := parseUserID(token.UserID)
+		t = &Token{SessionID: token.SessionID, UserID: userID, ExpirationDate: time.Now().Add(time.Hour)}
+		f.sessions[token.SessionID] = t
+	}
+	t.Value = token.Value
+	return t, nil
+}
+
+func newFakeTokens() *fakeTokens {
+	f := &fakeTokens{sessions: map[string]*Token{}}
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("s%d", i)
+		f.sessions[id] = &Token{SessionID: id, Value: "token-" + id, UserID: uint(i%2 + 1), ExpirationDate: time.Now().Add(time.Hour)}
+	}
+	return f
+}
+
+func TestTokenCache(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, fake *fakeTokens, cache *TokenCache)
+	}{
+		{
+			name: "Cached until the TTL",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				now := time.Now()
+				cache.now = func() time.Time { return now }
+				for i := 0; i < 3; i++ {
+					if _, err := cache.GetTokenUser(context.Background(), "token-s1", "2", "s1"); err != nil {
+						t.Fatalf("Failed to get token: %v", err)
+					}
+				}
+				if fake.queries != 1 {
+					t.Fatalf("Expected 1 query, got %v", fake.queries)
+				}
+				now = now.Add(time.Minute)
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				if fake.queries != 2 {
+					t.Fatalf("Expected the expired entry to be queried again, got %v queries", fake.queries)
+				}
+			},
+		},
+		{
+			name: "Expired token not served",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				now := time.Now()
+				cache.now = func() time.Time { return now }
+				fake.sessions["s1"].ExpirationDate = now.Add(time.Second)
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				now = now.Add(2 * time.Second)
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				if fake.queries != 2 {
+					t.Fatalf("Expected the expired token to reach the database, got %v queries", fake.queries)
+				}
+			},
+		},
+		{
+			name: "Another value or user is not a hit",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				if _, err := cache.GetTokenUser(context.Background(), "forged", "2", "s1"); err == nil {
+					t.Fatalf("Expected another value to be refused")
+				}
+				if _, err := cache.GetTokenUser(context.Background(), "token-s1", "1", "s1"); err == nil {
+					t.Fatalf("Expected another user to be refused")
+				}
+			},
+		},
+		{
+			name: "Least recently used evicted",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				cache.GetTokenUser(context.Background(), "token-s2", "1", "s2")
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				cache.GetTokenUser(context.Background(), "token-s3", "2", "s3")
+				if _, ok := cache.entries["s2"]; ok || len(cache.entries) != 2 {
+					t.Fatalf("Expected s2 to be evicted, got %v entries", len(cache.entries))
+				}
+			},
+		},
+		{
+			name: "Revocations invalidate and are published",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				var revoked []string
+				cache.OnRevoke = func(userID string, sessionID string) {
+					revoked = append(revoked, userID+"/"+sessionID)
+				}
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				cache.GetTokenUser(context.Background(), "token-s3", "2", "s3")
+				cache.DeleteSession(context.Background(), "2", "s1")
+				if _, err := cache.GetTokenUser(context.Background(), "token-s1", "2", "s1"); err == nil {
+					t.Fatalf("Expected the logged out session to be refused")
+				}
+				cache.DeleteToken(context.Background(), "2")
+				if _, err := cache.GetTokenUser(context.Background(), "token-s3", "2", "s3"); err == nil {
+					t.Fatalf("Expected the revoked sessions to be refused")
+				}
+				if fmt.Sprint(revoked) != "[2/s1 2/]" {
+					t.Fatalf("Unexpected revocations %v", revoked)
+				}
+			},
+		},
+		{
+			name: "Revocation during the read not cached",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				fake.afterQuery = func() {
+					fake.afterQuery = nil
+					cache.DeleteSession(context.Background(), "2", "s1")
+				}
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				if _, err := cache.GetTokenUser(context.Background(), "token-s1", "2", "s1"); err == nil {
+					t.Fatalf("Expected the session revoked during the read to be refused")
+				}
+				if fake.queries != 2 {
+					t.Fatalf("Expected the revoked session to reach the database, got %v queries", fake.queries)
+				}
+			},
+		},
+		{
+			name: "Refreshed token replaces the previous one",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				cache.GetTokenUser(context.Background(), "token-s2", "1", "s2")
+				cache.UpsertToken(context.Background(), &TokenRequest{SessionID: "s2", UserID: "1", Value: "refreshed"})
+				if _, err := cache.GetTokenUser(context.Background(), "token-s2", "1", "s2"); err == nil {
+					t.Fatalf("Expected the previous token to be refused")
+				}
+			},
+		},
+		{
+			name: "New session not revoked",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				var revoked []string
+				cache.OnRevoke = func(userID string, sessionID string) {
+					revoked = append(revoked, userID+"/"+sessionID)
+				}
+				cache.UpsertToken(context.Background(), &TokenRequest{SessionID: "s4", UserID: "1", Value: "token-s4"})
+				cache.UpsertToken(context.Background(), &TokenRequest{SessionID: "s2", UserID: "1", Value: "refreshed"})
+				if fmt.Sprint(revoked) != "[1/s2]" {
+					t.Fatalf("Expected only the refreshed session to be revoked, got %v", revoked)
+				}
+			},
+		},
+		{
+			name: "Revocation of another session during the read cached",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				fake.afterQuery = func() {
+					fake.afterQuery = nil
+					cache.DeleteSession(context.Background(), "2", "s3")
+					cache.Invalidate("1", "")
+				}
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				cache.GetTokenUser(context.Background(), "token-s1", "2", "s1")
+				if fake.queries != 1 || len(cache.pending) != 0 {
+					t.Fatalf("Expected the session to be cached, got %v queries", fake.queries)
+				}
+			},
+		},
+		{
+			name: "Remote invalidation",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				cache.GetTokenUser(context.Background(), "token-s2", "1", "s2")
+				cache.Invalidate("1", "")
+				if len(cache.entries) != 0 {
+					t.Fatalf("Expected the sessions of the user to be invalidated")
+				}
+			},
+		},
+		{
+			name: "Touch updates the cached token",
+			test: func(t *testing.T, fake *fakeTokens, cache *TokenCache) {
+				cache.GetTokenUser(context.Background(), "token-s2", "1", "s2")
+				seen := time.Now().Add(time.Hour)
+				cache.TouchSession(context.Background(), "s2", seen)
+				token, _ := cache.GetTokenUser(context.Background(), "token-s2", "1", "s2")
+				if !token.GetLastSeenAt().Equal(seen) {
+					t.Fatalf("Expected the last seen date to be updated, got %v", token.GetLastSeenAt())
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeTokens()
+			tt.test(t, fake, NewTokenCache(fake, 30*time.Second, 2))
+		})
+	}
+}
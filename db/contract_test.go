@@ -0,0 +1,34 @@
+package db_test
+
+import (
+	"gateway/configuration"
+	"gateway/db"
+	"gateway/db/dbtest"
+	"os"
+	"testing"
+)
+
+func TestMemoryContract(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.DBHdandler {
+		return db.NewMemoryHandler()
+	})
+}
+
+// TestSurrealDBContract needs a running SurrealDB, the other SURREALDB_ variables are read as usual
+func TestSurrealDBContract(t *testing.T) {
+	url := os.Getenv("SURREALDB_TEST_URL")
+	if url == "" {
+		t.Skip("SURREALDB_TEST_URL not set")
+	}
+	conf := configuration.New()
+	conf.SurrealDBURL = url
+	conf.SurrealDBMigrate = true
+	sdh, err := db.NewSurrealDBHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to create SurrealDB handler: %v", err)
+	}
+	defer sdh.Close()
+	dbtest.Run(t, func(t *testing.T) db.DBHdandler {
+		return sdh
+	})
+}
@@ -1,8 +1,11 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gateway/configuration"
+	"gateway/envelope"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -10,6 +13,29 @@ import (
 	"gorm.io/gorm"
 )
 
+// DefaultRole is the role of the users created without one
+const DefaultRole = "user"
+
+var (
+	ErrRefreshTokenReused  = errors.New("refresh token already used")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrEmailMismatch       = errors.New("email doesn't match the user")
+	ErrRecoveryCodeInvalid = errors.New("recovery code invalid")
+	ErrTOTPCodeReused      = errors.New("TOTP code already used")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrUserExists          = errors.New("username or email already taken")
+	ErrIdentityNotFound    = errors.New("identity not found")
+	ErrApiKeyNotFound      = errors.New("API key not found")
+	// ErrPasswordResetTokenInvalid is returned for unknown and already used reset tokens
+	ErrPasswordResetTokenInvalid = errors.New("password reset token invalid")
+)
+
+// errUserChanged is returned by the rotation of a user updated since it was read
+var errUserChanged = errors.New("user changed during the rotation")
+
+// rotateAttempts is the number of times the rotation of a user is tried while the user keeps changing
+const rotateAttempts = 3
+
 type UserDTO interface {
 	GetId() string
 	GetUUID() string
@@ -18,20 +44,152 @@ type UserDTO interface {
 	GetPassword() string
 	GetFirstName() string
 	GetLastName() string
+	// GetEncryptionKey returns the data key of the user, the handlers store it wrapped with the master key
 	GetEncryptionKey() string
+	IsEmailVerified() bool
+	// GetTOTPSecret returns the TOTP secret encrypted with the encryption key of the user
+	GetTOTPSecret() string
+	IsTOTPEnabled() bool
+	GetRole() string
 }
 
+// TokenDTO is the access token of a session, a user has one per device
 type TokenDTO interface {
 	GetId() string
+	GetSessionID() string
 	GetValue() string
 	GetUserID() string
+	GetUserAgent() string
+	GetIP() string
+	GetCreatedAt() time.Time
+	GetLastSeenAt() time.Time
+	GetExpirationDate() time.Time
+}
+
+type RefreshTokenDTO interface {
+	GetId() string
+	GetHash() string
+	GetFamily() string
+	GetUserID() string
+	GetUsername() string
 	GetExpirationDate() time.Time
+	IsUsed() bool
+	IsRevoked() bool
+}
+
+type PasswordResetTokenDTO interface {
+	GetId() string
+	GetUserID() string
+	GetUsername() string
+	GetExpirationDate() time.Time
+}
+
+// IdentityDTO links the subject of an external OpenID Connect provider to a user
+type IdentityDTO interface {
+	GetId() string
+	GetIssuer() string
+	GetSubject() string
+	GetUserID() string
+	GetUsername() string
+}
+
+type IdentityRequest struct {
+	Issuer   string
+	Subject  string
+	UserID   string
+	Username string
+}
+
+// ApiKeyDTO is a long-lived credential of a user for scripts, only the hash of the key is stored
+type ApiKeyDTO interface {
+	GetId() string
+	GetName() string
+	// GetPrefix returns the visible start of the key, it identifies the key
+	GetPrefix() string
+	GetUserID() string
+	GetUsername() string
+	GetScopes() []string
+	GetCreatedAt() time.Time
+	GetLastUsedAt() time.Time
+	// GetExpirationDate returns the zero time if the key never expires
+	GetExpirationDate() time.Time
+}
+
+type ApiKeyRequest struct {
+	Name           string
+	Prefix         string
+	Hash           string
+	UserID         string
+	Username       string
+	Scopes         []string
+	ExpirationDate time.Time
+}
+
+// AuthEventDTO records an authentication event, the events of a user are deleted when it's purged
+type AuthEventDTO interface {
+	GetId() string
+	GetType() string
+	GetUserID() string
+	// GetUserUUID returns the UUID of the user, the user ID of the events can be given to another user after a purge
+	GetUserUUID() string
+	GetUsername() string
+	GetIP() string
+	GetUserAgent() string
+	GetTraceID() string
+	GetCreatedAt() time.Time
+}
+
+type AuthEventRequest struct {
+	Type      string
+	UserID    string
+	UserUUID  string
+	Username  string
+	IP        string
+	UserAgent string
+	TraceID   string
+}
+
+// AuthEventFilter selects the events, the empty fields and the zero dates match every event
+type AuthEventFilter struct {
+	Type     string
+	UserID   string
+	UserUUID string
+	Username string
+	IP       string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
 }
 
 type TokenRequest struct {
+	SessionID      string
 	Value          string
 	ExpirationDate time.Time
 	UserID         string
+	UserAgent      string
+	IP             string
+}
+
+type RefreshTokenRequest struct {
+	Hash           string
+	Family         string
+	UserID         string
+	Username       string
+	ExpirationDate time.Time
+}
+
+type PasswordResetTokenRequest struct {
+	Hash           string
+	UserID         string
+	Username       string
+	ExpirationDate time.Time
+}
+
+// TOTPRequest replaces the TOTP settings of a user, an empty secret disables the TOTP
+type TOTPRequest struct {
+	Secret        string
+	Enabled       bool
+	RecoveryCodes []string
 }
 
 type UserRequest struct {
@@ -41,15 +199,107 @@ type UserRequest struct {
 	FirstName     string
 	LastName      string
 	EncryptionKey string
+	// Role defaults to DefaultRole
+	Role string
+}
+
+// UserUpdateRequest changes the profile of a user, the nil fields are kept
+type UserUpdateRequest struct {
+	Email     *string
+	FirstName *string
+	LastName  *string
 }
 
 type DBHdandler interface {
-	CreateUser(*UserRequest) (UserDTO, error)
-	GetUsername(username string) (UserDTO, error)
-	UpsertToken(*TokenRequest) (TokenDTO, error)
-	GetTokenUser(value string, userID string) (TokenDTO, error)
-	DeleteToken(userID string) error
-	Ping() error
+	// CreateUser returns ErrUserExists if the username or the email is taken, by a deleted user too
+	CreateUser(ctx context.Context, user *UserRequest) (UserDTO, error)
+	// GetUsername returns ErrUserNotFound if no user has this username
+	GetUsername(ctx context.Context, username string) (UserDTO, error)
+	// GetUserByEmail returns ErrUserNotFound if no user has this email
+	GetUserByEmail(ctx context.Context, email string) (UserDTO, error)
+	// UpdateUser returns ErrUserNotFound if the user doesn't exist, a new email is not verified anymore
+	UpdateUser(ctx context.Context, userID string, update *UserUpdateRequest) (UserDTO, error)
+	UpdatePassword(ctx context.Context, userID string, password string) error
+	// DeleteUser soft-deletes the user, it returns ErrUserNotFound if the user doesn't exist or is already deleted
+	DeleteUser(ctx context.Context, userID string) error
+	// RestoreUser cancels the soft-delete, it returns ErrUserNotFound if the user doesn't exist or isn't deleted
+	RestoreUser(ctx context.Context, userID string) error
+	// GetDeletedUsers returns the users soft-deleted before the date
+	GetDeletedUsers(ctx context.Context, before time.Time) ([]UserDTO, error)
+	// PurgeUser hard-deletes a soft-deleted user and everything that belongs to it, its auth events included
+	PurgeUser(ctx context.Context, userID string) error
+	// VerifyEmail marks the email as verified if it's still the email of the user
+	VerifyEmail(ctx context.Context, userID string, email string) error
+	UpdateTOTP(ctx context.Context, userID string, totp *TOTPRequest) error
+	// UpdateRole returns ErrUserNotFound if the user doesn't exist
+	UpdateRole(ctx context.Context, userID string, role string) error
+	// UseRecoveryCode consumes the hashed recovery code, it returns ErrRecoveryCodeInvalid if the user doesn't have it
+	UseRecoveryCode(ctx context.Context, userID string, hash string) error
+	// UseTOTPStep records the time step of an accepted TOTP code, it returns ErrTOTPCodeReused unless it's after the last one
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	CreateIdentity(ctx context.Context, identity *IdentityRequest) (IdentityDTO, error)
+	// GetIdentity returns ErrIdentityNotFound if the subject was never linked to a user
+	GetIdentity(ctx context.Context, issuer string, subject string) (IdentityDTO, error)
+	CreateApiKey(ctx context.Context, key *ApiKeyRequest) (ApiKeyDTO, error)
+	GetApiKeys(ctx context.Context, userID string) ([]ApiKeyDTO, error)
+	// GetApiKey returns ErrApiKeyNotFound if no key has this hash
+	GetApiKey(ctx context.Context, hash string) (ApiKeyDTO, error)
+	TouchApiKey(ctx context.Context, prefix string, lastUsedAt time.Time) error
+	// RevokeApiKey deletes the key, it returns ErrApiKeyNotFound if the user doesn't have it
+	RevokeApiKey(ctx context.Context, userID string, prefix string) error
+	// UpsertToken creates the session or replaces the token of an existing one
+	UpsertToken(ctx context.Context, token *TokenRequest) (TokenDTO, error)
+	// GetTokenUser returns ErrSessionNotFound unless the session of the user has this token and it hasn't expired
+	GetTokenUser(ctx context.Context, value string, userID string, sessionID string) (TokenDTO, error)
+	GetSessions(ctx context.Context, userID string) ([]TokenDTO, error)
+	TouchSession(ctx context.Context, sessionID string, lastSeenAt time.Time) error
+	DeleteSession(ctx context.Context, userID string, sessionID string) error
+	// DeleteToken deletes every session of the user
+	DeleteToken(ctx context.Context, userID string) error
+	// PurgeExpiredTokens deletes the sessions whose token expired before the date, it returns the number deleted
+	PurgeExpiredTokens(ctx context.Context, before time.Time) (int, error)
+	CreateRefreshToken(ctx context.Context, token *RefreshTokenRequest) (RefreshTokenDTO, error)
+	GetRefreshToken(ctx context.Context, hash string) (RefreshTokenDTO, error)
+	// UseRefreshToken marks the token as used, it returns ErrRefreshTokenReused if it was already used
+	UseRefreshToken(ctx context.Context, hash string) error
+	RevokeRefreshTokenFamily(ctx context.Context, family string) error
+	DeleteRefreshTokens(ctx context.Context, userID string) error
+	CreatePasswordResetToken(ctx context.Context, token *PasswordResetTokenRequest) (PasswordResetTokenDTO, error)
+	// GetPasswordResetToken returns the token without consuming it, or ErrPasswordResetTokenInvalid if it's unknown or already used
+	GetPasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error)
+	// UsePasswordResetToken consumes the token, it returns ErrPasswordResetTokenInvalid if it's unknown or already used
+	UsePasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error)
+	CreateAuthEvent(ctx context.Context, event *AuthEventRequest) error
+	// GetAuthEvents returns the events matching the filter, the most recent first
+	GetAuthEvents(ctx context.Context, filter *AuthEventFilter) ([]AuthEventDTO, error)
+	// RotateEncryptionKeys wraps the data keys again with the current master key and encrypts the fields
+	// still in plaintext, it returns the number of users updated
+	RotateEncryptionKeys(ctx context.Context) (int, error)
+	// AcquireLock takes the lock for the owner until the TTL, or extends it if the owner already holds it.
+	// It returns false while another owner holds it.
+	AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error)
+	Ping(ctx context.Context) error
+}
+
+// New returns the handler of the STORAGE_BACKEND, traced
+func New(conf *configuration.Configuration) (DBHdandler, error) {
+	switch conf.StorageBackend {
+	case "postgres":
+		pgh, err := NewPostgresHandler(conf)
+		if err != nil {
+			return nil, err
+		}
+		return NewTracedHandler(pgh, "postgresql"), nil
+	case "memory":
+		logrus.Warn("Using the in-memory storage, the data is lost on restart")
+		return NewTracedHandler(NewMemoryHandler(), "memory"), nil
+	default:
+		sdh, err := NewSurrealDBHandler(conf)
+		if err != nil {
+			return nil, err
+		}
+		return NewTracedHandler(sdh, "surrealdb"), nil
+	}
 }
 
 func NewPostgresHandler(conf *configuration.Configuration) (PostgresHandler, error) {
@@ -77,7 +327,12 @@ func NewPostgresHandler(conf *configuration.Configuration) (PostgresHandler, err
 		logrus.Fatal(err)
 		return PostgresHandler{db: db}, err
 	}
-	return PostgresHandler{db: db}, nil
+	env, err := envelope.New(conf)
+	if err != nil {
+		logrus.Fatal(err)
+		return PostgresHandler{db: db}, err
+	}
+	return PostgresHandler{db: db, envelope: env}, nil
 
 }
 
@@ -86,6 +341,12 @@ func AutoMigrate(db *gorm.DB) error {
 	err := db.AutoMigrate(
 		&User{},
 		&Token{},
+		&RefreshToken{},
+		&PasswordResetToken{},
+		&Identity{},
+		&ApiKey{},
+		&Lock{},
+		&AuthEvent{},
 	)
 	if err != nil {
 		logrus.Fatal(err)
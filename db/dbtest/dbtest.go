@@ -0,0 +1,479 @@
+// Package dbtest checks that a DBHdandler behaves like the others, every backend runs the same scenarios.
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/db"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var sequence atomic.Int64
+
+// unique returns a name that no other scenario uses, the backends with a database are not cleaned between runs
+func unique(prefix string) string {
+	return fmt.Sprintf("%v%d%d", prefix, time.Now().UnixNano(), sequence.Add(1))
+}
+
+func createUser(t *testing.T, ctx context.Context, dbh db.DBHdandler) db.UserDTO {
+	t.Helper()
+	username := unique("contract")
+	user, err := dbh.CreateUser(ctx, &db.UserRequest{
+		Username:  username,
+		Email:     username + "@test.me",
+		Password:  "hash",
+		FirstName: "First",
+		LastName:  "Last",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	return user
+}
+
+func upsertToken(t *testing.T, ctx context.Context, dbh db.DBHdandler, user db.UserDTO, sessionID string, value string) db.TokenDTO {
+	t.Helper()
+	token, err := dbh.UpsertToken(ctx, &db.TokenRequest{
+		SessionID:      sessionID,
+		Value:          value,
+		ExpirationDate: time.Now().Add(time.Hour),
+		UserID:         user.GetId(),
+		UserAgent:      "contract-agent",
+		IP:             "10.0.0.1",
+	})
+	if err != nil {
+		t.Fatalf("Failed to upsert token: %v", err)
+	}
+	return token
+}
+
+// Run runs the scenarios with a handler from newHandler, it's called once per scenario
+func Run(t *testing.T, newHandler func(t *testing.T) db.DBHdandler) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, ctx context.Context, dbh db.DBHdandler)
+	}{
+		{
+			name: "Duplicate users refused",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				for _, request := range []db.UserRequest{
+					{Username: user.GetUsername(), Email: unique("other") + "@test.me", Password: "hash"},
+					{Username: unique("other"), Email: user.GetEmail(), Password: "hash"},
+				} {
+					if _, err := dbh.CreateUser(ctx, &request); !errors.Is(err, db.ErrUserExists) {
+						t.Errorf("Expected ErrUserExists for %v/%v, got %v", request.Username, request.Email, err)
+					}
+				}
+			},
+		},
+		{
+			name: "Users found by username and email",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				if user.GetRole() != db.DefaultRole || user.GetUUID() == "" || user.GetEncryptionKey() == "" {
+					t.Fatalf("Expected the defaults of a new user, got role %q", user.GetRole())
+				}
+				byUsername, err := dbh.GetUsername(ctx, user.GetUsername())
+				if err != nil {
+					t.Fatalf("Failed to get user by username: %v", err)
+				}
+				byEmail, err := dbh.GetUserByEmail(ctx, user.GetEmail())
+				if err != nil {
+					t.Fatalf("Failed to get user by email: %v", err)
+				}
+				for _, found := range []db.UserDTO{byUsername, byEmail} {
+					if found.GetId() != user.GetId() || found.GetUUID() != user.GetUUID() {
+						t.Errorf("Expected the user %v, got %v", user.GetId(), found.GetId())
+					}
+					if found.GetFirstName() != "First" || found.GetLastName() != "Last" {
+						t.Errorf("Expected the names in plaintext, got %q %q", found.GetFirstName(), found.GetLastName())
+					}
+					if found.GetEncryptionKey() != user.GetEncryptionKey() {
+						t.Errorf("Expected the data key of the user")
+					}
+				}
+				if _, err := dbh.GetUsername(ctx, unique("missing")); !errors.Is(err, db.ErrUserNotFound) {
+					t.Errorf("Expected ErrUserNotFound for an unknown username, got %v", err)
+				}
+				if _, err := dbh.GetUserByEmail(ctx, unique("missing")+"@test.me"); !errors.Is(err, db.ErrUserNotFound) {
+					t.Errorf("Expected ErrUserNotFound for an unknown email, got %v", err)
+				}
+			},
+		},
+		{
+			name: "New email not verified",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				if err := dbh.VerifyEmail(ctx, user.GetId(), user.GetEmail()); err != nil {
+					t.Fatalf("Failed to verify email: %v", err)
+				}
+				firstName := "Renamed"
+				updated, err := dbh.UpdateUser(ctx, user.GetId(), &db.UserUpdateRequest{FirstName: &firstName})
+				if err != nil {
+					t.Fatalf("Failed to update user: %v", err)
+				}
+				if !updated.IsEmailVerified() || updated.GetFirstName() != firstName {
+					t.Fatalf("Expected the name to change and the email to stay verified")
+				}
+				email := unique("new") + "@test.me"
+				updated, err = dbh.UpdateUser(ctx, user.GetId(), &db.UserUpdateRequest{Email: &email})
+				if err != nil {
+					t.Fatalf("Failed to update user: %v", err)
+				}
+				if updated.IsEmailVerified() || updated.GetEmail() != email {
+					t.Fatalf("Expected the new email not to be verified")
+				}
+				if err := dbh.VerifyEmail(ctx, user.GetId(), user.GetEmail()); !errors.Is(err, db.ErrEmailMismatch) {
+					t.Fatalf("Expected ErrEmailMismatch for the previous email, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Token upsert replaces the token of the session",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				sessionID := unique("session")
+				upsertToken(t, ctx, dbh, user, sessionID, "first")
+				_, err := dbh.UpsertToken(ctx, &db.TokenRequest{
+					SessionID:      sessionID,
+					Value:          "second",
+					ExpirationDate: time.Now().Add(time.Hour),
+					UserID:         user.GetId(),
+					UserAgent:      "other-agent",
+					IP:             "10.0.0.2",
+				})
+				if err != nil {
+					t.Fatalf("Failed to upsert token: %v", err)
+				}
+				token, err := dbh.GetTokenUser(ctx, "second", user.GetId(), sessionID)
+				if err != nil {
+					t.Fatalf("Failed to get token: %v", err)
+				}
+				if token.GetUserID() != user.GetId() || token.GetSessionID() != sessionID || token.GetValue() != "second" {
+					t.Fatalf("Expected the token of the user %v and the session %v, got %v and %v",
+						user.GetId(), sessionID, token.GetUserID(), token.GetSessionID())
+				}
+				if token.GetUserAgent() != "contract-agent" || token.GetIP() != "10.0.0.1" {
+					t.Errorf("Expected the device of the session to be kept, got %v %v", token.GetUserAgent(), token.GetIP())
+				}
+				sessions, err := dbh.GetSessions(ctx, user.GetId())
+				if err != nil || len(sessions) != 1 {
+					t.Fatalf("Expected a single session, got %v %v", len(sessions), err)
+				}
+			},
+		},
+		{
+			name: "Token mismatch refused",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				other := createUser(t, ctx, dbh)
+				sessionID := unique("session")
+				upsertToken(t, ctx, dbh, user, sessionID, "value")
+				for name, lookup := range map[string][3]string{
+					"another value":   {"forged", user.GetId(), sessionID},
+					"another user":    {"value", other.GetId(), sessionID},
+					"unknown session": {"value", user.GetId(), unique("session")},
+				} {
+					token, err := dbh.GetTokenUser(ctx, lookup[0], lookup[1], lookup[2])
+					if !errors.Is(err, db.ErrSessionNotFound) || token != nil {
+						t.Errorf("Expected ErrSessionNotFound for %v, got %v", name, err)
+					}
+				}
+			},
+		},
+		{
+			name: "Expired tokens refused and purged",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				valid, expired := unique("session"), unique("session")
+				upsertToken(t, ctx, dbh, user, valid, "valid")
+				_, err := dbh.UpsertToken(ctx, &db.TokenRequest{
+					SessionID:      expired,
+					Value:          "expired",
+					ExpirationDate: time.Now().Add(-time.Hour),
+					UserID:         user.GetId(),
+				})
+				if err != nil {
+					t.Fatalf("Failed to upsert token: %v", err)
+				}
+				if _, err := dbh.GetTokenUser(ctx, "expired", user.GetId(), expired); !errors.Is(err, db.ErrSessionNotFound) {
+					t.Fatalf("Expected the expired token to be refused, got %v", err)
+				}
+
+				purged, err := dbh.PurgeExpiredTokens(ctx, time.Now())
+				if err != nil || purged < 1 {
+					t.Fatalf("Expected the expired token to be purged, got %v %v", purged, err)
+				}
+				sessions, err := dbh.GetSessions(ctx, user.GetId())
+				if err != nil || len(sessions) != 1 || sessions[0].GetSessionID() != valid {
+					t.Fatalf("Expected only the valid session to be kept, got %v %v", len(sessions), err)
+				}
+				if _, err := dbh.GetTokenUser(ctx, "valid", user.GetId(), valid); err != nil {
+					t.Fatalf("Failed to get the valid token: %v", err)
+				}
+			},
+		},
+		{
+			name: "Lock held by a single owner",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				name := unique("lock")
+				for _, attempt := range []struct {
+					owner    string
+					ttl      time.Duration
+					acquired bool
+				}{
+					{"first", time.Minute, true},
+					{"second", time.Minute, false},
+					// The owner extends its lock, here into the past so it expires
+					{"first", -time.Minute, true},
+					{"second", time.Minute, true},
+					{"first", time.Minute, false},
+				} {
+					acquired, err := dbh.AcquireLock(ctx, name, attempt.owner, attempt.ttl)
+					if err != nil {
+						t.Fatalf("Failed to acquire lock: %v", err)
+					}
+					if acquired != attempt.acquired {
+						t.Fatalf("Expected %v to acquire the lock: %v, got %v", attempt.owner, attempt.acquired, acquired)
+					}
+				}
+			},
+		},
+		{
+			name: "Sessions deleted",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				other := createUser(t, ctx, dbh)
+				first, second := unique("session"), unique("session")
+				upsertToken(t, ctx, dbh, user, first, "first")
+				upsertToken(t, ctx, dbh, user, second, "second")
+
+				if err := dbh.DeleteSession(ctx, other.GetId(), first); !errors.Is(err, db.ErrSessionNotFound) {
+					t.Fatalf("Expected the session of another user not to be deleted, got %v", err)
+				}
+				if err := dbh.DeleteSession(ctx, user.GetId(), first); err != nil {
+					t.Fatalf("Failed to delete session: %v", err)
+				}
+				if _, err := dbh.GetTokenUser(ctx, "first", user.GetId(), first); !errors.Is(err, db.ErrSessionNotFound) {
+					t.Fatalf("Expected the deleted session to be refused, got %v", err)
+				}
+				if err := dbh.DeleteSession(ctx, user.GetId(), first); !errors.Is(err, db.ErrSessionNotFound) {
+					t.Fatalf("Expected ErrSessionNotFound for a deleted session, got %v", err)
+				}
+				if err := dbh.DeleteToken(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to delete tokens: %v", err)
+				}
+				if _, err := dbh.GetTokenUser(ctx, "second", user.GetId(), second); !errors.Is(err, db.ErrSessionNotFound) {
+					t.Fatalf("Expected every session to be deleted, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Deleted users hidden until purged",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				if err := dbh.PurgeUser(ctx, user.GetId()); !errors.Is(err, db.ErrUserNotFound) {
+					t.Fatalf("Expected an active user not to be purged, got %v", err)
+				}
+				if err := dbh.DeleteUser(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to delete user: %v", err)
+				}
+				if err := dbh.DeleteUser(ctx, user.GetId()); !errors.Is(err, db.ErrUserNotFound) {
+					t.Fatalf("Expected ErrUserNotFound for a deleted user, got %v", err)
+				}
+				if _, err := dbh.GetUsername(ctx, user.GetUsername()); !errors.Is(err, db.ErrUserNotFound) {
+					t.Fatalf("Expected the deleted user to be hidden, got %v", err)
+				}
+				if _, err := dbh.CreateUser(ctx, &db.UserRequest{Username: user.GetUsername(), Email: user.GetEmail()}); !errors.Is(err, db.ErrUserExists) {
+					t.Fatalf("Expected the username to stay taken, got %v", err)
+				}
+
+				deleted, err := dbh.GetDeletedUsers(ctx, time.Now().Add(time.Minute))
+				if err != nil {
+					t.Fatalf("Failed to get deleted users: %v", err)
+				}
+				found := false
+				for _, d := range deleted {
+					found = found || d.GetId() == user.GetId()
+				}
+				if !found {
+					t.Fatalf("Expected the user in the deleted users")
+				}
+				if err := dbh.PurgeUser(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to purge user: %v", err)
+				}
+				if _, err := dbh.CreateUser(ctx, &db.UserRequest{Username: user.GetUsername(), Email: user.GetEmail()}); err != nil {
+					t.Fatalf("Expected the username to be free after the purge, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Deleted user restored",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				if err := dbh.RestoreUser(ctx, user.GetId()); !errors.Is(err, db.ErrUserNotFound) {
+					t.Fatalf("Expected an active user not to be restored, got %v", err)
+				}
+				if err := dbh.DeleteUser(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to delete user: %v", err)
+				}
+				if err := dbh.RestoreUser(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to restore user: %v", err)
+				}
+				if _, err := dbh.GetUsername(ctx, user.GetUsername()); err != nil {
+					t.Fatalf("Expected the restored user to be found, got %v", err)
+				}
+				deleted, err := dbh.GetDeletedUsers(ctx, time.Now().Add(time.Minute))
+				if err != nil {
+					t.Fatalf("Failed to get deleted users: %v", err)
+				}
+				for _, d := range deleted {
+					if d.GetId() == user.GetId() {
+						t.Fatalf("Expected the restored user not to be purged")
+					}
+				}
+			},
+		},
+		{
+			name: "Password reset token used once",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				hash := unique("reset")
+				if _, err := dbh.CreatePasswordResetToken(ctx, &db.PasswordResetTokenRequest{
+					Hash:           hash,
+					UserID:         user.GetId(),
+					Username:       user.GetUsername(),
+					ExpirationDate: time.Now().Add(time.Hour),
+				}); err != nil {
+					t.Fatalf("Failed to create reset token: %v", err)
+				}
+				// Reading the token doesn't consume it
+				for i := 0; i < 2; i++ {
+					token, err := dbh.GetPasswordResetToken(ctx, hash)
+					if err != nil || token.GetUsername() != user.GetUsername() {
+						t.Fatalf("Failed to get reset token: %v", err)
+					}
+				}
+				if _, err := dbh.UsePasswordResetToken(ctx, hash); err != nil {
+					t.Fatalf("Failed to use reset token: %v", err)
+				}
+				if _, err := dbh.GetPasswordResetToken(ctx, hash); !errors.Is(err, db.ErrPasswordResetTokenInvalid) {
+					t.Errorf("Expected the used token to be invalid, got %v", err)
+				}
+				if _, err := dbh.UsePasswordResetToken(ctx, hash); !errors.Is(err, db.ErrPasswordResetTokenInvalid) {
+					t.Errorf("Expected the token to be used once, got %v", err)
+				}
+				if _, err := dbh.GetPasswordResetToken(ctx, unique("missing")); !errors.Is(err, db.ErrPasswordResetTokenInvalid) {
+					t.Errorf("Expected an unknown token to be invalid, got %v", err)
+				}
+			},
+		},
+		{
+			name: "TOTP step accepted once",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				if err := dbh.UseTOTPStep(ctx, user.GetId(), 1000); err != nil {
+					t.Fatalf("Failed to use TOTP step: %v", err)
+				}
+				for _, step := range []int64{1000, 999} {
+					if err := dbh.UseTOTPStep(ctx, user.GetId(), step); !errors.Is(err, db.ErrTOTPCodeReused) {
+						t.Errorf("Expected ErrTOTPCodeReused for step %v, got %v", step, err)
+					}
+				}
+				if err := dbh.UseTOTPStep(ctx, user.GetId(), 1001); err != nil {
+					t.Errorf("Failed to use the next TOTP step: %v", err)
+				}
+			},
+		},
+		{
+			name: "Updates of a missing user refused",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				if err := dbh.DeleteUser(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to delete user: %v", err)
+				}
+				if err := dbh.PurgeUser(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to purge user: %v", err)
+				}
+				if err := dbh.UpdatePassword(ctx, user.GetId(), "hash"); !errors.Is(err, db.ErrUserNotFound) {
+					t.Errorf("Expected ErrUserNotFound for the password, got %v", err)
+				}
+				if err := dbh.UpdateTOTP(ctx, user.GetId(), &db.TOTPRequest{Secret: "secret"}); !errors.Is(err, db.ErrUserNotFound) {
+					t.Errorf("Expected ErrUserNotFound for the TOTP, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Auth events filtered, most recent first",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				username := unique("events")
+				for _, eventType := range []string{"login_failed", "login", "logout"} {
+					if err := dbh.CreateAuthEvent(ctx, &db.AuthEventRequest{Type: eventType, Username: username, IP: "10.0.0.1"}); err != nil {
+						t.Fatalf("Failed to create auth event: %v", err)
+					}
+					// The Surreal dates are compared as strings
+					time.Sleep(2 * time.Millisecond)
+				}
+				events, err := dbh.GetAuthEvents(ctx, &db.AuthEventFilter{Username: username, Limit: 2})
+				if err != nil {
+					t.Fatalf("Failed to get auth events: %v", err)
+				}
+				if len(events) != 2 || events[0].GetType() != "logout" || events[1].GetType() != "login" {
+					t.Fatalf("Expected the 2 most recent events, got %v", len(events))
+				}
+				events, err = dbh.GetAuthEvents(ctx, &db.AuthEventFilter{Username: username, Type: "login_failed"})
+				if err != nil || len(events) != 1 || events[0].GetIP() != "10.0.0.1" {
+					t.Fatalf("Expected the failed login, got %v %v", len(events), err)
+				}
+				events, err = dbh.GetAuthEvents(ctx, &db.AuthEventFilter{Username: username, Since: time.Now().Add(time.Minute)})
+				if err != nil || len(events) != 0 {
+					t.Fatalf("Expected no event in the future, got %v %v", len(events), err)
+				}
+			},
+		},
+		{
+			name: "Auth events purged with the user",
+			test: func(t *testing.T, ctx context.Context, dbh db.DBHdandler) {
+				user := createUser(t, ctx, dbh)
+				event := &db.AuthEventRequest{Type: "login", UserID: user.GetId(), UserUUID: user.GetUUID(), Username: user.GetUsername()}
+				if err := dbh.CreateAuthEvent(ctx, event); err != nil {
+					t.Fatalf("Failed to create auth event: %v", err)
+				}
+				// The events of an unknown username aren't linked to the user
+				unknown := &db.AuthEventRequest{Type: "login_failed", Username: user.GetUsername()}
+				if err := dbh.CreateAuthEvent(ctx, unknown); err != nil {
+					t.Fatalf("Failed to create auth event: %v", err)
+				}
+				events, err := dbh.GetAuthEvents(ctx, &db.AuthEventFilter{UserUUID: user.GetUUID()})
+				if err != nil || len(events) != 1 || events[0].GetUserUUID() != user.GetUUID() {
+					t.Fatalf("Expected the event of the user, got %v %v", len(events), err)
+				}
+
+				if err := dbh.DeleteUser(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to delete user: %v", err)
+				}
+				if err := dbh.PurgeUser(ctx, user.GetId()); err != nil {
+					t.Fatalf("Failed to purge user: %v", err)
+				}
+				events, err = dbh.GetAuthEvents(ctx, &db.AuthEventFilter{UserUUID: user.GetUUID()})
+				if err != nil || len(events) != 0 {
+					t.Fatalf("Expected the events of the user to be purged, got %v %v", len(events), err)
+				}
+				events, err = dbh.GetAuthEvents(ctx, &db.AuthEventFilter{Username: user.GetUsername()})
+				if err != nil || len(events) != 1 {
+					t.Fatalf("Expected the event of the unknown username to be kept, got %v %v", len(events), err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, context.Background(), newHandler(t))
+		})
+	}
+}
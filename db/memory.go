@@ -0,0 +1,736 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"gateway/utils"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+)
+
+// MemoryHandler keeps the data in memory with the semantics of the database handlers, for development and tests.
+// The data is lost on restart and isn't shared between replicas. The data keys are kept unwrapped as nothing is persisted.
+type MemoryHandler struct {
+	mu             sync.RWMutex
+	nextID         uint
+	users          map[uint]*User
+	tokens         map[string]*Token
+	refreshTokens  map[string]*RefreshToken
+	passwordResets map[string]*PasswordResetToken
+	identities     map[[2]string]*Identity
+	apiKeys        map[string]*ApiKey
+	authEvents     []*AuthEvent
+	locks          map[string]*Lock
+	now            func() time.Time
+}
+
+func NewMemoryHandler() *MemoryHandler {
+	return &MemoryHandler{
+		users:          map[uint]*User{},
+		tokens:         map[string]*Token{},
+		refreshTokens:  map[string]*RefreshToken{},
+		passwordResets: map[string]*PasswordResetToken{},
+		identities:     map[[2]string]*Identity{},
+		apiKeys:        map[string]*ApiKey{},
+		locks:          map[string]*Lock{},
+		now:            time.Now,
+	}
+}
+
+// id returns the next ID, shared by every kind of record, the lock must be held
+func (mh *MemoryHandler) id() uint {
+	mh.nextID++
+	return mh.nextID
+}
+
+// parseUserID converts the ID of a user like PostgresHandler
+func parseUserID(userID string) (uint, error) {
+	id, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user ID %q: %w", userID, err)
+	}
+	return uint(id), nil
+}
+
+// The records are copied in and out so the callers never share them with the handler
+
+func copyUser(u *User) *User {
+	c := *u
+	c.RecoveryCodes = append([]string(nil), u.RecoveryCodes...)
+	return &c
+}
+
+func copyToken(t *Token) *Token {
+	c := *t
+	return &c
+}
+
+func copyApiKey(ak *ApiKey) *ApiKey {
+	c := *ak
+	c.Scopes = append([]string(nil), ak.Scopes...)
+	return &c
+}
+
+// user returns the user if it exists and isn't deleted, the lock must be held
+func (mh *MemoryHandler) user(userID string) (*User, error) {
+	id, err := parseUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := mh.users[id]
+	if !ok || user.DeletedAt.Valid {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (mh *MemoryHandler) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (mh *MemoryHandler) CreateUser(ctx context.Context, userRequest *UserRequest) (UserDTO, error) {
+	uuid, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	dataKey := userRequest.EncryptionKey
+	if dataKey == "" {
+		if dataKey, err = utils.GenerateSecretKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	// Like the unique indexes, the deleted users keep their username and email until they are purged
+	for _, u := range mh.users {
+		if u.Username == userRequest.Username || u.Email == userRequest.Email {
+			return nil, ErrUserExists
+		}
+	}
+	user := &User{
+		ID:            mh.id(),
+		UUID:          uuid.String(),
+		Username:      userRequest.Username,
+		Email:         userRequest.Email,
+		Password:      userRequest.Password,
+		FirstName:     userRequest.FirstName,
+		LastName:      userRequest.LastName,
+		EncryptionKey: EncryptionKey{SecretKey: dataKey},
+		Role:          userRequest.Role,
+	}
+	if user.Role == "" {
+		user.Role = DefaultRole
+	}
+	mh.users[user.ID] = user
+	return copyUser(user), nil
+}
+
+func (mh *MemoryHandler) GetUsername(ctx context.Context, username string) (UserDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	for _, u := range mh.users {
+		if u.Username == username && !u.DeletedAt.Valid {
+			return copyUser(u), nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (mh *MemoryHandler) GetUserByEmail(ctx context.Context, email string) (UserDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	for _, u := range mh.users {
+		if u.Email == email && !u.DeletedAt.Valid {
+			return copyUser(u), nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (mh *MemoryHandler) UpdateUser(ctx context.Context, userID string, update *UserUpdateRequest) (UserDTO, error) {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, err := mh.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	if update.Email != nil {
+		for _, u := range mh.users {
+			if u != user && u.Email == *update.Email {
+				return nil, ErrUserExists
+			}
+		}
+		if user.Email != *update.Email {
+			user.EmailVerified = false
+		}
+		user.Email = *update.Email
+	}
+	if update.FirstName != nil {
+		user.FirstName = *update.FirstName
+	}
+	if update.LastName != nil {
+		user.LastName = *update.LastName
+	}
+	return copyUser(user), nil
+}
+
+func (mh *MemoryHandler) UpdatePassword(ctx context.Context, userID string, password string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, err := mh.user(userID)
+	if err != nil {
+		return err
+	}
+	user.Password = password
+	return nil
+}
+
+func (mh *MemoryHandler) DeleteUser(ctx context.Context, userID string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, err := mh.user(userID)
+	if err != nil {
+		return err
+	}
+	user.DeletedAt = gorm.DeletedAt{Time: mh.now(), Valid: true}
+	return nil
+}
+
+func (mh *MemoryHandler) RestoreUser(ctx context.Context, userID string) error {
+	id, err := parseUserID(userID)
+	if err != nil {
+		return err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, ok := mh.users[id]
+	if !ok || !user.DeletedAt.Valid {
+		return ErrUserNotFound
+	}
+	user.DeletedAt = gorm.DeletedAt{}
+	return nil
+}
+
+func (mh *MemoryHandler) GetDeletedUsers(ctx context.Context, before time.Time) ([]UserDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	deleted := []UserDTO{}
+	for _, u := range mh.users {
+		if u.DeletedAt.Valid && u.DeletedAt.Time.Before(before) {
+			deleted = append(deleted, copyUser(u))
+		}
+	}
+	return deleted, nil
+}
+
+func (mh *MemoryHandler) PurgeUser(ctx context.Context, userID string) error {
+	id, err := parseUserID(userID)
+	if err != nil {
+		return err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	// Only a soft-deleted user can be purged
+	user, ok := mh.users[id]
+	if !ok || !user.DeletedAt.Valid {
+		return ErrUserNotFound
+	}
+	for sessionID, t := range mh.tokens {
+		if t.UserID == id {
+			delete(mh.tokens, sessionID)
+		}
+	}
+	for hash, rt := range mh.refreshTokens {
+		if rt.UserID == id {
+			delete(mh.refreshTokens, hash)
+		}
+	}
+	for hash, prt := range mh.passwordResets {
+		if prt.UserID == id {
+			delete(mh.passwordResets, hash)
+		}
+	}
+	for key, i := range mh.identities {
+		if i.UserID == id {
+			delete(mh.identities, key)
+		}
+	}
+	for prefix, ak := range mh.apiKeys {
+		if ak.UserID == id {
+			delete(mh.apiKeys, prefix)
+		}
+	}
+	events := mh.authEvents[:0]
+	for _, event := range mh.authEvents {
+		if event.UserUUID != user.UUID {
+			events = append(events, event)
+		}
+	}
+	mh.authEvents = events
+	delete(mh.users, id)
+	return nil
+}
+
+func (mh *MemoryHandler) VerifyEmail(ctx context.Context, userID string, email string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, err := mh.user(userID)
+	if err != nil || user.Email != email {
+		return ErrEmailMismatch
+	}
+	user.EmailVerified = true
+	return nil
+}
+
+func (mh *MemoryHandler) UpdateTOTP(ctx context.Context, userID string, totp *TOTPRequest) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, err := mh.user(userID)
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = totp.Secret
+	user.TOTPEnabled = totp.Enabled
+	user.RecoveryCodes = append([]string(nil), totp.RecoveryCodes...)
+	return nil
+}
+
+func (mh *MemoryHandler) UpdateRole(ctx context.Context, userID string, role string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, err := mh.user(userID)
+	if err != nil {
+		return err
+	}
+	user.Role = role
+	return nil
+}
+
+func (mh *MemoryHandler) UseRecoveryCode(ctx context.Context, userID string, hash string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, err := mh.user(userID)
+	if err != nil {
+		return err
+	}
+	for i, code := range user.RecoveryCodes {
+		if code == hash {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRecoveryCodeInvalid
+}
+
+func (mh *MemoryHandler) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	user, err := mh.user(userID)
+	if err != nil {
+		return err
+	}
+	if step <= user.TOTPLastStep {
+		return ErrTOTPCodeReused
+	}
+	user.TOTPLastStep = step
+	return nil
+}
+
+// RotateEncryptionKeys has nothing to do, the data keys are not wrapped
+func (mh *MemoryHandler) RotateEncryptionKeys(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (mh *MemoryHandler) CreateIdentity(ctx context.Context, identity *IdentityRequest) (IdentityDTO, error) {
+	userID, err := parseUserID(identity.UserID)
+	if err != nil {
+		return nil, err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	key := [2]string{identity.Issuer, identity.Subject}
+	if _, ok := mh.identities[key]; ok {
+		return nil, gorm.ErrDuplicatedKey
+	}
+	i := &Identity{
+		ID:       mh.id(),
+		Issuer:   identity.Issuer,
+		Subject:  identity.Subject,
+		UserID:   userID,
+		Username: identity.Username,
+	}
+	mh.identities[key] = i
+	c := *i
+	return &c, nil
+}
+
+func (mh *MemoryHandler) GetIdentity(ctx context.Context, issuer string, subject string) (IdentityDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	i, ok := mh.identities[[2]string{issuer, subject}]
+	if !ok {
+		return nil, ErrIdentityNotFound
+	}
+	c := *i
+	return &c, nil
+}
+
+func (mh *MemoryHandler) CreateApiKey(ctx context.Context, key *ApiKeyRequest) (ApiKeyDTO, error) {
+	userID, err := parseUserID(key.UserID)
+	if err != nil {
+		return nil, err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	for _, ak := range mh.apiKeys {
+		if ak.Prefix == key.Prefix || ak.Hash == key.Hash {
+			return nil, gorm.ErrDuplicatedKey
+		}
+	}
+	apiKey := &ApiKey{
+		ID:             mh.id(),
+		Name:           key.Name,
+		Prefix:         key.Prefix,
+		Hash:           key.Hash,
+		UserID:         userID,
+		Username:       key.Username,
+		Scopes:         append([]string(nil), key.Scopes...),
+		CreatedAt:      mh.now(),
+		ExpirationDate: key.ExpirationDate,
+	}
+	mh.apiKeys[key.Prefix] = apiKey
+	return copyApiKey(apiKey), nil
+}
+
+func (mh *MemoryHandler) GetApiKeys(ctx context.Context, userID string) ([]ApiKeyDTO, error) {
+	id, err := parseUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	mh.mu.RLock()
+	var keys []*ApiKey
+	for _, ak := range mh.apiKeys {
+		if ak.UserID == id {
+			keys = append(keys, copyApiKey(ak))
+		}
+	}
+	mh.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	apiKeys := make([]ApiKeyDTO, len(keys))
+	for i := range keys {
+		apiKeys[i] = keys[i]
+	}
+	return apiKeys, nil
+}
+
+func (mh *MemoryHandler) GetApiKey(ctx context.Context, hash string) (ApiKeyDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	for _, ak := range mh.apiKeys {
+		if ak.Hash == hash {
+			return copyApiKey(ak), nil
+		}
+	}
+	return nil, ErrApiKeyNotFound
+}
+
+func (mh *MemoryHandler) TouchApiKey(ctx context.Context, prefix string, lastUsedAt time.Time) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	if ak, ok := mh.apiKeys[prefix]; ok {
+		ak.LastUsedAt = lastUsedAt
+	}
+	return nil
+}
+
+func (mh *MemoryHandler) RevokeApiKey(ctx context.Context, userID string, prefix string) error {
+	id, err := parseUserID(userID)
+	if err != nil {
+		return err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	ak, ok := mh.apiKeys[prefix]
+	if !ok || ak.UserID != id {
+		return ErrApiKeyNotFound
+	}
+	delete(mh.apiKeys, prefix)
+	return nil
+}
+
+func (mh *MemoryHandler) UpsertToken(ctx context.Context, token *TokenRequest) (TokenDTO, error) {
+	userID, err := parseUserID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	now := mh.now()
+	// Keep the device information of the session when only the token is rotated
+	t, ok := mh.tokens[token.SessionID]
+	if !ok {
+		t = &Token{
+			ID:        mh.id(),
+			SessionID: token.SessionID,
+			UserID:    userID,
+			UserAgent: token.UserAgent,
+			IP:        token.IP,
+			CreatedAt: now,
+		}
+		mh.tokens[token.SessionID] = t
+	}
+	t.Value = token.Value
+	t.ExpirationDate = token.ExpirationDate
+	t.LastSeenAt = now
+	return copyToken(t), nil
+}
+
+func (mh *MemoryHandler) GetTokenUser(ctx context.Context, value string, userID string, sessionID string) (TokenDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	t, ok := mh.tokens[sessionID]
+	if !ok || t.Value != value || t.GetUserID() != userID || !t.ExpirationDate.After(mh.now()) {
+		return nil, ErrSessionNotFound
+	}
+	return copyToken(t), nil
+}
+
+func (mh *MemoryHandler) GetSessions(ctx context.Context, userID string) ([]TokenDTO, error) {
+	id, err := parseUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	mh.mu.RLock()
+	var tokens []*Token
+	for _, t := range mh.tokens {
+		if t.UserID == id {
+			tokens = append(tokens, copyToken(t))
+		}
+	}
+	mh.mu.RUnlock()
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].LastSeenAt.After(tokens[j].LastSeenAt) })
+	sessions := make([]TokenDTO, len(tokens))
+	for i := range tokens {
+		sessions[i] = tokens[i]
+	}
+	return sessions, nil
+}
+
+func (mh *MemoryHandler) TouchSession(ctx context.Context, sessionID string, lastSeenAt time.Time) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	if t, ok := mh.tokens[sessionID]; ok {
+		t.LastSeenAt = lastSeenAt
+	}
+	return nil
+}
+
+func (mh *MemoryHandler) DeleteSession(ctx context.Context, userID string, sessionID string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	t, ok := mh.tokens[sessionID]
+	if !ok || t.GetUserID() != userID {
+		return ErrSessionNotFound
+	}
+	delete(mh.tokens, sessionID)
+	return nil
+}
+
+func (mh *MemoryHandler) DeleteToken(ctx context.Context, userID string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	for sessionID, t := range mh.tokens {
+		if t.GetUserID() == userID {
+			delete(mh.tokens, sessionID)
+		}
+	}
+	return nil
+}
+
+func (mh *MemoryHandler) PurgeExpiredTokens(ctx context.Context, before time.Time) (int, error) {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	purged := 0
+	for sessionID, t := range mh.tokens {
+		if t.ExpirationDate.Before(before) {
+			delete(mh.tokens, sessionID)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (mh *MemoryHandler) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	now := mh.now()
+	if lock, ok := mh.locks[name]; ok && lock.Owner != owner && now.Before(lock.ExpiresAt) {
+		return false, nil
+	}
+	mh.locks[name] = &Lock{Name: name, Owner: owner, ExpiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (mh *MemoryHandler) CreateRefreshToken(ctx context.Context, token *RefreshTokenRequest) (RefreshTokenDTO, error) {
+	userID, err := parseUserID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	if _, ok := mh.refreshTokens[token.Hash]; ok {
+		return nil, gorm.ErrDuplicatedKey
+	}
+	refreshToken := &RefreshToken{
+		ID:             mh.id(),
+		Hash:           token.Hash,
+		Family:         token.Family,
+		UserID:         userID,
+		Username:       token.Username,
+		ExpirationDate: token.ExpirationDate,
+	}
+	mh.refreshTokens[token.Hash] = refreshToken
+	c := *refreshToken
+	return &c, nil
+}
+
+func (mh *MemoryHandler) GetRefreshToken(ctx context.Context, hash string) (RefreshTokenDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	refreshToken, ok := mh.refreshTokens[hash]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	c := *refreshToken
+	return &c, nil
+}
+
+func (mh *MemoryHandler) UseRefreshToken(ctx context.Context, hash string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	refreshToken, ok := mh.refreshTokens[hash]
+	if !ok || refreshToken.Used {
+		return ErrRefreshTokenReused
+	}
+	refreshToken.Used = true
+	return nil
+}
+
+func (mh *MemoryHandler) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	for _, refreshToken := range mh.refreshTokens {
+		if refreshToken.Family == family {
+			refreshToken.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (mh *MemoryHandler) DeleteRefreshTokens(ctx context.Context, userID string) error {
+	id, err := parseUserID(userID)
+	if err != nil {
+		return err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	for hash, refreshToken := range mh.refreshTokens {
+		if refreshToken.UserID == id {
+			delete(mh.refreshTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (mh *MemoryHandler) CreatePasswordResetToken(ctx context.Context, token *PasswordResetTokenRequest) (PasswordResetTokenDTO, error) {
+	userID, err := parseUserID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	if _, ok := mh.passwordResets[token.Hash]; ok {
+		return nil, gorm.ErrDuplicatedKey
+	}
+	resetToken := &PasswordResetToken{
+		ID:             mh.id(),
+		Hash:           token.Hash,
+		UserID:         userID,
+		Username:       token.Username,
+		ExpirationDate: token.ExpirationDate,
+	}
+	mh.passwordResets[token.Hash] = resetToken
+	c := *resetToken
+	return &c, nil
+}
+
+func (mh *MemoryHandler) GetPasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	resetToken, ok := mh.passwordResets[hash]
+	if !ok || resetToken.Used {
+		return nil, ErrPasswordResetTokenInvalid
+	}
+	c := *resetToken
+	return &c, nil
+}
+
+func (mh *MemoryHandler) UsePasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error) {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	resetToken, ok := mh.passwordResets[hash]
+	if !ok || resetToken.Used {
+		return nil, ErrPasswordResetTokenInvalid
+	}
+	resetToken.Used = true
+	c := *resetToken
+	return &c, nil
+}
+
+func (mh *MemoryHandler) CreateAuthEvent(ctx context.Context, event *AuthEventRequest) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	mh.authEvents = append(mh.authEvents, &AuthEvent{
+		ID:        mh.id(),
+		Type:      event.Type,
+		UserID:    event.UserID,
+		UserUUID:  event.UserUUID,
+		Username:  event.Username,
+		IP:        event.IP,
+		UserAgent: event.UserAgent,
+		TraceID:   event.TraceID,
+		CreatedAt: mh.now(),
+	})
+	return nil
+}
+
+func (mh *MemoryHandler) GetAuthEvents(ctx context.Context, filter *AuthEventFilter) ([]AuthEventDTO, error) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	events := []AuthEventDTO{}
+	// The events are appended in order, the most recent is the last one
+	for i := len(mh.authEvents) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(events) == filter.Limit {
+			break
+		}
+		event := mh.authEvents[i]
+		if (filter.Type != "" && event.Type != filter.Type) ||
+			(filter.UserID != "" && event.UserID != filter.UserID) ||
+			(filter.UserUUID != "" && event.UserUUID != filter.UserUUID) ||
+			(filter.Username != "" && event.Username != filter.Username) ||
+			(filter.IP != "" && event.IP != filter.IP) ||
+			(!filter.Since.IsZero() && event.CreatedAt.Before(filter.Since)) ||
+			(!filter.Until.IsZero() && !event.CreatedAt.Before(filter.Until)) {
+			continue
+		}
+		c := *event
+		events = append(events, &c)
+	}
+	return events, nil
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, mh *MemoryHandler)
+	}{
+		{
+			name: "Duplicate username or email refused",
+			test: func(t *testing.T, mh *MemoryHandler) {
+				user, err := mh.CreateUser(context.Background(), &UserRequest{Username: "alice", Email: "alice@test.me"})
+				if err != nil {
+					t.Fatalf("Failed to create user: %v", err)
+				}
+				if user.GetRole() != DefaultRole || user.GetEncryptionKey() == "" || user.GetUUID() == "" {
+					t.Fatalf("Expected the defaults of a new user, got %+v", user)
+				}
+				for _, request := range []UserRequest{
+					{Username: "alice", Email: "other@test.me"},
+					{Username: "other", Email: "alice@test.me"},
+				} {
+					if _, err := mh.CreateUser(context.Background(), &request); !errors.Is(err, ErrUserExists) {
+						t.Fatalf("Expected a duplicate for %+v, got %v", request, err)
+					}
+				}
+				// The username stays taken until the user is purged
+				mh.DeleteUser(context.Background(), user.GetId())
+				if _, err := mh.CreateUser(context.Background(), &UserRequest{Username: "alice", Email: "new@test.me"}); !errors.Is(err, ErrUserExists) {
+					t.Fatalf("Expected the deleted username to be taken, got %v", err)
+				}
+				if _, err := mh.GetUsername(context.Background(), "alice"); !errors.Is(err, ErrUserNotFound) {
+					t.Fatalf("Expected the deleted user to be hidden, got %v", err)
+				}
+				if err := mh.PurgeUser(context.Background(), user.GetId()); err != nil {
+					t.Fatalf("Failed to purge user: %v", err)
+				}
+				if _, err := mh.CreateUser(context.Background(), &UserRequest{Username: "alice", Email: "alice@test.me"}); err != nil {
+					t.Fatalf("Expected the username to be free after the purge, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Token upsert keeps the device of the session",
+			test: func(t *testing.T, mh *MemoryHandler) {
+				now := time.Now()
+				mh.now = func() time.Time { return now }
+				exp := now.Add(time.Hour)
+				mh.UpsertToken(context.Background(), &TokenRequest{SessionID: "s1", Value: "first", UserID: "1", UserAgent: "laptop", IP: "10.0.0.1", ExpirationDate: exp})
+				now = now.Add(time.Minute)
+				token, err := mh.UpsertToken(context.Background(), &TokenRequest{SessionID: "s1", Value: "second", UserID: "1", UserAgent: "phone", IP: "10.0.0.2", ExpirationDate: exp})
+				if err != nil {
+					t.Fatalf("Failed to upsert token: %v", err)
+				}
+				if token.GetValue() != "second" || token.GetUserAgent() != "laptop" || token.GetCreatedAt().Equal(now) {
+					t.Fatalf("Expected only the token to change, got %+v", token)
+				}
+				if _, err := mh.GetTokenUser(context.Background(), "first", "1", "s1"); !errors.Is(err, ErrSessionNotFound) {
+					t.Fatalf("Expected the previous token to be refused, got %v", err)
+				}
+				if _, err := mh.GetTokenUser(context.Background(), "second", "2", "s1"); !errors.Is(err, ErrSessionNotFound) {
+					t.Fatalf("Expected another user to be refused, got %v", err)
+				}
+				if _, err := mh.GetTokenUser(context.Background(), "second", "1", "s1"); err != nil {
+					t.Fatalf("Failed to get token: %v", err)
+				}
+				if err := mh.DeleteSession(context.Background(), "2", "s1"); !errors.Is(err, ErrSessionNotFound) {
+					t.Fatalf("Expected the session of another user not to be deleted, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Returned records are copies",
+			test: func(t *testing.T, mh *MemoryHandler) {
+				user, _ := mh.CreateUser(context.Background(), &UserRequest{Username: "bob", Email: "bob@test.me"})
+				mh.UpdateTOTP(context.Background(), user.GetId(), &TOTPRequest{Secret: "secret", Enabled: true, RecoveryCodes: []string{"a", "b"}})
+				before, _ := mh.GetUsername(context.Background(), "bob")
+				if err := mh.UseRecoveryCode(context.Background(), user.GetId(), "a"); err != nil {
+					t.Fatalf("Failed to use recovery code: %v", err)
+				}
+				if codes := before.(*User).RecoveryCodes; fmt.Sprint(codes) != "[a b]" {
+					t.Fatalf("Expected the previous read to be unchanged, got %v", codes)
+				}
+				if err := mh.UseRecoveryCode(context.Background(), user.GetId(), "a"); !errors.Is(err, ErrRecoveryCodeInvalid) {
+					t.Fatalf("Expected the code to be used once, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Refresh token used once",
+			test: func(t *testing.T, mh *MemoryHandler) {
+				mh.CreateRefreshToken(context.Background(), &RefreshTokenRequest{Hash: "h1", Family: "f1", UserID: "1"})
+				var wg sync.WaitGroup
+				used := make(chan error, 10)
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						used <- mh.UseRefreshToken(context.Background(), "h1")
+					}()
+				}
+				wg.Wait()
+				close(used)
+				succeeded := 0
+				for err := range used {
+					if err == nil {
+						succeeded++
+					} else if !errors.Is(err, ErrRefreshTokenReused) {
+						t.Fatalf("Unexpected error %v", err)
+					}
+				}
+				if succeeded != 1 {
+					t.Fatalf("Expected the token to be used once, got %v", succeeded)
+				}
+			},
+		},
+		{
+			name: "Concurrent signups of the same username",
+			test: func(t *testing.T, mh *MemoryHandler) {
+				var wg sync.WaitGroup
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						mh.CreateUser(context.Background(), &UserRequest{Username: "carol", Email: fmt.Sprintf("carol%d@test.me", i)})
+					}(i)
+				}
+				wg.Wait()
+				if len(mh.users) != 1 {
+					t.Fatalf("Expected a single user, got %v", len(mh.users))
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, NewMemoryHandler())
+		})
+	}
+}
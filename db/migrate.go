@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	surrealdb "github.com/surrealdb/surrealdb.go"
+	"github.com/surrealdb/surrealdb.go/pkg/models"
+)
+
+//go:embed migrations/surrealdb/*.surql
+var surrealMigrations embed.FS
+
+// migrationsTable keeps the migrations applied to the database
+const migrationsTable = "migrations"
+
+var (
+	// ErrMigrationModified is returned when an applied migration doesn't match its file anymore
+	ErrMigrationModified = errors.New("migration modified after it was applied")
+	// ErrMigrationUnknown is returned when the database has a migration that isn't in the files
+	ErrMigrationUnknown = errors.New("unknown migration applied")
+)
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.surql$`)
+
+// Migration is a versioned change of the schema, Down reverts Up
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationStatus tells if a migration is applied, AppliedAt is the zero time if it's pending
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+type appliedMigration struct {
+	ID        *models.RecordID `json:"id,omitempty"`
+	Version   int              `json:"version"`
+	Name      string           `json:"name"`
+	Checksum  string           `json:"checksum"`
+	AppliedAt string           `json:"appliedAt"`
+}
+
+// LoadMigrations reads the NNNN_name.up.surql and NNNN_name.down.surql files, ordered by version.
+// The checksum covers both files so a migration can't be changed once applied.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, file := range files {
+		match := migrationFileName.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, file.Name())
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %v and %v", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%v has no up file", m.Version, m.Name)
+		}
+		sum := sha256.Sum256([]byte(m.Up + "\x00" + m.Down))
+		m.Checksum = hex.EncodeToString(sum[:])
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// SurrealMigrator applies the migrations of the SurrealDB schema, each in a transaction with its record
+type SurrealMigrator struct {
+	conn       *surrealConn
+	migrations []Migration
+}
+
+// Migrator returns the migrator of the embedded migrations
+func (sdh SurrealDBHandler) Migrator() (*SurrealMigrator, error) {
+	sub, err := fs.Sub(surrealMigrations, path.Join("migrations", "surrealdb"))
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := LoadMigrations(sub)
+	if err != nil {
+		return nil, err
+	}
+	return &SurrealMigrator{conn: sdh.conn, migrations: migrations}, nil
+}
+
+// applied returns the applied migrations by version after checking them against the files
+func (sm *SurrealMigrator) applied() (map[int]appliedMigration, error) {
+	records, err := querySurreal[appliedMigration](context.Background(), sm.conn.get(), "SELECT * FROM type::table($table)", map[string]interface{}{"table": migrationsTable})
+	if err != nil {
+		return nil, err
+	}
+	known := map[int]Migration{}
+	for _, m := range sm.migrations {
+		known[m.Version] = m
+	}
+	applied := map[int]appliedMigration{}
+	for _, record := range records {
+		m, ok := known[record.Version]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d_%v", ErrMigrationUnknown, record.Version, record.Name)
+		}
+		if m.Checksum != record.Checksum {
+			return nil, fmt.Errorf("%w: %d_%v", ErrMigrationModified, record.Version, record.Name)
+		}
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+func (sm *SurrealMigrator) Status() ([]MigrationStatus, error) {
+	applied, err := sm.applied()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, len(sm.migrations))
+	for i, m := range sm.migrations {
+		status[i] = MigrationStatus{Migration: m}
+		if record, ok := applied[m.Version]; ok {
+			status[i].AppliedAt, _ = time.Parse(time.RFC3339, record.AppliedAt)
+		}
+	}
+	return status, nil
+}
+
+// Up applies the pending migrations in order, it returns the number of migrations applied
+func (sm *SurrealMigrator) Up() (int, error) {
+	applied, err := sm.applied()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, m := range sm.migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := sm.run(m.Up, "CREATE $record CONTENT $migration", map[string]interface{}{
+			"record": migrationRecordID(m.Version),
+			"migration": appliedMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				Checksum:  m.Checksum,
+				AppliedAt: time.Now().UTC().Format(time.RFC3339),
+			},
+		})
+		if err != nil {
+			return count, fmt.Errorf("migration %d_%v failed: %w", m.Version, m.Name, err)
+		}
+		logger.WithField("migration", fmt.Sprintf("%d_%v", m.Version, m.Name)).Info("Applied the migration")
+		count++
+	}
+	return count, nil
+}
+
+// Down reverts the last applied migrations, it returns the number of migrations reverted
+func (sm *SurrealMigrator) Down(steps int) (int, error) {
+	applied, err := sm.applied()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := len(sm.migrations) - 1; i >= 0 && count < steps; i-- {
+		m := sm.migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return count, fmt.Errorf("migration %d_%v can't be reverted, it has no down file", m.Version, m.Name)
+		}
+		err := sm.run(m.Down, "DELETE $record", map[string]interface{}{"record": migrationRecordID(m.Version)})
+		if err != nil {
+			return count, fmt.Errorf("revert of migration %d_%v failed: %w", m.Version, m.Name, err)
+		}
+		logger.WithField("migration", fmt.Sprintf("%d_%v", m.Version, m.Name)).Info("Reverted the migration")
+		count++
+	}
+	return count, nil
+}
+
+// run executes the script and the change of the migrations table in a single transaction
+func (sm *SurrealMigrator) run(script string, record string, vars map[string]interface{}) error {
+	script = strings.TrimSpace(script)
+	if !strings.HasSuffix(script, ";") {
+		script += ";"
+	}
+	sql := "BEGIN TRANSACTION;\n" + script + "\n" + record + ";\nCOMMIT TRANSACTION;"
+	res, err := surrealdb.Query[interface{}](sm.conn.get(), sql, vars)
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return nil
+	}
+	// Every statement of a cancelled transaction fails, only the distinct errors are kept
+	var errs []string
+	for _, statement := range *res {
+		if statement.Status == "OK" {
+			continue
+		}
+		if message := fmt.Sprintf("%v", statement.Result); !slices.Contains(errs, message) {
+			errs = append(errs, message)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func migrationRecordID(version int) models.RecordID {
+	return models.NewRecordID(migrationsTable, version)
+}
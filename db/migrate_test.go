@@ -0,0 +1,100 @@
+package db
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "Ordered by version with a checksum",
+			test: func(t *testing.T) {
+				migrations, err := LoadMigrations(fstest.MapFS{
+					"0002_second.up.surql":  {Data: []byte("DEFINE TABLE b;")},
+					"0001_first.up.surql":   {Data: []byte("DEFINE TABLE a;")},
+					"0001_first.down.surql": {Data: []byte("REMOVE TABLE a;")},
+					"README.md":             {Data: []byte("ignored")},
+				})
+				if err != nil {
+					t.Fatalf("Failed to load migrations: %v", err)
+				}
+				if len(migrations) != 2 || migrations[0].Name != "first" || migrations[1].Version != 2 {
+					t.Fatalf("Unexpected migrations %+v", migrations)
+				}
+				if migrations[0].Down != "REMOVE TABLE a;" || migrations[1].Down != "" {
+					t.Fatalf("Expected the down files to be loaded, got %+v", migrations)
+				}
+				if len(migrations[0].Checksum) != 64 || migrations[0].Checksum == migrations[1].Checksum {
+					t.Fatalf("Expected distinct checksums, got %v and %v", migrations[0].Checksum, migrations[1].Checksum)
+				}
+			},
+		},
+		{
+			name: "Checksum covers the down file",
+			test: func(t *testing.T) {
+				load := func(down string) string {
+					migrations, err := LoadMigrations(fstest.MapFS{
+						"0001_first.up.surql":   {Data: []byte("DEFINE TABLE a;")},
+						"0001_first.down.surql": {Data: []byte(down)},
+					})
+					if err != nil {
+						t.Fatalf("Failed to load migrations: %v", err)
+					}
+					return migrations[0].Checksum
+				}
+				if load("REMOVE TABLE a;") == load("REMOVE TABLE IF EXISTS a;") {
+					t.Fatalf("Expected a modified down file to change the checksum")
+				}
+			},
+		},
+		{
+			name: "Invalid migrations refused",
+			test: func(t *testing.T) {
+				for name, fsys := range map[string]fstest.MapFS{
+					"no up file": {"0001_first.down.surql": {Data: []byte("REMOVE TABLE a;")}},
+					"two names": {
+						"0001_first.up.surql":  {Data: []byte("DEFINE TABLE a;")},
+						"0001_second.up.surql": {Data: []byte("DEFINE TABLE b;")},
+					},
+				} {
+					if _, err := LoadMigrations(fsys); err == nil {
+						t.Errorf("Expected an error for %v", name)
+					}
+				}
+			},
+		},
+		{
+			name: "Embedded migrations are consecutive and reversible",
+			test: func(t *testing.T) {
+				sub, err := fs.Sub(surrealMigrations, "migrations/surrealdb")
+				if err != nil {
+					t.Fatalf("Failed to open the embedded migrations: %v", err)
+				}
+				migrations, err := LoadMigrations(sub)
+				if err != nil {
+					t.Fatalf("Failed to load the embedded migrations: %v", err)
+				}
+				for i, m := range migrations {
+					if m.Version != i+1 {
+						t.Fatalf("Expected the version %v, got %v", i+1, m.Version)
+					}
+					if m.Down == "" {
+						t.Errorf("Expected %04d_%v to have a down file", m.Version, m.Name)
+					}
+				}
+				if !strings.Contains(migrations[0].Up, "users_email ON TABLE users FIELDS email UNIQUE") {
+					t.Fatalf("Expected the first migration to make the email unique")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.test)
+	}
+}
@@ -16,6 +16,15 @@ type User struct {
 	FirstName     string
 	LastName      string
 	EncryptionKey EncryptionKey
+	EmailVerified bool
+	TOTPSecret    string
+	TOTPEnabled   bool
+	// TOTPLastStep is the time step of the last accepted TOTP code, the codes up to it can't be replayed
+	TOTPLastStep  int64    `gorm:"default:0"`
+	RecoveryCodes []string `gorm:"serializer:json"`
+	Role          string   `gorm:"default:user"`
+	// DeletedAt hides the user until it's purged after the grace period
+	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
 func (u *User) GetId() string {
@@ -50,6 +59,25 @@ func (u *User) GetEncryptionKey() string {
 	return u.EncryptionKey.SecretKey
 }
 
+func (u *User) IsEmailVerified() bool {
+	return u.EmailVerified
+}
+
+func (u *User) GetTOTPSecret() string {
+	return u.TOTPSecret
+}
+
+func (u *User) IsTOTPEnabled() bool {
+	return u.TOTPEnabled
+}
+
+func (u *User) GetRole() string {
+	if u.Role == "" {
+		return DefaultRole
+	}
+	return u.Role
+}
+
 type EncryptionKey struct {
 	gorm.Model
 	SecretKey string
@@ -57,16 +85,25 @@ type EncryptionKey struct {
 }
 
 type Token struct {
-	ID             uint `gorm:"primaryKey;autoIncrement:true;uniqueIndex;not null"`
+	ID             uint   `gorm:"primaryKey;autoIncrement:true;uniqueIndex;not null"`
+	SessionID      string `gorm:"uniqueIndex"`
 	Value          string
-	ExpirationDate time.Time
-	UserID         uint
+	ExpirationDate time.Time `gorm:"index"`
+	UserID         uint      `gorm:"index"`
+	UserAgent      string
+	IP             string
+	CreatedAt      time.Time
+	LastSeenAt     time.Time
 }
 
 func (t *Token) GetId() string {
 	return fmt.Sprintf("%d", t.ID)
 }
 
+func (t *Token) GetSessionID() string {
+	return t.SessionID
+}
+
 func (t *Token) GetValue() string {
 	return t.Value
 }
@@ -75,6 +112,222 @@ func (t *Token) GetUserID() string {
 	return fmt.Sprintf("%d", t.UserID)
 }
 
+func (t *Token) GetUserAgent() string {
+	return t.UserAgent
+}
+
+func (t *Token) GetIP() string {
+	return t.IP
+}
+
+func (t *Token) GetCreatedAt() time.Time {
+	return t.CreatedAt
+}
+
+func (t *Token) GetLastSeenAt() time.Time {
+	return t.LastSeenAt
+}
+
 func (t *Token) GetExpirationDate() time.Time {
 	return t.ExpirationDate
 }
+
+type RefreshToken struct {
+	ID             uint   `gorm:"primaryKey;autoIncrement:true;uniqueIndex;not null"`
+	Hash           string `gorm:"uniqueIndex"`
+	Family         string `gorm:"index"`
+	UserID         uint
+	Username       string
+	ExpirationDate time.Time
+	Used           bool
+	Revoked        bool
+}
+
+func (rt *RefreshToken) GetId() string {
+	return fmt.Sprintf("%d", rt.ID)
+}
+
+func (rt *RefreshToken) GetHash() string {
+	return rt.Hash
+}
+
+func (rt *RefreshToken) GetFamily() string {
+	return rt.Family
+}
+
+func (rt *RefreshToken) GetUserID() string {
+	return fmt.Sprintf("%d", rt.UserID)
+}
+
+func (rt *RefreshToken) GetUsername() string {
+	return rt.Username
+}
+
+func (rt *RefreshToken) GetExpirationDate() time.Time {
+	return rt.ExpirationDate
+}
+
+func (rt *RefreshToken) IsUsed() bool {
+	return rt.Used
+}
+
+func (rt *RefreshToken) IsRevoked() bool {
+	return rt.Revoked
+}
+
+type PasswordResetToken struct {
+	ID             uint   `gorm:"primaryKey;autoIncrement:true;uniqueIndex;not null"`
+	Hash           string `gorm:"uniqueIndex"`
+	UserID         uint
+	Username       string
+	ExpirationDate time.Time
+	Used           bool
+}
+
+func (prt *PasswordResetToken) GetId() string {
+	return fmt.Sprintf("%d", prt.ID)
+}
+
+func (prt *PasswordResetToken) GetUserID() string {
+	return fmt.Sprintf("%d", prt.UserID)
+}
+
+func (prt *PasswordResetToken) GetUsername() string {
+	return prt.Username
+}
+
+func (prt *PasswordResetToken) GetExpirationDate() time.Time {
+	return prt.ExpirationDate
+}
+
+type Identity struct {
+	ID       uint   `gorm:"primaryKey;autoIncrement:true;uniqueIndex;not null"`
+	Issuer   string `gorm:"uniqueIndex:idx_identity_subject"`
+	Subject  string `gorm:"uniqueIndex:idx_identity_subject"`
+	UserID   uint   `gorm:"index"`
+	Username string
+}
+
+func (i *Identity) GetId() string {
+	return fmt.Sprintf("%d", i.ID)
+}
+
+func (i *Identity) GetIssuer() string {
+	return i.Issuer
+}
+
+func (i *Identity) GetSubject() string {
+	return i.Subject
+}
+
+func (i *Identity) GetUserID() string {
+	return fmt.Sprintf("%d", i.UserID)
+}
+
+func (i *Identity) GetUsername() string {
+	return i.Username
+}
+
+type ApiKey struct {
+	ID             uint `gorm:"primaryKey;autoIncrement:true;uniqueIndex;not null"`
+	Name           string
+	Prefix         string `gorm:"uniqueIndex"`
+	Hash           string `gorm:"uniqueIndex"`
+	UserID         uint   `gorm:"index"`
+	Username       string
+	Scopes         []string `gorm:"serializer:json"`
+	CreatedAt      time.Time
+	LastUsedAt     time.Time
+	ExpirationDate time.Time
+}
+
+func (ak *ApiKey) GetId() string {
+	return fmt.Sprintf("%d", ak.ID)
+}
+
+func (ak *ApiKey) GetName() string {
+	return ak.Name
+}
+
+func (ak *ApiKey) GetPrefix() string {
+	return ak.Prefix
+}
+
+func (ak *ApiKey) GetUserID() string {
+	return fmt.Sprintf("%d", ak.UserID)
+}
+
+func (ak *ApiKey) GetUsername() string {
+	return ak.Username
+}
+
+func (ak *ApiKey) GetScopes() []string {
+	return ak.Scopes
+}
+
+func (ak *ApiKey) GetCreatedAt() time.Time {
+	return ak.CreatedAt
+}
+
+func (ak *ApiKey) GetLastUsedAt() time.Time {
+	return ak.LastUsedAt
+}
+
+func (ak *ApiKey) GetExpirationDate() time.Time {
+	return ak.ExpirationDate
+}
+
+type AuthEvent struct {
+	ID        uint   `gorm:"primaryKey;autoIncrement:true;uniqueIndex;not null"`
+	Type      string `gorm:"index"`
+	UserID    string `gorm:"index"`
+	UserUUID  string `gorm:"index"`
+	Username  string `gorm:"index"`
+	IP        string
+	UserAgent string
+	TraceID   string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+func (ae *AuthEvent) GetId() string {
+	return fmt.Sprintf("%d", ae.ID)
+}
+
+func (ae *AuthEvent) GetType() string {
+	return ae.Type
+}
+
+func (ae *AuthEvent) GetUserID() string {
+	return ae.UserID
+}
+
+func (ae *AuthEvent) GetUserUUID() string {
+	return ae.UserUUID
+}
+
+func (ae *AuthEvent) GetUsername() string {
+	return ae.Username
+}
+
+func (ae *AuthEvent) GetIP() string {
+	return ae.IP
+}
+
+func (ae *AuthEvent) GetUserAgent() string {
+	return ae.UserAgent
+}
+
+func (ae *AuthEvent) GetTraceID() string {
+	return ae.TraceID
+}
+
+func (ae *AuthEvent) GetCreatedAt() time.Time {
+	return ae.CreatedAt
+}
+
+// Lock is a lease on a background job, held by a replica of the gateway until ExpiresAt
+type Lock struct {
+	Name      string `gorm:"primaryKey"`
+	Owner     string
+	ExpiresAt time.Time
+}
@@ -0,0 +1,356 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracedHandler traces every operation of the DBHdandler as a child span of ctx and records its latency
+type TracedHandler struct {
+	dbh      DBHdandler
+	system   string
+	tracer   trace.Tracer
+	duration metric.Float64Histogram
+}
+
+// NewTracedHandler wraps the handler, system is the db.system of the spans and the metrics.
+// The global providers are set by the api, the instruments created before are forwarded to them.
+func NewTracedHandler(dbh DBHdandler, system string) *TracedHandler {
+	duration, err := otel.Meter("gateway/db").Float64Histogram("db.client.operation.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of the database operations"),
+	)
+	if err != nil {
+		logger.WithError(err).Error("Error when trying to create the database metrics")
+	}
+	return &TracedHandler{dbh: dbh, system: system, tracer: otel.Tracer("gateway/db"), duration: duration}
+}
+
+// expected tells if the error is an answer of the database rather than a failure
+func expected(err error) bool {
+	for _, e := range []error{
+		ErrRefreshTokenReused, ErrSessionNotFound, ErrEmailMismatch, ErrRecoveryCodeInvalid, ErrUserNotFound,
+		ErrUserExists, ErrIdentityNotFound, ErrApiKeyNotFound, ErrPasswordResetTokenInvalid,
+	} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// start starts the span of the operation, the returned function ends it with the result of the operation
+func (th *TracedHandler) start(ctx context.Context, operation string) (context.Context, func(error)) {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", th.system),
+		attribute.String("db.operation.name", operation),
+	}
+	ctx, span := th.tracer.Start(ctx, "db."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	start := time.Now()
+	return ctx, func(err error) {
+		if err != nil && !expected(err) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			attrs = append(attrs, attribute.String("error.type", fmt.Sprintf("%T", err)))
+		}
+		if th.duration != nil {
+			th.duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attrs...))
+		}
+		span.End()
+	}
+}
+
+func (th *TracedHandler) CreateUser(ctx context.Context, user *UserRequest) (UserDTO, error) {
+	ctx, end := th.start(ctx, "CreateUser")
+	res, err := th.dbh.CreateUser(ctx, user)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetUsername(ctx context.Context, username string) (UserDTO, error) {
+	ctx, end := th.start(ctx, "GetUsername")
+	res, err := th.dbh.GetUsername(ctx, username)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetUserByEmail(ctx context.Context, email string) (UserDTO, error) {
+	ctx, end := th.start(ctx, "GetUserByEmail")
+	res, err := th.dbh.GetUserByEmail(ctx, email)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) UpdateUser(ctx context.Context, userID string, update *UserUpdateRequest) (UserDTO, error) {
+	ctx, end := th.start(ctx, "UpdateUser")
+	res, err := th.dbh.UpdateUser(ctx, userID, update)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) UpdatePassword(ctx context.Context, userID string, password string) error {
+	ctx, end := th.start(ctx, "UpdatePassword")
+	err := th.dbh.UpdatePassword(ctx, userID, password)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) DeleteUser(ctx context.Context, userID string) error {
+	ctx, end := th.start(ctx, "DeleteUser")
+	err := th.dbh.DeleteUser(ctx, userID)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) RestoreUser(ctx context.Context, userID string) error {
+	ctx, end := th.start(ctx, "RestoreUser")
+	err := th.dbh.RestoreUser(ctx, userID)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) GetDeletedUsers(ctx context.Context, before time.Time) ([]UserDTO, error) {
+	ctx, end := th.start(ctx, "GetDeletedUsers")
+	res, err := th.dbh.GetDeletedUsers(ctx, before)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) PurgeUser(ctx context.Context, userID string) error {
+	ctx, end := th.start(ctx, "PurgeUser")
+	err := th.dbh.PurgeUser(ctx, userID)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) VerifyEmail(ctx context.Context, userID string, email string) error {
+	ctx, end := th.start(ctx, "VerifyEmail")
+	err := th.dbh.VerifyEmail(ctx, userID, email)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) UpdateTOTP(ctx context.Context, userID string, totp *TOTPRequest) error {
+	ctx, end := th.start(ctx, "UpdateTOTP")
+	err := th.dbh.UpdateTOTP(ctx, userID, totp)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) UpdateRole(ctx context.Context, userID string, role string) error {
+	ctx, end := th.start(ctx, "UpdateRole")
+	err := th.dbh.UpdateRole(ctx, userID, role)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) UseRecoveryCode(ctx context.Context, userID string, hash string) error {
+	ctx, end := th.start(ctx, "UseRecoveryCode")
+	err := th.dbh.UseRecoveryCode(ctx, userID, hash)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	ctx, end := th.start(ctx, "UseTOTPStep")
+	err := th.dbh.UseTOTPStep(ctx, userID, step)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) CreateIdentity(ctx context.Context, identity *IdentityRequest) (IdentityDTO, error) {
+	ctx, end := th.start(ctx, "CreateIdentity")
+	res, err := th.dbh.CreateIdentity(ctx, identity)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetIdentity(ctx context.Context, issuer string, subject string) (IdentityDTO, error) {
+	ctx, end := th.start(ctx, "GetIdentity")
+	res, err := th.dbh.GetIdentity(ctx, issuer, subject)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) CreateApiKey(ctx context.Context, key *ApiKeyRequest) (ApiKeyDTO, error) {
+	ctx, end := th.start(ctx, "CreateApiKey")
+	res, err := th.dbh.CreateApiKey(ctx, key)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetApiKeys(ctx context.Context, userID string) ([]ApiKeyDTO, error) {
+	ctx, end := th.start(ctx, "GetApiKeys")
+	res, err := th.dbh.GetApiKeys(ctx, userID)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetApiKey(ctx context.Context, hash string) (ApiKeyDTO, error) {
+	ctx, end := th.start(ctx, "GetApiKey")
+	res, err := th.dbh.GetApiKey(ctx, hash)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) TouchApiKey(ctx context.Context, prefix string, lastUsedAt time.Time) error {
+	ctx, end := th.start(ctx, "TouchApiKey")
+	err := th.dbh.TouchApiKey(ctx, prefix, lastUsedAt)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) RevokeApiKey(ctx context.Context, userID string, prefix string) error {
+	ctx, end := th.start(ctx, "RevokeApiKey")
+	err := th.dbh.RevokeApiKey(ctx, userID, prefix)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) UpsertToken(ctx context.Context, token *TokenRequest) (TokenDTO, error) {
+	ctx, end := th.start(ctx, "UpsertToken")
+	res, err := th.dbh.UpsertToken(ctx, token)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetTokenUser(ctx context.Context, value string, userID string, sessionID string) (TokenDTO, error) {
+	ctx, end := th.start(ctx, "GetTokenUser")
+	res, err := th.dbh.GetTokenUser(ctx, value, userID, sessionID)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetSessions(ctx context.Context, userID string) ([]TokenDTO, error) {
+	ctx, end := th.start(ctx, "GetSessions")
+	res, err := th.dbh.GetSessions(ctx, userID)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) TouchSession(ctx context.Context, sessionID string, lastSeenAt time.Time) error {
+	ctx, end := th.start(ctx, "TouchSession")
+	err := th.dbh.TouchSession(ctx, sessionID, lastSeenAt)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) DeleteSession(ctx context.Context, userID string, sessionID string) error {
+	ctx, end := th.start(ctx, "DeleteSession")
+	err := th.dbh.DeleteSession(ctx, userID, sessionID)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) DeleteToken(ctx context.Context, userID string) error {
+	ctx, end := th.start(ctx, "DeleteToken")
+	err := th.dbh.DeleteToken(ctx, userID)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) PurgeExpiredTokens(ctx context.Context, before time.Time) (int, error) {
+	ctx, end := th.start(ctx, "PurgeExpiredTokens")
+	res, err := th.dbh.PurgeExpiredTokens(ctx, before)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) CreateRefreshToken(ctx context.Context, token *RefreshTokenRequest) (RefreshTokenDTO, error) {
+	ctx, end := th.start(ctx, "CreateRefreshToken")
+	res, err := th.dbh.CreateRefreshToken(ctx, token)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetRefreshToken(ctx context.Context, hash string) (RefreshTokenDTO, error) {
+	ctx, end := th.start(ctx, "GetRefreshToken")
+	res, err := th.dbh.GetRefreshToken(ctx, hash)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) UseRefreshToken(ctx context.Context, hash string) error {
+	ctx, end := th.start(ctx, "UseRefreshToken")
+	err := th.dbh.UseRefreshToken(ctx, hash)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	ctx, end := th.start(ctx, "RevokeRefreshTokenFamily")
+	err := th.dbh.RevokeRefreshTokenFamily(ctx, family)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) DeleteRefreshTokens(ctx context.Context, userID string) error {
+	ctx, end := th.start(ctx, "DeleteRefreshTokens")
+	err := th.dbh.DeleteRefreshTokens(ctx, userID)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) CreatePasswordResetToken(ctx context.Context, token *PasswordResetTokenRequest) (PasswordResetTokenDTO, error) {
+	ctx, end := th.start(ctx, "CreatePasswordResetToken")
+	res, err := th.dbh.CreatePasswordResetToken(ctx, token)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) GetPasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error) {
+	ctx, end := th.start(ctx, "GetPasswordResetToken")
+	res, err := th.dbh.GetPasswordResetToken(ctx, hash)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) UsePasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error) {
+	ctx, end := th.start(ctx, "UsePasswordResetToken")
+	res, err := th.dbh.UsePasswordResetToken(ctx, hash)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) CreateAuthEvent(ctx context.Context, event *AuthEventRequest) error {
+	ctx, end := th.start(ctx, "CreateAuthEvent")
+	err := th.dbh.CreateAuthEvent(ctx, event)
+	end(err)
+	return err
+}
+
+func (th *TracedHandler) GetAuthEvents(ctx context.Context, filter *AuthEventFilter) ([]AuthEventDTO, error) {
+	ctx, end := th.start(ctx, "GetAuthEvents")
+	res, err := th.dbh.GetAuthEvents(ctx, filter)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) RotateEncryptionKeys(ctx context.Context) (int, error) {
+	ctx, end := th.start(ctx, "RotateEncryptionKeys")
+	res, err := th.dbh.RotateEncryptionKeys(ctx)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	ctx, end := th.start(ctx, "AcquireLock")
+	res, err := th.dbh.AcquireLock(ctx, name, owner, ttl)
+	end(err)
+	return res, err
+}
+
+func (th *TracedHandler) Ping(ctx context.Context) error {
+	ctx, end := th.start(ctx, "Ping")
+	err := th.dbh.Ping(ctx)
+	end(err)
+	return err
+}
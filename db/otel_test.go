@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// failingPing fails the pings with its error
+type failingPing struct {
+	DBHdandler
+	err error
+}
+
+func (f *failingPing) Ping(ctx context.Context) error {
+	return f.err
+}
+
+func TestTracedHandler(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	th := NewTracedHandler(NewMemoryHandler(), "memory")
+
+	if _, err := th.GetUsername(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected ErrUserNotFound, got %v", err)
+	}
+	if err := NewTracedHandler(&failingPing{err: errors.New("connection refused")}, "memory").Ping(ctx); err == nil {
+		t.Fatalf("Expected the error of the handler")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %v", len(spans))
+	}
+	for _, span := range spans[:2] {
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("Expected %v to be a child of the request", span.Name())
+		}
+		if !hasAttribute(span.Attributes(), attribute.String("db.system", "memory")) {
+			t.Errorf("Expected the db.system of %v", span.Name())
+		}
+	}
+	if spans[0].Name() != "db.GetUsername" || spans[0].Status().Code == codes.Error {
+		t.Errorf("Expected a user not found not to be a failure, got %v %v", spans[0].Name(), spans[0].Status())
+	}
+	if spans[1].Name() != "db.Ping" || spans[1].Status().Code != codes.Error {
+		t.Errorf("Expected the failed ping to be an error, got %v %v", spans[1].Name(), spans[1].Status())
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,17 @@
 package db
 
 import (
+	"context"
+	"errors"
+	"gateway/envelope"
+	"gateway/utils"
 	"strconv"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var loger = logrus.WithFields(logrus.Fields{
@@ -13,7 +19,8 @@ var loger = logrus.WithFields(logrus.Fields{
 })
 
 type PostgresHandler struct {
-	db *gorm.DB
+	db       *gorm.DB
+	envelope *envelope.Envelope
 }
 
 func (PostgresHandler) NewToken(t TokenRequest) TokenDTO {
@@ -22,9 +29,12 @@ func (PostgresHandler) NewToken(t TokenRequest) TokenDTO {
 		loger.WithError(err).Error("Error when trying to convert userID to uint")
 	}
 	return &Token{
+		SessionID:      t.SessionID,
 		Value:          t.Value,
 		ExpirationDate: t.ExpirationDate,
 		UserID:         uint(userId),
+		UserAgent:      t.UserAgent,
+		IP:             t.IP,
 	}
 }
 
@@ -36,67 +46,431 @@ func (PostgresHandler) LogAndReturnError(l *logrus.Entry, result *gorm.DB, actio
 	return nil
 }
 
-func (ph PostgresHandler) Ping() error {
+func (ph PostgresHandler) Ping(ctx context.Context) error {
 	sqlDB, err := ph.db.DB()
 	if err != nil {
 		loger.WithError(err).Error("Error when trying to get database connection")
 	}
-	err = sqlDB.Ping()
+	err = sqlDB.PingContext(ctx)
 	if err != nil {
 		loger.WithError(err).Error("Error when trying to ping database")
 	}
 	return err
 }
 
-func (ph PostgresHandler) CreateUser(userRequest *UserRequest) (UserDTO, error) {
+// decryptUser unwraps the data key of the user and decrypts its fields in place
+func (ph PostgresHandler) decryptUser(user *User) error {
+	dataKey, err := ph.envelope.Unwrap(user.EncryptionKey.SecretKey)
+	if err != nil {
+		loger.WithError(err).WithField("username", user.Username).Error("Error when trying to unwrap the data key")
+		return err
+	}
+	user.EncryptionKey.SecretKey = dataKey
+	if user.FirstName, err = envelope.DecryptField(user.FirstName, dataKey); err != nil {
+		return err
+	}
+	if user.LastName, err = envelope.DecryptField(user.LastName, dataKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getUser loads the user matching the condition with its data key, it returns ErrUserNotFound if there's none
+func (ph PostgresHandler) getUser(ctx context.Context, query string, args ...interface{}) (*User, error) {
+	user := new(User)
+	result := ph.db.WithContext(ctx).Preload("EncryptionKey").Where(query, args...).First(user)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err := ph.LogAndReturnError(loger, result, "get", "user"); err != nil {
+		return nil, err
+	}
+	return user, ph.decryptUser(user)
+}
+
+func (ph PostgresHandler) CreateUser(ctx context.Context, userRequest *UserRequest) (UserDTO, error) {
 
 	uuid, err := uuid.NewV4()
 	if err != nil {
 		loger.WithError(err).Error("Error when trying to generate UUID")
 	}
 
+	dataKey := userRequest.EncryptionKey
+	if dataKey == "" {
+		if dataKey, err = utils.GenerateSecretKey(); err != nil {
+			return nil, err
+		}
+	}
+	wrappedKey, err := ph.envelope.Wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	firstName, err := envelope.EncryptField(userRequest.FirstName, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	lastName, err := envelope.EncryptField(userRequest.LastName, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
 	user := User{
 		Username:      userRequest.Username,
 		Email:         userRequest.Email,
 		Password:      userRequest.Password,
-		FirstName:     userRequest.FirstName,
-		LastName:      userRequest.LastName,
-		EncryptionKey: EncryptionKey{SecretKey: userRequest.EncryptionKey},
+		FirstName:     firstName,
+		LastName:      lastName,
+		EncryptionKey: EncryptionKey{SecretKey: wrappedKey},
 		UUID:          uuid.String(),
+		Role:          userRequest.Role,
+	}
+	if user.Role == "" {
+		user.Role = DefaultRole
+	}
+	// The deleted users keep their username and email until they are purged
+	result := ph.db.WithContext(ctx).Unscoped().Where("username = ? OR email = ?", userRequest.Username, userRequest.Email).FirstOrCreate(&user)
+	if err := ph.LogAndReturnError(loger, result, "create", "user"); err != nil {
+		return nil, err
 	}
-	result := ph.db.Where("username = ? OR email = ?", userRequest.Username, userRequest.Email).FirstOrCreate(&user)
-	loger.Info(result.RowsAffected)
-	// User already exists so we throw an error
+	// Nothing is created when a user already has the username or the email
 	if result.RowsAffected == 0 {
-		return nil, gorm.ErrDuplicatedKey
+		return nil, ErrUserExists
 	}
-	ph.db.Create(&user)
-	err = ph.LogAndReturnError(loger, result, "create", "user")
-	return &user, err
+	return &user, ph.decryptUser(&user)
 }
 
-func (ph PostgresHandler) GetUsername(username string) (UserDTO, error) {
-	user := new(User)
-	result := ph.db.Where("username = ?", username).First(user)
-	err := ph.LogAndReturnError(loger, result, "get", "username")
-	return user, err
+func (ph PostgresHandler) GetUsername(ctx context.Context, username string) (UserDTO, error) {
+	user, err := ph.getUser(ctx, "username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
-func (ph PostgresHandler) UpsertToken(token *TokenRequest) (TokenDTO, error) {
+func (ph PostgresHandler) GetUserByEmail(ctx context.Context, email string) (UserDTO, error) {
+	return ph.getUser(ctx, "email = ?", email)
+}
+
+func (ph PostgresHandler) UpdateUser(ctx context.Context, userID string, update *UserUpdateRequest) (UserDTO, error) {
+	user, err := ph.getUser(ctx, "id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := user.EncryptionKey.SecretKey
+
+	updates := map[string]interface{}{}
+	if update.Email != nil {
+		// The right side uses the old email, the verification is kept if it doesn't change
+		updates["email_verified"] = gorm.Expr("CASE WHEN email = ? THEN email_verified ELSE false END", *update.Email)
+		updates["email"] = *update.Email
+	}
+	if update.FirstName != nil {
+		firstName, err := envelope.EncryptField(*update.FirstName, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		updates["first_name"] = firstName
+	}
+	if update.LastName != nil {
+		lastName, err := envelope.EncryptField(*update.LastName, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		updates["last_name"] = lastName
+	}
+	if len(updates) > 0 {
+		result := ph.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Updates(updates)
+		if err := ph.LogAndReturnError(loger, result, "update", "user"); err != nil {
+			return nil, err
+		}
+	}
+	return ph.getUser(ctx, "id = ?", userID)
+}
+
+func (ph PostgresHandler) DeleteUser(ctx context.Context, userID string) error {
+	result := ph.db.WithContext(ctx).Where("id = ?", userID).Delete(&User{})
+	if err := ph.LogAndReturnError(loger, result, "delete", "user"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (ph PostgresHandler) RestoreUser(ctx context.Context, userID string) error {
+	result := ph.db.WithContext(ctx).Unscoped().Model(&User{}).Where("id = ? AND deleted_at IS NOT NULL", userID).Update("deleted_at", nil)
+	if err := ph.LogAndReturnError(loger, result, "restore", "user"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (ph PostgresHandler) GetDeletedUsers(ctx context.Context, before time.Time) ([]UserDTO, error) {
+	var users []User
+	result := ph.db.WithContext(ctx).Unscoped().Preload("EncryptionKey").Where("deleted_at IS NOT NULL AND deleted_at < ?", before).Find(&users)
+	if err := ph.LogAndReturnError(loger, result, "get", "deleted users"); err != nil {
+		return nil, err
+	}
+	deleted := make([]UserDTO, len(users))
+	for i := range users {
+		if err := ph.decryptUser(&users[i]); err != nil {
+			return nil, err
+		}
+		deleted[i] = &users[i]
+	}
+	return deleted, nil
+}
+
+func (ph PostgresHandler) PurgeUser(ctx context.Context, userID string) error {
+	userId, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return err
+	}
+	return ph.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The events are keyed by the UUID, the user ID of an event can't tell a purged user from a new one
+		result := tx.Where("user_uuid IN (?)", tx.Unscoped().Model(&User{}).Select("uuid").Where("id = ? AND deleted_at IS NOT NULL", userId)).
+			Delete(&AuthEvent{})
+		if err := ph.LogAndReturnError(loger, result, "purge", "auth events"); err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&Token{}, &RefreshToken{}, &PasswordResetToken{}, &Identity{}, &ApiKey{}, &EncryptionKey{}} {
+			result := tx.Unscoped().Where("user_id = ?", userId).Delete(model)
+			if err := ph.LogAndReturnError(loger, result, "purge", "user data"); err != nil {
+				return err
+			}
+		}
+		// Only a soft-deleted user can be purged
+		result = tx.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", userId).Delete(&User{})
+		if err := ph.LogAndReturnError(loger, result, "purge", "user"); err != nil {
+			return err
+		}
+		if result.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	})
+}
+
+func (ph PostgresHandler) RotateEncryptionKeys(ctx context.Context) (int, error) {
+	rotated := 0
+	var users []User
+	result := ph.db.WithContext(ctx).Unscoped().Preload("EncryptionKey").FindInBatches(&users, 100, func(tx *gorm.DB, batch int) error {
+		for i := range users {
+			user := &users[i]
+			done, err := ph.rotateUser(ctx, user)
+			// The user changed since it was read, it's read again to not overwrite the change
+			for attempt := 1; errors.Is(err, errUserChanged) && attempt < rotateAttempts; attempt++ {
+				user = new(User)
+				reload := ph.db.WithContext(ctx).Unscoped().Preload("EncryptionKey").First(user, users[i].ID)
+				if errors.Is(reload.Error, gorm.ErrRecordNotFound) {
+					err = nil
+					break
+				}
+				if reload.Error != nil {
+					return reload.Error
+				}
+				done, err = ph.rotateUser(ctx, user)
+			}
+			if errors.Is(err, errUserChanged) {
+				loger.WithField("username", user.Username).Warn("The user keeps changing, it's rotated by the next start")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if done {
+				rotated++
+			}
+		}
+		return nil
+	})
+	return rotated, ph.LogAndReturnError(loger, result, "rotate", "encryption keys")
+}
+
+// rotateUser rewraps the data key of the user and encrypts its plaintext fields, it tells if the user was updated.
+// It returns errUserChanged if the fields or the key aren't the ones read anymore.
+func (ph PostgresHandler) rotateUser(ctx context.Context, user *User) (bool, error) {
+	key := user.EncryptionKey
+	encrypted := (user.FirstName == "" || envelope.IsEncrypted(user.FirstName)) &&
+		(user.LastName == "" || envelope.IsEncrypted(user.LastName))
+	if key.ID != 0 && !ph.envelope.NeedsRewrap(key.SecretKey) && encrypted {
+		return false, nil
+	}
+
+	// The users created before the data keys get one
+	dataKey, err := ph.envelope.Unwrap(key.SecretKey)
+	if err != nil {
+		return false, err
+	}
+	if dataKey == "" {
+		if dataKey, err = utils.GenerateSecretKey(); err != nil {
+			return false, err
+		}
+	}
+	wrappedKey, err := ph.envelope.Wrap(dataKey)
+	if err != nil {
+		return false, err
+	}
+	firstName, err := encryptPlaintextField(user.FirstName, dataKey)
+	if err != nil {
+		return false, err
+	}
+	lastName, err := encryptPlaintextField(user.LastName, dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	err = ph.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Model(&User{}).Where("id = ? AND first_name = ? AND last_name = ?", user.ID, user.FirstName, user.LastName).
+			Updates(map[string]interface{}{"first_name": firstName, "last_name": lastName})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errUserChanged
+		}
+		if key.ID == 0 {
+			key.SecretKey = wrappedKey
+			key.UserID = user.ID
+			return tx.Unscoped().Save(&key).Error
+		}
+		result = tx.Unscoped().Model(&EncryptionKey{}).Where("id = ? AND secret_key = ?", key.ID, key.SecretKey).
+			Update("secret_key", wrappedKey)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errUserChanged
+		}
+		return nil
+	})
+	if errors.Is(err, errUserChanged) {
+		return false, err
+	}
+	if err != nil {
+		loger.WithError(err).WithField("username", user.Username).Error("Error when trying to rotate the encryption key")
+		return false, err
+	}
+	return true, nil
+}
+
+// encryptPlaintextField encrypts a field written before the encryption, an encrypted field is kept
+// as the data key doesn't change when its wrapping does
+func encryptPlaintextField(value string, dataKey string) (string, error) {
+	if envelope.IsEncrypted(value) {
+		return value, nil
+	}
+	return envelope.EncryptField(value, dataKey)
+}
+
+func (ph PostgresHandler) UpdatePassword(ctx context.Context, userID string, password string) error {
+	result := ph.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Update("password", password)
+	if err := ph.LogAndReturnError(loger, result, "update", "password"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (ph PostgresHandler) VerifyEmail(ctx context.Context, userID string, email string) error {
+	result := ph.db.WithContext(ctx).Model(&User{}).Where("id = ? AND email = ?", userID, email).Update("email_verified", true)
+	if err := ph.LogAndReturnError(loger, result, "verify", "email"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrEmailMismatch
+	}
+	return nil
+}
+
+func (ph PostgresHandler) UpdateRole(ctx context.Context, userID string, role string) error {
+	result := ph.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Update("role", role)
+	if err := ph.LogAndReturnError(loger, result, "update", "role"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (ph PostgresHandler) UpdateTOTP(ctx context.Context, userID string, totp *TOTPRequest) error {
+	result := ph.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Select("totp_secret", "totp_enabled", "recovery_codes").Updates(&User{
+		TOTPSecret:    totp.Secret,
+		TOTPEnabled:   totp.Enabled,
+		RecoveryCodes: totp.RecoveryCodes,
+	})
+	if err := ph.LogAndReturnError(loger, result, "update", "totp"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (ph PostgresHandler) UseRecoveryCode(ctx context.Context, userID string, hash string) error {
+	return ph.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := new(User)
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", userID).First(user)
+		if err := ph.LogAndReturnError(loger, result, "get", "user recovery codes"); err != nil {
+			return err
+		}
+		codes := make([]string, 0, len(user.RecoveryCodes))
+		for _, code := range user.RecoveryCodes {
+			if code != hash {
+				codes = append(codes, code)
+			}
+		}
+		if len(codes) == len(user.RecoveryCodes) {
+			return ErrRecoveryCodeInvalid
+		}
+		result = tx.Model(user).Select("recovery_codes").Updates(&User{RecoveryCodes: codes})
+		return ph.LogAndReturnError(loger, result, "use", "recovery code")
+	})
+}
+
+func (ph PostgresHandler) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	// The condition makes the update atomic, a step can't be accepted twice
+	result := ph.db.WithContext(ctx).Model(&User{}).Where("id = ? AND COALESCE(totp_last_step, 0) < ?", userID, step).Update("totp_last_step", step)
+	if err := ph.LogAndReturnError(loger, result, "use", "totp step"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+func (ph PostgresHandler) UpsertToken(ctx context.Context, token *TokenRequest) (TokenDTO, error) {
 
 	userId, err := strconv.ParseUint(token.UserID, 10, 64)
 	if err != nil {
 		loger.WithError(err).Error("Error when trying to convert userID to uint")
 	}
 	tokenR := Token{
-		UserID: uint(userId),
+		SessionID: token.SessionID,
+		UserID:    uint(userId),
+		UserAgent: token.UserAgent,
+		IP:        token.IP,
 	}
-	result := ph.db.Where("user_id = ?", userId).Assign(Token{Value: token.Value, ExpirationDate: token.ExpirationDate}).FirstOrCreate(&tokenR)
+	result := ph.db.WithContext(ctx).Where("session_id = ?", token.SessionID).Assign(Token{
+		Value:          token.Value,
+		ExpirationDate: token.ExpirationDate,
+		LastSeenAt:     time.Now(),
+	}).FirstOrCreate(&tokenR)
 	err = ph.LogAndReturnError(loger, result, "upsert", "token")
 	return &tokenR, err
 }
 
-func (ph PostgresHandler) GetTokenUser(value string, userID string) (TokenDTO, error) {
+func (ph PostgresHandler) GetTokenUser(ctx context.Context, value string, userID string, sessionID string) (TokenDTO, error) {
 	// Convert the userID to uint
 	userId, err := strconv.ParseUint(userID, 10, 64)
 	if err != nil {
@@ -104,18 +478,323 @@ func (ph PostgresHandler) GetTokenUser(value string, userID string) (TokenDTO, e
 		return nil, err
 	}
 	tokenR := new(Token)
-	result := ph.db.Where("user_id = ? and value = ?", userId, value).First(tokenR)
+	result := ph.db.WithContext(ctx).Where("user_id = ? and session_id = ? and value = ? and expiration_date > ?", userId, sessionID, value, time.Now()).First(tokenR)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	}
 	err = ph.LogAndReturnError(loger, result, "get", "token username")
 	return tokenR, err
 }
 
-func (ph PostgresHandler) DeleteToken(userID string) error {
+func (ph PostgresHandler) GetSessions(ctx context.Context, userID string) ([]TokenDTO, error) {
+	userId, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return nil, err
+	}
+	var tokens []Token
+	result := ph.db.WithContext(ctx).Where("user_id = ?", userId).Order("last_seen_at desc").Find(&tokens)
+	if err := ph.LogAndReturnError(loger, result, "get", "sessions"); err != nil {
+		return nil, err
+	}
+	sessions := make([]TokenDTO, len(tokens))
+	for i := range tokens {
+		sessions[i] = &tokens[i]
+	}
+	return sessions, nil
+}
+
+func (ph PostgresHandler) TouchSession(ctx context.Context, sessionID string, lastSeenAt time.Time) error {
+	result := ph.db.WithContext(ctx).Model(&Token{}).Where("session_id = ?", sessionID).Update("last_seen_at", lastSeenAt)
+	return ph.LogAndReturnError(loger, result, "touch", "session")
+}
+
+func (ph PostgresHandler) DeleteSession(ctx context.Context, userID string, sessionID string) error {
+	userId, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return err
+	}
+	result := ph.db.WithContext(ctx).Where("user_id = ? and session_id = ?", userId, sessionID).Delete(&Token{})
+	if err := ph.LogAndReturnError(loger, result, "delete", "session"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (ph PostgresHandler) DeleteToken(ctx context.Context, userID string) error {
 	// Convert the userID to uint
 	userId, err := strconv.ParseUint(userID, 10, 64)
 	if err != nil {
 		loger.WithError(err).Error("Error when trying to convert userID to uint")
 	}
-	result := ph.db.Where("user_id = ?", userId).Delete(&Token{})
+	result := ph.db.WithContext(ctx).Where("user_id = ?", userId).Delete(&Token{})
 	err = ph.LogAndReturnError(loger, result, "delete", "token")
 	return err
 }
+
+func (ph PostgresHandler) PurgeExpiredTokens(ctx context.Context, before time.Time) (int, error) {
+	result := ph.db.WithContext(ctx).Where("expiration_date < ?", before).Delete(&Token{})
+	if err := ph.LogAndReturnError(loger, result, "purge", "expired tokens"); err != nil {
+		return 0, err
+	}
+	return int(result.RowsAffected), nil
+}
+
+func (ph PostgresHandler) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	// The row of another owner is only updated once it expired, otherwise no row is affected
+	result := ph.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"owner", "expires_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			gorm.Expr("locks.owner = ? OR locks.expires_at < ?", owner, now),
+		}},
+	}).Create(&Lock{Name: name, Owner: owner, ExpiresAt: now.Add(ttl)})
+	if err := ph.LogAndReturnError(loger, result, "acquire", "lock"); err != nil {
+		return false, err
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (ph PostgresHandler) CreateRefreshToken(ctx context.Context, token *RefreshTokenRequest) (RefreshTokenDTO, error) {
+	userId, err := strconv.ParseUint(token.UserID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return nil, err
+	}
+	refreshToken := RefreshToken{
+		Hash:           token.Hash,
+		Family:         token.Family,
+		UserID:         uint(userId),
+		Username:       token.Username,
+		ExpirationDate: token.ExpirationDate,
+	}
+	result := ph.db.WithContext(ctx).Create(&refreshToken)
+	err = ph.LogAndReturnError(loger, result, "create", "refresh token")
+	return &refreshToken, err
+}
+
+func (ph PostgresHandler) GetRefreshToken(ctx context.Context, hash string) (RefreshTokenDTO, error) {
+	refreshToken := new(RefreshToken)
+	result := ph.db.WithContext(ctx).Where("hash = ?", hash).First(refreshToken)
+	err := ph.LogAndReturnError(loger, result, "get", "refresh token")
+	return refreshToken, err
+}
+
+func (ph PostgresHandler) UseRefreshToken(ctx context.Context, hash string) error {
+	// The used = false condition makes the rotation atomic between concurrent requests
+	result := ph.db.WithContext(ctx).Model(&RefreshToken{}).Where("hash = ? AND used = ?", hash, false).Update("used", true)
+	if err := ph.LogAndReturnError(loger, result, "use", "refresh token"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
+func (ph PostgresHandler) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	result := ph.db.WithContext(ctx).Model(&RefreshToken{}).Where("family = ?", family).Update("revoked", true)
+	return ph.LogAndReturnError(loger, result, "revoke", "refresh token family")
+}
+
+func (ph PostgresHandler) DeleteRefreshTokens(ctx context.Context, userID string) error {
+	userId, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return err
+	}
+	result := ph.db.WithContext(ctx).Where("user_id = ?", userId).Delete(&RefreshToken{})
+	return ph.LogAndReturnError(loger, result, "delete", "refresh tokens")
+}
+
+func (ph PostgresHandler) CreateIdentity(ctx context.Context, identity *IdentityRequest) (IdentityDTO, error) {
+	userId, err := strconv.ParseUint(identity.UserID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return nil, err
+	}
+	i := Identity{
+		Issuer:   identity.Issuer,
+		Subject:  identity.Subject,
+		UserID:   uint(userId),
+		Username: identity.Username,
+	}
+	result := ph.db.WithContext(ctx).Create(&i)
+	err = ph.LogAndReturnError(loger, result, "create", "identity")
+	return &i, err
+}
+
+func (ph PostgresHandler) GetIdentity(ctx context.Context, issuer string, subject string) (IdentityDTO, error) {
+	identity := new(Identity)
+	result := ph.db.WithContext(ctx).Where("issuer = ? AND subject = ?", issuer, subject).First(identity)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrIdentityNotFound
+	}
+	err := ph.LogAndReturnError(loger, result, "get", "identity")
+	return identity, err
+}
+
+func (ph PostgresHandler) CreateApiKey(ctx context.Context, key *ApiKeyRequest) (ApiKeyDTO, error) {
+	userId, err := strconv.ParseUint(key.UserID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return nil, err
+	}
+	apiKey := ApiKey{
+		Name:           key.Name,
+		Prefix:         key.Prefix,
+		Hash:           key.Hash,
+		UserID:         uint(userId),
+		Username:       key.Username,
+		Scopes:         key.Scopes,
+		ExpirationDate: key.ExpirationDate,
+	}
+	result := ph.db.WithContext(ctx).Create(&apiKey)
+	err = ph.LogAndReturnError(loger, result, "create", "API key")
+	return &apiKey, err
+}
+
+func (ph PostgresHandler) GetApiKeys(ctx context.Context, userID string) ([]ApiKeyDTO, error) {
+	userId, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return nil, err
+	}
+	var keys []ApiKey
+	result := ph.db.WithContext(ctx).Where("user_id = ?", userId).Order("created_at desc").Find(&keys)
+	if err := ph.LogAndReturnError(loger, result, "get", "API keys"); err != nil {
+		return nil, err
+	}
+	apiKeys := make([]ApiKeyDTO, len(keys))
+	for i := range keys {
+		apiKeys[i] = &keys[i]
+	}
+	return apiKeys, nil
+}
+
+func (ph PostgresHandler) GetApiKey(ctx context.Context, hash string) (ApiKeyDTO, error) {
+	apiKey := new(ApiKey)
+	result := ph.db.WithContext(ctx).Where("hash = ?", hash).First(apiKey)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrApiKeyNotFound
+	}
+	err := ph.LogAndReturnError(loger, result, "get", "API key")
+	return apiKey, err
+}
+
+func (ph PostgresHandler) TouchApiKey(ctx context.Context, prefix string, lastUsedAt time.Time) error {
+	result := ph.db.WithContext(ctx).Model(&ApiKey{}).Where("prefix = ?", prefix).Update("last_used_at", lastUsedAt)
+	return ph.LogAndReturnError(loger, result, "touch", "API key")
+}
+
+func (ph PostgresHandler) RevokeApiKey(ctx context.Context, userID string, prefix string) error {
+	userId, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return err
+	}
+	result := ph.db.WithContext(ctx).Where("user_id = ? AND prefix = ?", userId, prefix).Delete(&ApiKey{})
+	if err := ph.LogAndReturnError(loger, result, "revoke", "API key"); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
+
+func (ph PostgresHandler) CreatePasswordResetToken(ctx context.Context, token *PasswordResetTokenRequest) (PasswordResetTokenDTO, error) {
+	userId, err := strconv.ParseUint(token.UserID, 10, 64)
+	if err != nil {
+		loger.WithError(err).Error("Error when trying to convert userID to uint")
+		return nil, err
+	}
+	resetToken := PasswordResetToken{
+		Hash:           token.Hash,
+		UserID:         uint(userId),
+		Username:       token.Username,
+		ExpirationDate: token.ExpirationDate,
+	}
+	result := ph.db.WithContext(ctx).Create(&resetToken)
+	err = ph.LogAndReturnError(loger, result, "create", "password reset token")
+	return &resetToken, err
+}
+
+func (ph PostgresHandler) GetPasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error) {
+	resetToken := new(PasswordResetToken)
+	result := ph.db.WithContext(ctx).Where("hash = ? AND used = ?", hash, false).First(resetToken)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrPasswordResetTokenInvalid
+	}
+	if err := ph.LogAndReturnError(loger, result, "get", "password reset token"); err != nil {
+		return nil, err
+	}
+	return resetToken, nil
+}
+
+func (ph PostgresHandler) UsePasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error) {
+	result := ph.db.WithContext(ctx).Model(&PasswordResetToken{}).Where("hash = ? AND used = ?", hash, false).Update("used", true)
+	if err := ph.LogAndReturnError(loger, result, "use", "password reset token"); err != nil {
+		return nil, err
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrPasswordResetTokenInvalid
+	}
+	resetToken := new(PasswordResetToken)
+	result = ph.db.WithContext(ctx).Where("hash = ?", hash).First(resetToken)
+	err := ph.LogAndReturnError(loger, result, "get", "password reset token")
+	return resetToken, err
+}
+
+func (ph PostgresHandler) CreateAuthEvent(ctx context.Context, event *AuthEventRequest) error {
+	authEvent := AuthEvent{
+		Type:      event.Type,
+		UserID:    event.UserID,
+		UserUUID:  event.UserUUID,
+		Username:  event.Username,
+		IP:        event.IP,
+		UserAgent: event.UserAgent,
+		TraceID:   event.TraceID,
+	}
+	result := ph.db.WithContext(ctx).Create(&authEvent)
+	return ph.LogAndReturnError(loger, result, "create", "auth event")
+}
+
+func (ph PostgresHandler) GetAuthEvents(ctx context.Context, filter *AuthEventFilter) ([]AuthEventDTO, error) {
+	query := ph.db.WithContext(ctx).Model(&AuthEvent{})
+	for column, value := range map[string]string{
+		"type":      filter.Type,
+		"user_id":   filter.UserID,
+		"user_uuid": filter.UserUUID,
+		"username":  filter.Username,
+		"ip":        filter.IP,
+	} {
+		if value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	var events []AuthEvent
+	result := query.Order("created_at desc").Find(&events)
+	if err := ph.LogAndReturnError(loger, result, "get", "auth events"); err != nil {
+		return nil, err
+	}
+	authEvents := make([]AuthEventDTO, len(events))
+	for i := range events {
+		authEvents[i] = &events[i]
+	}
+	return authEvents, nil
+}
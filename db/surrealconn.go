@@ -0,0 +1,243 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"gateway/configuration"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	surrealdb "github.com/surrealdb/surrealdb.go"
+)
+
+// ErrSurrealDBNotConnected is the readiness of the connection until it's opened
+var ErrSurrealDBNotConnected = errors.New("not connected to SurrealDB")
+
+// surrealConn supervises the connection to SurrealDB. It's checked every interval, a lost connection is reopened
+// with an exponential backoff and the session signs in again before its token expires. The queries read the
+// current connection, the ones running on a lost connection fail.
+type surrealConn struct {
+	mu      sync.RWMutex
+	db      *surrealdb.DB
+	err     error
+	renewAt time.Time
+
+	interval   time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	dial       func() (*surrealdb.DB, error)
+	signIn     func(db *surrealdb.DB) (time.Time, error)
+	check      func(db *surrealdb.DB) error
+	after      func(d time.Duration) <-chan time.Time
+	now        func() time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSurrealConn(conf *configuration.Configuration) *surrealConn {
+	return &surrealConn{
+		err:        ErrSurrealDBNotConnected,
+		interval:   conf.SurrealDBCheck,
+		backoff:    conf.SurrealDBBackoff,
+		maxBackoff: conf.SurrealDBMaxBackoff,
+		dial: func() (*surrealdb.DB, error) {
+			return surrealdb.New(conf.SurrealDBURL)
+		},
+		signIn: func(db *surrealdb.DB) (time.Time, error) {
+			return signInSurreal(conf, db)
+		},
+		check: func(db *surrealdb.DB) error {
+			_, err := db.Version()
+			return err
+		},
+		after: time.After,
+		now:   time.Now,
+	}
+}
+
+// open connects once and starts the supervision, the gateway doesn't start without the database
+func (sc *surrealConn) open() error {
+	db, err := sc.connect()
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	sc.db = db
+	sc.err = nil
+	sc.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.cancel = cancel
+	sc.done = make(chan struct{})
+	go sc.supervise(ctx)
+	return nil
+}
+
+// close stops the supervision and closes the connection
+func (sc *surrealConn) close() error {
+	if sc.cancel != nil {
+		sc.cancel()
+		<-sc.done
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	db := sc.db
+	sc.db = nil
+	sc.err = ErrSurrealDBNotConnected
+	if db == nil {
+		return nil
+	}
+	return db.Close()
+}
+
+// get returns the current connection
+func (sc *surrealConn) get() *surrealdb.DB {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.db
+}
+
+// ready returns nil if the connection was working at the last check, or why it isn't
+func (sc *surrealConn) ready() error {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.err
+}
+
+// connect opens a new connection and signs in
+func (sc *surrealConn) connect() (*surrealdb.DB, error) {
+	db, err := sc.dial()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := sc.signIn(db)
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return nil, err
+	}
+	sc.setExpiration(expiresAt)
+	return db, nil
+}
+
+// setExpiration schedules the renewal of the token before it expires, with a margin for the sign in
+func (sc *surrealConn) setExpiration(expiresAt time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if expiresAt.IsZero() {
+		sc.renewAt = time.Time{}
+		return
+	}
+	margin := min(time.Minute, expiresAt.Sub(sc.now())/2)
+	sc.renewAt = expiresAt.Add(-margin)
+}
+
+func (sc *surrealConn) getRenewAt() time.Time {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.renewAt
+}
+
+func (sc *surrealConn) supervise(ctx context.Context) {
+	defer close(sc.done)
+	for {
+		wait := sc.interval
+		renewAt := sc.getRenewAt()
+		if !renewAt.IsZero() {
+			wait = max(0, min(wait, renewAt.Sub(sc.now())))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-sc.after(wait):
+		}
+
+		db := sc.get()
+		if !renewAt.IsZero() && !sc.now().Before(renewAt) {
+			expiresAt, err := sc.signIn(db)
+			if err == nil {
+				sc.setExpiration(expiresAt)
+				logger.Debug("Signed in to SurrealDB again before the token expires")
+				continue
+			}
+			logger.WithError(err).Warn("Failed to sign in to SurrealDB again, reconnecting")
+			sc.reconnect(ctx, err)
+			continue
+		}
+		if err := sc.check(db); err != nil {
+			logger.WithError(err).Warn("Lost the connection to SurrealDB, reconnecting")
+			sc.reconnect(ctx, err)
+		}
+	}
+}
+
+// reconnect replaces the connection, it retries with an exponential backoff until it succeeds or ctx is done
+func (sc *surrealConn) reconnect(ctx context.Context, cause error) {
+	sc.mu.Lock()
+	sc.err = cause
+	sc.mu.Unlock()
+
+	backoff := sc.backoff
+	for attempt := 1; ; attempt++ {
+		db, err := sc.connect()
+		if err == nil {
+			sc.mu.Lock()
+			previous := sc.db
+			sc.db = db
+			sc.err = nil
+			sc.mu.Unlock()
+			if previous != nil {
+				// The lost connection waits to be closed to release its reader
+				previous.Close()
+			}
+			logger.WithField("attempt", attempt).Info("Reconnected to SurrealDB")
+			return
+		}
+		sc.mu.Lock()
+		sc.err = err
+		sc.mu.Unlock()
+		logger.WithError(err).WithField("attempt", attempt).WithField("backoff", backoff).Warn("Failed to reconnect to SurrealDB")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-sc.after(backoff):
+		}
+		backoff = min(backoff*2, sc.maxBackoff)
+	}
+}
+
+// signInSurreal selects the namespace and the database and signs in, it returns when the token expires
+func signInSurreal(conf *configuration.Configuration, db *surrealdb.DB) (time.Time, error) {
+	if err := db.Use(conf.SurrealDBNamespace, conf.SurrealDBDatabase); err != nil {
+		return time.Time{}, err
+	}
+	token, err := db.SignIn(&surrealdb.Auth{
+		Username: conf.SurrealDBUsername,
+		Password: conf.SurrealDBPassword,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := db.Authenticate(token); err != nil {
+		return time.Time{}, err
+	}
+	return tokenExpiration(token), nil
+}
+
+// tokenExpiration reads the exp claim of the token signed by SurrealDB, it returns the zero time if there's none
+func tokenExpiration(token string) time.Time {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		logger.WithError(err).Debug("Failed to read the expiration of the SurrealDB token")
+		return time.Time{}
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return time.Time{}
+	}
+	return exp.Time
+}
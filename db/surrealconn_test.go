@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	surrealdb "github.com/surrealdb/surrealdb.go"
+)
+
+// newFakeSurrealConn returns a connection whose clock moves forward on every wait instead of sleeping
+func newFakeSurrealConn() (*surrealConn, *[]time.Duration) {
+	now := time.Now()
+	waits := []time.Duration{}
+	sc := &surrealConn{
+		err:        ErrSurrealDBNotConnected,
+		interval:   10 * time.Second,
+		backoff:    time.Second,
+		maxBackoff: 5 * time.Second,
+		dial:       func() (*surrealdb.DB, error) { return nil, nil },
+		signIn:     func(db *surrealdb.DB) (time.Time, error) { return time.Time{}, nil },
+		check:      func(db *surrealdb.DB) error { return nil },
+		now:        func() time.Time { return now },
+		done:       make(chan struct{}),
+	}
+	sc.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		now = now.Add(d)
+		c := make(chan time.Time, 1)
+		c <- now
+		return c
+	}
+	return sc, &waits
+}
+
+func TestSurrealConn(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, sc *surrealConn, waits *[]time.Duration)
+	}{
+		{
+			name: "Reconnect with an exponential backoff",
+			test: func(t *testing.T, sc *surrealConn, waits *[]time.Duration) {
+				failures := 4
+				sc.dial = func() (*surrealdb.DB, error) {
+					if failures > 0 {
+						failures--
+						if sc.ready() == nil {
+							t.Errorf("Expected the gateway not to be ready while disconnected")
+						}
+						return nil, errRefused
+					}
+					return nil, nil
+				}
+				sc.reconnect(context.Background(), errors.New("connection lost"))
+
+				expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+				if len(*waits) != len(expected) {
+					t.Fatalf("Expected %v waits, got %v", len(expected), *waits)
+				}
+				for i, wait := range *waits {
+					if wait != expected[i] {
+						t.Errorf("Expected the wait %v to be %v, got %v", i, expected[i], wait)
+					}
+				}
+				if err := sc.ready(); err != nil {
+					t.Fatalf("Expected the gateway to be ready once reconnected, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Token renewed before it expires",
+			test: func(t *testing.T, sc *surrealConn, waits *[]time.Duration) {
+				sc.err = nil
+				sc.setExpiration(sc.now().Add(30 * time.Second))
+				ctx, cancel := context.WithCancel(context.Background())
+				signIns := 0
+				var expiresAt time.Time
+				sc.signIn = func(db *surrealdb.DB) (time.Time, error) {
+					signIns++
+					cancel()
+					expiresAt = sc.now().Add(time.Hour)
+					return expiresAt, nil
+				}
+				sc.supervise(ctx)
+
+				if signIns != 1 {
+					t.Fatalf("Expected a single sign in, got %v", signIns)
+				}
+				// Checked after the interval, then signed in half-way to the expiration
+				if len(*waits) < 2 || (*waits)[0] != 10*time.Second || (*waits)[1] != 5*time.Second {
+					t.Fatalf("Expected to wait 10s then 5s, got %v", *waits)
+				}
+				if renewAt := sc.getRenewAt(); !renewAt.Equal(expiresAt.Add(-time.Minute)) {
+					t.Fatalf("Expected the new token to be renewed a minute before it expires, got %v", expiresAt.Sub(renewAt))
+				}
+			},
+		},
+		{
+			name: "Failed check reconnects",
+			test: func(t *testing.T, sc *surrealConn, waits *[]time.Duration) {
+				sc.err = nil
+				ctx, cancel := context.WithCancel(context.Background())
+				checks := 0
+				sc.check = func(db *surrealdb.DB) error {
+					checks++
+					if checks > 1 {
+						return nil
+					}
+					return errRefused
+				}
+				dials := 0
+				sc.dial = func() (*surrealdb.DB, error) {
+					dials++
+					cancel()
+					return nil, nil
+				}
+				sc.supervise(ctx)
+
+				if dials != 1 || sc.ready() != nil {
+					t.Fatalf("Expected a reconnection, got %v dials and %v", dials, sc.ready())
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, waits := newFakeSurrealConn()
+			tt.test(t, sc, waits)
+		})
+	}
+}
+
+var errRefused = errors.New("connection refused")
@@ -1,8 +1,13 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gateway/configuration"
+	"gateway/envelope"
+	"gateway/utils"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -16,27 +21,46 @@ var logger = logrus.WithFields(logrus.Fields{
 })
 
 type SurrealDBHandler struct {
-	db   *surrealdb.DB
-	conf *configuration.Configuration
+	conn     *surrealConn
+	conf     *configuration.Configuration
+	envelope *envelope.Envelope
 }
 
 func NewSurrealDBHandler(conf *configuration.Configuration) (SurrealDBHandler, error) {
 
-	db, err := surrealdb.New(conf.SurrealDBURL)
+	env, err := envelope.New(conf)
 	if err != nil {
 		return SurrealDBHandler{}, err
 	}
 
-	err = connectAndPing(conf, db)
-	if err != nil {
+	conn := newSurrealConn(conf)
+	if err := conn.open(); err != nil {
 		return SurrealDBHandler{}, err
 	}
 
 	logger.Info("Connected to SurrealDB with url ", conf.SurrealDBURL)
-	return SurrealDBHandler{
-		db:   db,
-		conf: conf,
-	}, nil
+	sdh := SurrealDBHandler{
+		conn:     conn,
+		conf:     conf,
+		envelope: env,
+	}
+	if conf.SurrealDBMigrate {
+		migrator, err := sdh.Migrator()
+		if err != nil {
+			conn.close()
+			return SurrealDBHandler{}, err
+		}
+		if _, err := migrator.Up(); err != nil {
+			conn.close()
+			return SurrealDBHandler{}, err
+		}
+	}
+	return sdh, nil
+}
+
+// Close stops the supervision of the connection and closes it
+func (sdh SurrealDBHandler) Close() error {
+	return sdh.conn.close()
 }
 
 type SurrealUser struct {
@@ -48,6 +72,13 @@ type SurrealUser struct {
 	FirstName     string           `json:"firstName"`
 	LastName      string           `json:"lastName"`
 	EncryptionKey string           `json:"encryptionKey,omitempty"`
+	EmailVerified bool             `json:"emailVerified"`
+	TOTPSecret    string           `json:"totpSecret,omitempty"`
+	TOTPEnabled   bool             `json:"totpEnabled"`
+	TOTPLastStep  int64            `json:"totpLastStep,omitempty"`
+	RecoveryCodes []string         `json:"recoveryCodes,omitempty"`
+	Role          string           `json:"role"`
+	DeletedAt     string           `json:"deletedAt,omitempty"`
 }
 
 func (su *SurrealUser) GetId() string {
@@ -83,6 +114,26 @@ func (su *SurrealUser) GetEncryptionKey() string {
 	return su.EncryptionKey
 }
 
+func (su *SurrealUser) IsEmailVerified() bool {
+	return su.EmailVerified
+}
+
+func (su *SurrealUser) GetTOTPSecret() string {
+	return su.TOTPSecret
+}
+
+func (su *SurrealUser) IsTOTPEnabled() bool {
+	return su.TOTPEnabled
+}
+
+// GetRole returns DefaultRole for the users created before the roles
+func (su *SurrealUser) GetRole() string {
+	if su.Role == "" {
+		return DefaultRole
+	}
+	return su.Role
+}
+
 type SurrealEncryptionKey struct {
 	ID        *models.RecordID `json:"id,omitempty"`
 	SecretKey string
@@ -90,15 +141,23 @@ type SurrealEncryptionKey struct {
 
 type SurrealToken struct {
 	ID             *models.RecordID `json:"id,omitempty"`
-	Value          string
-	ExpirationDate string
-	//UserId         *models.RecordID `json:"userId,omitempty"`
+	Value          string           `json:"value"`
+	ExpirationDate string           `json:"expirationDate"`
+	UserID         string           `json:"userId"`
+	UserAgent      string           `json:"userAgent"`
+	IP             string           `json:"ip"`
+	CreatedAt      string           `json:"createdAt"`
+	LastSeenAt     string           `json:"lastSeenAt"`
 }
 
 func (st *SurrealToken) GetId() string {
 	return st.ID.String()
 }
 
+func (st *SurrealToken) GetSessionID() string {
+	return fmt.Sprintf("%v", st.ID.ID)
+}
+
 func (st *SurrealToken) GetValue() string {
 	return st.Value
 }
@@ -109,7 +168,25 @@ func (st *SurrealToken) GetExpirationDate() time.Time {
 }
 
 func (st *SurrealToken) GetUserID() string {
-	return st.ID.String()
+	return st.UserID
+}
+
+func (st *SurrealToken) GetUserAgent() string {
+	return st.UserAgent
+}
+
+func (st *SurrealToken) GetIP() string {
+	return st.IP
+}
+
+func (st *SurrealToken) GetCreatedAt() time.Time {
+	t, _ := time.Parse(time.RFC3339, st.CreatedAt)
+	return t
+}
+
+func (st *SurrealToken) GetLastSeenAt() time.Time {
+	t, _ := time.Parse(time.RFC3339, st.LastSeenAt)
+	return t
 }
 
 func (sdh SurrealDBHandler) NewUserDTO(email string, username string, password string, firstName string, lastName string, encryptionKey string) SurrealUser {
@@ -125,52 +202,110 @@ func (sdh SurrealDBHandler) NewUserDTO(email string, username string, password s
 	}
 }
 
-func (sdh SurrealDBHandler) Ping() error {
-	return connectAndPing(sdh.conf, sdh.db)
+// Ping returns the state of the connection at its last check, it doesn't query SurrealDB
+func (sdh SurrealDBHandler) Ping(ctx context.Context) error {
+	return sdh.conn.ready()
 }
 
-func (sdh SurrealDBHandler) CreateUser(userRequest *UserRequest) (UserDTO, error) {
+func (sdh SurrealDBHandler) CreateUser(ctx context.Context, userRequest *UserRequest) (UserDTO, error) {
 	// r := models.NewRecordID("users", userRequest.Username)
 	uuid, err := uuid.NewV4()
 	if err != nil {
 		return nil, err
 	}
+	dataKey := userRequest.EncryptionKey
+	if dataKey == "" {
+		if dataKey, err = utils.GenerateSecretKey(); err != nil {
+			return nil, err
+		}
+	}
+	wrappedKey, err := sdh.envelope.Wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	firstName, err := envelope.EncryptField(userRequest.FirstName, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	lastName, err := envelope.EncryptField(userRequest.LastName, dataKey)
+	if err != nil {
+		return nil, err
+	}
 	u := &SurrealUser{
-		ID:        &models.RecordID{ID: userRequest.Username},
-		UUID:      &models.UUID{UUID: uuid},
-		Username:  userRequest.Username,
-		Email:     userRequest.Email,
-		Password:  userRequest.Password,
-		FirstName: userRequest.FirstName,
-		LastName:  userRequest.LastName,
-		//EncryptionKey: userRequest.EncryptionKey,
+		ID:            &models.RecordID{ID: userRequest.Username},
+		UUID:          &models.UUID{UUID: uuid},
+		Username:      userRequest.Username,
+		Email:         userRequest.Email,
+		Password:      userRequest.Password,
+		FirstName:     firstName,
+		LastName:      lastName,
+		EncryptionKey: wrappedKey,
+		Role:          userRequest.Role,
+	}
+	if u.Role == "" {
+		u.Role = DefaultRole
 	}
 
-	user, err := surrealdb.Select[SurrealUser](sdh.db, *u.ID)
+	// The record ID is the username and the migrations make the email unique
+	user, err := surrealCall(ctx, func() (*SurrealUser, error) {
+		return surrealdb.Create[SurrealUser](sdh.conn.get(), models.Table("users"), u)
+	})
 	if err != nil {
-		panic(err)
-	}
-	logger.Infof("User: %v", user)
-	// TODO Check here why the select doesn't work
-	if user.ID != nil {
-		return nil, fmt.Errorf("user already exists")
+		if strings.Contains(err.Error(), "already") {
+			return nil, ErrUserExists
+		}
+		logger.WithError(err).WithField("username", userRequest.Username).Error("Error when trying to create the user")
+		return nil, err
 	}
-	user, err = surrealdb.Create[SurrealUser](sdh.db, models.Table("users"), u)
+	return user, sdh.decryptUser(user)
+}
+
+// decryptUser unwraps the data key of the user and decrypts its fields in place
+func (sdh SurrealDBHandler) decryptUser(user *SurrealUser) error {
+	dataKey, err := sdh.envelope.Unwrap(user.EncryptionKey)
 	if err != nil {
-		return nil, fmt.Errorf("user insertion failed")
+		logger.WithError(err).WithField("username", user.Username).Error("Error when trying to unwrap the data key")
+		return err
+	}
+	user.EncryptionKey = dataKey
+	if user.FirstName, err = envelope.DecryptField(user.FirstName, dataKey); err != nil {
+		return err
+	}
+	if user.LastName, err = envelope.DecryptField(user.LastName, dataKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// decryptUsers decrypts the users of a query, it returns ErrUserNotFound if there's none
+func (sdh SurrealDBHandler) decryptUsers(users []SurrealUser) ([]UserDTO, error) {
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	dtos := make([]UserDTO, len(users))
+	for i := range users {
+		if err := sdh.decryptUser(&users[i]); err != nil {
+			return nil, err
+		}
+		dtos[i] = &users[i]
 	}
-	return user, nil
+	return dtos, nil
 }
 
-func (sdh SurrealDBHandler) GetUsername(username string) (UserDTO, error) {
+func (sdh SurrealDBHandler) GetUsername(ctx context.Context, username string) (UserDTO, error) {
 	r := models.NewRecordID("users", username)
-	user, err := surrealdb.Select[SurrealUser, models.RecordID](sdh.db, r)
+	user, err := surrealCall(ctx, func() (*SurrealUser, error) {
+		return surrealdb.Select[SurrealUser, models.RecordID](sdh.conn.get(), r)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return user, nil
+	if user == nil || user.ID == nil || user.DeletedAt != "" {
+		return nil, ErrUserNotFound
+	}
+	return user, sdh.decryptUser(user)
 	// vars := map[string]interface{}{"username": username}
-	// res, err := surrealdb.Query[[]SurrealUser](sdh.db, "SELECT * FROM users WHERE username = gridexx", vars)
+	// res, err := surrealdb.Query[[]SurrealUser](sdh.conn.get(), "SELECT * FROM users WHERE username = gridexx", vars)
 	// if err != nil {
 	// 	return nil, err
 	// }
@@ -187,64 +322,991 @@ func (sdh SurrealDBHandler) GetUsername(username string) (UserDTO, error) {
 	// return nil, err
 }
 
-func (sdh SurrealDBHandler) UpsertToken(token *TokenRequest) (TokenDTO, error) {
+func (sdh SurrealDBHandler) GetUserByEmail(ctx context.Context, email string) (UserDTO, error) {
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"SELECT * FROM users WHERE email = $email AND deletedAt = NONE LIMIT 1",
+		map[string]interface{}{"email": email},
+	)
+	if err != nil {
+		return nil, err
+	}
+	dtos, err := sdh.decryptUsers(users)
+	if err != nil {
+		return nil, err
+	}
+	return dtos[0], nil
+}
+
+func (sdh SurrealDBHandler) UpdateUser(ctx context.Context, userID string, update *UserUpdateRequest) (UserDTO, error) {
+	record := models.NewRecordID("users", userID)
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(), "SELECT * FROM $record", map[string]interface{}{"record": record})
+	if err != nil {
+		return nil, err
+	}
+	current, err := sdh.decryptUsers(users)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := current[0].GetEncryptionKey()
+
+	vars := map[string]interface{}{"record": record}
+	// The SET clauses run in order, the verification is reset before the email changes
+	var sets []string
+	if update.Email != nil {
+		sets = append(sets, "emailVerified = IF email = $email THEN emailVerified ELSE false END", "email = $email")
+		vars["email"] = *update.Email
+	}
+	if update.FirstName != nil {
+		if vars["firstName"], err = envelope.EncryptField(*update.FirstName, dataKey); err != nil {
+			return nil, err
+		}
+		sets = append(sets, "firstName = $firstName")
+	}
+	if update.LastName != nil {
+		if vars["lastName"], err = envelope.EncryptField(*update.LastName, dataKey); err != nil {
+			return nil, err
+		}
+		sets = append(sets, "lastName = $lastName")
+	}
+	if len(sets) == 0 {
+		return current[0], nil
+	}
+	users, err = querySurreal[SurrealUser](ctx, sdh.conn.get(), "UPDATE $record SET "+strings.Join(sets, ", ")+" RETURN AFTER", vars)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := sdh.decryptUsers(users)
+	if err != nil {
+		return nil, err
+	}
+	return updated[0], nil
+}
+
+func (sdh SurrealDBHandler) DeleteUser(ctx context.Context, userID string) error {
+	// The dates are stored in UTC so GetDeletedUsers can compare them
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET deletedAt = $now WHERE deletedAt = NONE RETURN AFTER",
+		map[string]interface{}{
+			"record": models.NewRecordID("users", userID),
+			"now":    time.Now().UTC().Format(time.RFC3339),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) RestoreUser(ctx context.Context, userID string) error {
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET deletedAt = NONE WHERE deletedAt != NONE RETURN AFTER",
+		map[string]interface{}{"record": models.NewRecordID("users", userID)},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) GetDeletedUsers(ctx context.Context, before time.Time) ([]UserDTO, error) {
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"SELECT * FROM users WHERE deletedAt != NONE AND deletedAt < $before",
+		map[string]interface{}{"before": before.UTC().Format(time.RFC3339)},
+	)
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return sdh.decryptUsers(users)
+}
+
+func (sdh SurrealDBHandler) RotateEncryptionKeys(ctx context.Context) (int, error) {
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(), "SELECT * FROM users", nil)
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for i := range users {
+		user := &users[i]
+		done, err := sdh.rotateUser(ctx, user)
+		// The user changed since it was read, it's read again to not overwrite the change
+		for attempt := 1; errors.Is(err, errUserChanged) && attempt < rotateAttempts; attempt++ {
+			var reloaded []SurrealUser
+			reloaded, err = querySurreal[SurrealUser](ctx, sdh.conn.get(), "SELECT * FROM $record", map[string]interface{}{"record": users[i].ID})
+			if err != nil {
+				return rotated, err
+			}
+			if len(reloaded) == 0 {
+				break
+			}
+			user = &reloaded[0]
+			done, err = sdh.rotateUser(ctx, user)
+		}
+		if errors.Is(err, errUserChanged) {
+			logger.WithField("username", user.Username).Warn("The user keeps changing, it's rotated by the next start")
+			continue
+		}
+		if err != nil {
+			return rotated, err
+		}
+		if done {
+			rotated++
+		}
+	}
+	return rotated, nil
+}
+
+// rotateUser rewraps the data key of the user and encrypts its plaintext fields, it tells if the user was updated.
+// It returns errUserChanged if the fields or the key aren't the ones read anymore.
+func (sdh SurrealDBHandler) rotateUser(ctx context.Context, user *SurrealUser) (bool, error) {
+	encrypted := (user.FirstName == "" || envelope.IsEncrypted(user.FirstName)) &&
+		(user.LastName == "" || envelope.IsEncrypted(user.LastName))
+	if user.EncryptionKey != "" && !sdh.envelope.NeedsRewrap(user.EncryptionKey) && encrypted {
+		return false, nil
+	}
+
+	// The users created before the data keys get one
+	dataKey, err := sdh.envelope.Unwrap(user.EncryptionKey)
+	if err != nil {
+		return false, err
+	}
+	if dataKey == "" {
+		if dataKey, err = utils.GenerateSecretKey(); err != nil {
+			return false, err
+		}
+	}
+	vars := map[string]interface{}{
+		"record":       user.ID,
+		"oldFirstName": user.FirstName,
+		"oldLastName":  user.LastName,
+	}
+	if vars["key"], err = sdh.envelope.Wrap(dataKey); err != nil {
+		return false, err
+	}
+	if vars["firstName"], err = encryptPlaintextField(user.FirstName, dataKey); err != nil {
+		return false, err
+	}
+	if vars["lastName"], err = encryptPlaintextField(user.LastName, dataKey); err != nil {
+		return false, err
+	}
+	// The key is omitted when empty, it's NONE in the record
+	oldKey := "encryptionKey = NONE"
+	if user.EncryptionKey != "" {
+		oldKey = "encryptionKey = $oldKey"
+		vars["oldKey"] = user.EncryptionKey
+	}
+	updated, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET encryptionKey = $key, firstName = $firstName, lastName = $lastName "+
+			"WHERE "+oldKey+" AND firstName = $oldFirstName AND lastName = $oldLastName RETURN AFTER",
+		vars,
+	)
+	if err != nil {
+		return false, err
+	}
+	if len(updated) == 0 {
+		return false, errUserChanged
+	}
+	return true, nil
+}
+
+func (sdh SurrealDBHandler) PurgeUser(ctx context.Context, userID string) error {
+	record := models.NewRecordID("users", userID)
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"SELECT * FROM $record WHERE deletedAt != NONE",
+		map[string]interface{}{"record": record},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrUserNotFound
+	}
+	// The user is deleted last so a failed purge is retried by the next run
+	for _, table := range []string{"tokens", "refresh_tokens", "password_resets", "identities", "api_keys"} {
+		_, err := querySurreal[map[string]interface{}](ctx, sdh.conn.get(),
+			"DELETE type::table($table) WHERE userId = $userId",
+			map[string]interface{}{"table": table, "userId": userID},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	// The username is the ID of the user, the events are keyed by the UUID that isn't given to the next user
+	_, err = querySurreal[map[string]interface{}](ctx, sdh.conn.get(),
+		"DELETE auth_events WHERE userUuid = $userUuid",
+		map[string]interface{}{"userUuid": users[0].GetUUID()},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = querySurreal[SurrealUser](ctx, sdh.conn.get(), "DELETE $record", map[string]interface{}{"record": record})
+	return err
+}
+
+func (sdh SurrealDBHandler) UpdatePassword(ctx context.Context, userID string, password string) error {
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET password = $password RETURN AFTER",
+		map[string]interface{}{
+			"record":   models.NewRecordID("users", userID),
+			"password": password,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) VerifyEmail(ctx context.Context, userID string, email string) error {
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET emailVerified = true WHERE email = $email RETURN AFTER",
+		map[string]interface{}{
+			"record": models.NewRecordID("users", userID),
+			"email":  email,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrEmailMismatch
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) UpdateRole(ctx context.Context, userID string, role string) error {
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET role = $role RETURN AFTER",
+		map[string]interface{}{
+			"record": models.NewRecordID("users", userID),
+			"role":   role,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) UpdateTOTP(ctx context.Context, userID string, totp *TOTPRequest) error {
+	codes := totp.RecoveryCodes
+	if codes == nil {
+		codes = []string{}
+	}
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET totpSecret = $secret, totpEnabled = $enabled, recoveryCodes = $codes RETURN AFTER",
+		map[string]interface{}{
+			"record":  models.NewRecordID("users", userID),
+			"secret":  totp.Secret,
+			"enabled": totp.Enabled,
+			"codes":   codes,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) UseRecoveryCode(ctx context.Context, userID string, hash string) error {
+	// The CONTAINS condition makes the removal atomic, a code can't be used twice
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET recoveryCodes -= $hash WHERE recoveryCodes CONTAINS $hash RETURN AFTER",
+		map[string]interface{}{
+			"record": models.NewRecordID("users", userID),
+			"hash":   hash,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrRecoveryCodeInvalid
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	// The WHERE condition makes the update atomic, a step can't be accepted twice
+	users, err := querySurreal[SurrealUser](ctx, sdh.conn.get(),
+		"UPDATE $record SET totpLastStep = $step WHERE (totpLastStep OR 0) < $step RETURN AFTER",
+		map[string]interface{}{
+			"record": models.NewRecordID("users", userID),
+			"step":   step,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) UpsertToken(ctx context.Context, token *TokenRequest) (TokenDTO, error) {
+	r := models.NewRecordID("tokens", token.SessionID)
+	now := surrealTime(time.Now())
 	s := SurrealToken{
-		ID:             &models.RecordID{ID: token.UserID},
 		Value:          token.Value,
-		ExpirationDate: token.ExpirationDate.Format(time.RFC3339),
+		ExpirationDate: token.ExpirationDate.UTC().Format(time.RFC3339),
+		UserID:         token.UserID,
+		UserAgent:      token.UserAgent,
+		IP:             token.IP,
+		CreatedAt:      now,
+		LastSeenAt:     now,
+	}
+	// Keep the device information of the session when only the token is rotated
+	existing, err := surrealCall(ctx, func() (*SurrealToken, error) {
+		return surrealdb.Select[SurrealToken, models.RecordID](sdh.conn.get(), r)
+	})
+	if err == nil && existing != nil && existing.ID != nil {
+		s.UserAgent = existing.UserAgent
+		s.IP = existing.IP
+		s.CreatedAt = existing.CreatedAt
 	}
-	res, err := surrealdb.Upsert[SurrealToken](sdh.db, models.Table("tokens"), s)
+	res, err := surrealCall(ctx, func() (*SurrealToken, error) {
+		return surrealdb.Upsert[SurrealToken](sdh.conn.get(), r, s)
+	})
 	return res, err
 }
-func (sdh SurrealDBHandler) GetTokenUser(value string, userID string) (TokenDTO, error) {
-	r := models.NewRecordID("tokens", userID)
-	token, err := surrealdb.Select[SurrealToken, models.RecordID](sdh.db, r)
+
+func (sdh SurrealDBHandler) GetTokenUser(ctx context.Context, value string, userID string, sessionID string) (TokenDTO, error) {
+	r := models.NewRecordID("tokens", sessionID)
+	token, err := surrealCall(ctx, func() (*SurrealToken, error) {
+		return surrealdb.Select[SurrealToken, models.RecordID](sdh.conn.get(), r)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if token.Value != value {
-		return nil, fmt.Errorf("token not found")
+	if token == nil || token.ID == nil || token.Value != value || token.UserID != userID || !token.GetExpirationDate().After(time.Now()) {
+		return nil, ErrSessionNotFound
 	}
 	return token, nil
 }
-func (sdh SurrealDBHandler) DeleteToken(userID string) error {
-	r := models.NewRecordID("tokens", userID)
-	_, err := surrealdb.Delete[map[string]interface{}, models.RecordID](sdh.db, r)
+
+func (sdh SurrealDBHandler) GetSessions(ctx context.Context, userID string) ([]TokenDTO, error) {
+	tokens, err := querySurreal[SurrealToken](ctx, sdh.conn.get(),
+		"SELECT * FROM tokens WHERE userId = $userId ORDER BY lastSeenAt DESC",
+		map[string]interface{}{"userId": userID},
+	)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]TokenDTO, len(tokens))
+	for i := range tokens {
+		sessions[i] = &tokens[i]
+	}
+	return sessions, nil
+}
+
+func (sdh SurrealDBHandler) TouchSession(ctx context.Context, sessionID string, lastSeenAt time.Time) error {
+	_, err := querySurreal[SurrealToken](ctx, sdh.conn.get(),
+		"UPDATE $record SET lastSeenAt = $lastSeenAt",
+		map[string]interface{}{
+			"record":     models.NewRecordID("tokens", sessionID),
+			"lastSeenAt": surrealTime(lastSeenAt),
+		},
+	)
+	return err
+}
+
+func (sdh SurrealDBHandler) DeleteSession(ctx context.Context, userID string, sessionID string) error {
+	deleted, err := querySurreal[SurrealToken](ctx, sdh.conn.get(),
+		"DELETE $record WHERE userId = $userId RETURN BEFORE",
+		map[string]interface{}{
+			"record": models.NewRecordID("tokens", sessionID),
+			"userId": userID,
+		},
+	)
 	if err != nil {
 		return err
 	}
+	if len(deleted) == 0 {
+		return ErrSessionNotFound
+	}
 	return nil
 }
 
-func connectAndPing(conf *configuration.Configuration, db *surrealdb.DB) error {
+func (sdh SurrealDBHandler) DeleteToken(ctx context.Context, userID string) error {
+	_, err := querySurreal[SurrealToken](ctx, sdh.conn.get(),
+		"DELETE tokens WHERE userId = $userId",
+		map[string]interface{}{"userId": userID},
+	)
+	return err
+}
+
+func (sdh SurrealDBHandler) PurgeExpiredTokens(ctx context.Context, before time.Time) (int, error) {
+	// The dates are compared as datetimes, the tokens written before they were stored in UTC have an offset
+	deleted, err := querySurreal[SurrealToken](ctx, sdh.conn.get(),
+		"DELETE tokens WHERE <datetime> expirationDate < <datetime> $before RETURN BEFORE",
+		map[string]interface{}{"before": before.UTC().Format(time.RFC3339)},
+	)
+	return len(deleted), err
+}
 
-	// Set the namespace and database
-	if err := db.Use(conf.SurrealDBNamespace, conf.SurrealDBDatabase); err != nil {
-		return err
+type SurrealLock struct {
+	ID        *models.RecordID `json:"id,omitempty"`
+	Owner     string           `json:"owner"`
+	ExpiresAt string           `json:"expiresAt"`
+}
+
+func (sdh SurrealDBHandler) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	// The record of another owner is only updated once it expired, nothing is returned otherwise
+	locks, err := querySurreal[SurrealLock](ctx, sdh.conn.get(),
+		"UPSERT $record SET owner = $owner, expiresAt = $expiresAt WHERE owner = NONE OR owner = $owner OR expiresAt < $now",
+		map[string]interface{}{
+			"record":    models.NewRecordID("locks", name),
+			"owner":     owner,
+			"expiresAt": now.Add(ttl).Format(time.RFC3339),
+			"now":       now.Format(time.RFC3339),
+		},
+	)
+	if err != nil {
+		return false, err
 	}
+	return len(locks) > 0, nil
+}
+
+type SurrealRefreshToken struct {
+	ID             *models.RecordID `json:"id,omitempty"`
+	Hash           string           `json:"hash"`
+	Family         string           `json:"family"`
+	UserID         string           `json:"userId"`
+	Username       string           `json:"username"`
+	ExpirationDate string           `json:"expirationDate"`
+	Used           bool             `json:"used"`
+	Revoked        bool             `json:"revoked"`
+}
 
-	// Create the connection to the database
-	// Sign in to authentication `db`
-	authData := &surrealdb.Auth{
-		Username: conf.SurrealDBUsername, // use your setup username
-		Password: conf.SurrealDBPassword, // use your setup password
+func (srt *SurrealRefreshToken) GetId() string {
+	return srt.ID.String()
+}
+
+func (srt *SurrealRefreshToken) GetHash() string {
+	return srt.Hash
+}
+
+func (srt *SurrealRefreshToken) GetFamily() string {
+	return srt.Family
+}
+
+func (srt *SurrealRefreshToken) GetUserID() string {
+	return srt.UserID
+}
+
+func (srt *SurrealRefreshToken) GetUsername() string {
+	return srt.Username
+}
+
+func (srt *SurrealRefreshToken) GetExpirationDate() time.Time {
+	t, _ := time.Parse(time.RFC3339, srt.ExpirationDate)
+	return t
+}
+
+func (srt *SurrealRefreshToken) IsUsed() bool {
+	return srt.Used
+}
+
+func (srt *SurrealRefreshToken) IsRevoked() bool {
+	return srt.Revoked
+}
+
+func (sdh SurrealDBHandler) CreateRefreshToken(ctx context.Context, token *RefreshTokenRequest) (RefreshTokenDTO, error) {
+	s := SurrealRefreshToken{
+		Hash:           token.Hash,
+		Family:         token.Family,
+		UserID:         token.UserID,
+		Username:       token.Username,
+		ExpirationDate: token.ExpirationDate.Format(time.RFC3339),
+	}
+	res, err := surrealCall(ctx, func() (*SurrealRefreshToken, error) {
+		return surrealdb.Create[SurrealRefreshToken](sdh.conn.get(), models.NewRecordID("refresh_tokens", token.Hash), s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (sdh SurrealDBHandler) GetRefreshToken(ctx context.Context, hash string) (RefreshTokenDTO, error) {
+	r := models.NewRecordID("refresh_tokens", hash)
+	token, err := surrealCall(ctx, func() (*SurrealRefreshToken, error) {
+		return surrealdb.Select[SurrealRefreshToken, models.RecordID](sdh.conn.get(), r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token == nil || token.ID == nil {
+		return nil, fmt.Errorf("refresh token not found")
 	}
-	token, err := db.SignIn(authData)
+	return token, nil
+}
+
+func (sdh SurrealDBHandler) UseRefreshToken(ctx context.Context, hash string) error {
+	// The used = false condition makes the rotation atomic between concurrent requests
+	tokens, err := querySurreal[SurrealRefreshToken](ctx, sdh.conn.get(),
+		"UPDATE $record SET used = true WHERE used = false RETURN AFTER",
+		map[string]interface{}{"record": models.NewRecordID("refresh_tokens", hash)},
+	)
 	if err != nil {
 		return err
 	}
+	if len(tokens) == 0 {
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
+func (sdh SurrealDBHandler) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	_, err := querySurreal[SurrealRefreshToken](ctx, sdh.conn.get(),
+		"UPDATE refresh_tokens SET revoked = true WHERE family = $family",
+		map[string]interface{}{"family": family},
+	)
+	return err
+}
+
+func (sdh SurrealDBHandler) DeleteRefreshTokens(ctx context.Context, userID string) error {
+	_, err := querySurreal[SurrealRefreshToken](ctx, sdh.conn.get(),
+		"DELETE refresh_tokens WHERE userId = $userId",
+		map[string]interface{}{"userId": userID},
+	)
+	return err
+}
+
+// surrealCall runs a call of the SurrealDB client, which doesn't take a context, and stops waiting for it
+// when ctx is done. The statement isn't cancelled on the server.
+func surrealCall[T any](ctx context.Context, call func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := call()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// surrealTimeLayout keeps the trailing zeros of RFC 3339 so that the dates have a fixed width
+const surrealTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// surrealTime formats the dates that are sorted or filtered in UTC so that they compare as strings
+func surrealTime(t time.Time) string {
+	return t.UTC().Format(surrealTimeLayout)
+}
+
+// querySurreal runs a single statement and returns the records of its result
+func querySurreal[T any](ctx context.Context, db *surrealdb.DB, sql string, vars map[string]interface{}) ([]T, error) {
+	res, err := surrealCall(ctx, func() (*[]surrealdb.QueryResult[[]T], error) {
+		return surrealdb.Query[[]T](db, sql, vars)
+	})
+	if err != nil {
+		logger.WithError(err).WithField("query", sql).Error("Error when trying to query SurrealDB")
+		return nil, err
+	}
+	if res == nil || len(*res) == 0 {
+		return []T{}, nil
+	}
+	if (*res)[0].Status != "OK" {
+		return nil, fmt.Errorf("query failed with status %v", (*res)[0].Status)
+	}
+	return (*res)[0].Result, nil
+}
+
+type SurrealPasswordResetToken struct {
+	ID             *models.RecordID `json:"id,omitempty"`
+	UserID         string           `json:"userId"`
+	Username       string           `json:"username"`
+	ExpirationDate string           `json:"expirationDate"`
+	Used           bool             `json:"used"`
+}
+
+func (sprt *SurrealPasswordResetToken) GetId() string {
+	return sprt.ID.String()
+}
+
+func (sprt *SurrealPasswordResetToken) GetUserID() string {
+	return sprt.UserID
+}
+
+func (sprt *SurrealPasswordResetToken) GetUsername() string {
+	return sprt.Username
+}
+
+func (sprt *SurrealPasswordResetToken) GetExpirationDate() time.Time {
+	t, _ := time.Parse(time.RFC3339, sprt.ExpirationDate)
+	return t
+}
+
+func (sdh SurrealDBHandler) CreatePasswordResetToken(ctx context.Context, token *PasswordResetTokenRequest) (PasswordResetTokenDTO, error) {
+	s := SurrealPasswordResetToken{
+		UserID:         token.UserID,
+		Username:       token.Username,
+		ExpirationDate: token.ExpirationDate.Format(time.RFC3339),
+	}
+	res, err := surrealCall(ctx, func() (*SurrealPasswordResetToken, error) {
+		return surrealdb.Create[SurrealPasswordResetToken](sdh.conn.get(), models.NewRecordID("password_resets", token.Hash), s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (sdh SurrealDBHandler) GetPasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error) {
+	tokens, err := querySurreal[SurrealPasswordResetToken](ctx, sdh.conn.get(),
+		"SELECT * FROM $record WHERE used = false",
+		map[string]interface{}{"record": models.NewRecordID("password_resets", hash)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrPasswordResetTokenInvalid
+	}
+	return &tokens[0], nil
+}
+
+func (sdh SurrealDBHandler) UsePasswordResetToken(ctx context.Context, hash string) (PasswordResetTokenDTO, error) {
+	tokens, err := querySurreal[SurrealPasswordResetToken](ctx, sdh.conn.get(),
+		"UPDATE $record SET used = true WHERE used = false RETURN AFTER",
+		map[string]interface{}{"record": models.NewRecordID("password_resets", hash)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrPasswordResetTokenInvalid
+	}
+	return &tokens[0], nil
+}
+
+type SurrealIdentity struct {
+	ID       *models.RecordID `json:"id,omitempty"`
+	Issuer   string           `json:"issuer"`
+	Subject  string           `json:"subject"`
+	UserID   string           `json:"userId"`
+	Username string           `json:"username"`
+}
+
+func (si *SurrealIdentity) GetId() string {
+	return si.ID.String()
+}
+
+func (si *SurrealIdentity) GetIssuer() string {
+	return si.Issuer
+}
+
+func (si *SurrealIdentity) GetSubject() string {
+	return si.Subject
+}
+
+func (si *SurrealIdentity) GetUserID() string {
+	return si.UserID
+}
+
+func (si *SurrealIdentity) GetUsername() string {
+	return si.Username
+}
+
+// identityRecordID uses an array ID so the pair issuer and subject is unique
+func identityRecordID(issuer string, subject string) models.RecordID {
+	return models.NewRecordID("identities", []interface{}{issuer, subject})
+}
+
+func (sdh SurrealDBHandler) CreateIdentity(ctx context.Context, identity *IdentityRequest) (IdentityDTO, error) {
+	s := SurrealIdentity{
+		Issuer:   identity.Issuer,
+		Subject:  identity.Subject,
+		UserID:   identity.UserID,
+		Username: identity.Username,
+	}
+	res, err := surrealCall(ctx, func() (*SurrealIdentity, error) {
+		return surrealdb.Create[SurrealIdentity](sdh.conn.get(), identityRecordID(identity.Issuer, identity.Subject), s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (sdh SurrealDBHandler) GetIdentity(ctx context.Context, issuer string, subject string) (IdentityDTO, error) {
+	identity, err := surrealCall(ctx, func() (*SurrealIdentity, error) {
+		return surrealdb.Select[SurrealIdentity](sdh.conn.get(), identityRecordID(issuer, subject))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil || identity.ID == nil {
+		return nil, ErrIdentityNotFound
+	}
+	return identity, nil
+}
+
+type SurrealApiKey struct {
+	ID             *models.RecordID `json:"id,omitempty"`
+	Name           string           `json:"name"`
+	Hash           string           `json:"hash"`
+	UserID         string           `json:"userId"`
+	Username       string           `json:"username"`
+	Scopes         []string         `json:"scopes"`
+	CreatedAt      string           `json:"createdAt"`
+	LastUsedAt     string           `json:"lastUsedAt"`
+	ExpirationDate string           `json:"expirationDate"`
+}
+
+func (sak *SurrealApiKey) GetId() string {
+	return sak.ID.String()
+}
+
+func (sak *SurrealApiKey) GetName() string {
+	return sak.Name
+}
+
+// GetPrefix returns the ID of the record, the keys are stored by prefix
+func (sak *SurrealApiKey) GetPrefix() string {
+	return fmt.Sprintf("%v", sak.ID.ID)
+}
+
+func (sak *SurrealApiKey) GetUserID() string {
+	return sak.UserID
+}
+
+func (sak *SurrealApiKey) GetUsername() string {
+	return sak.Username
+}
+
+func (sak *SurrealApiKey) GetScopes() []string {
+	return sak.Scopes
+}
+
+func (sak *SurrealApiKey) GetCreatedAt() time.Time {
+	t, _ := time.Parse(time.RFC3339, sak.CreatedAt)
+	return t
+}
+
+func (sak *SurrealApiKey) GetLastUsedAt() time.Time {
+	t, _ := time.Parse(time.RFC3339, sak.LastUsedAt)
+	return t
+}
+
+func (sak *SurrealApiKey) GetExpirationDate() time.Time {
+	t, _ := time.Parse(time.RFC3339, sak.ExpirationDate)
+	return t
+}
+
+func (sdh SurrealDBHandler) CreateApiKey(ctx context.Context, key *ApiKeyRequest) (ApiKeyDTO, error) {
+	s := SurrealApiKey{
+		Name:      key.Name,
+		Hash:      key.Hash,
+		UserID:    key.UserID,
+		Username:  key.Username,
+		Scopes:    key.Scopes,
+		CreatedAt: surrealTime(time.Now()),
+	}
+	if !key.ExpirationDate.IsZero() {
+		s.ExpirationDate = key.ExpirationDate.Format(time.RFC3339)
+	}
+	res, err := surrealCall(ctx, func() (*SurrealApiKey, error) {
+		return surrealdb.Create[SurrealApiKey](sdh.conn.get(), models.NewRecordID("api_keys", key.Prefix), s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (sdh SurrealDBHandler) GetApiKeys(ctx context.Context, userID string) ([]ApiKeyDTO, error) {
+	keys, err := querySurreal[SurrealApiKey](ctx, sdh.conn.get(),
+		"SELECT * FROM api_keys WHERE userId = $userId ORDER BY createdAt DESC",
+		map[string]interface{}{"userId": userID},
+	)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := make([]ApiKeyDTO, len(keys))
+	for i := range keys {
+		apiKeys[i] = &keys[i]
+	}
+	return apiKeys, nil
+}
 
-	// Check token validity. This is not necessary if you called `SignIn` before. This authenticates the `db` instance too if sign in was
-	// not previously called
-	if err := db.Authenticate(token); err != nil {
+func (sdh SurrealDBHandler) GetApiKey(ctx context.Context, hash string) (ApiKeyDTO, error) {
+	keys, err := querySurreal[SurrealApiKey](ctx, sdh.conn.get(),
+		"SELECT * FROM api_keys WHERE hash = $hash LIMIT 1",
+		map[string]interface{}{"hash": hash},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrApiKeyNotFound
+	}
+	return &keys[0], nil
+}
+
+func (sdh SurrealDBHandler) TouchApiKey(ctx context.Context, prefix string, lastUsedAt time.Time) error {
+	_, err := querySurreal[SurrealApiKey](ctx, sdh.conn.get(),
+		"UPDATE $record SET lastUsedAt = $lastUsedAt",
+		map[string]interface{}{
+			"record":     models.NewRecordID("api_keys", prefix),
+			"lastUsedAt": surrealTime(lastUsedAt),
+		},
+	)
+	return err
+}
+
+func (sdh SurrealDBHandler) RevokeApiKey(ctx context.Context, userID string, prefix string) error {
+	deleted, err := querySurreal[SurrealApiKey](ctx, sdh.conn.get(),
+		"DELETE $record WHERE userId = $userId RETURN BEFORE",
+		map[string]interface{}{
+			"record": models.NewRecordID("api_keys", prefix),
+			"userId": userID,
+		},
+	)
+	if err != nil {
 		return err
 	}
+	if len(deleted) == 0 {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
+
+type SurrealAuthEvent struct {
+	ID        *models.RecordID `json:"id,omitempty"`
+	Type      string           `json:"type"`
+	UserID    string           `json:"userId"`
+	UserUUID  string           `json:"userUuid"`
+	Username  string           `json:"username"`
+	IP        string           `json:"ip"`
+	UserAgent string           `json:"userAgent"`
+	TraceID   string           `json:"traceId"`
+	CreatedAt string           `json:"createdAt"`
+}
+
+func (sae *SurrealAuthEvent) GetId() string {
+	return sae.ID.String()
+}
+
+func (sae *SurrealAuthEvent) GetType() string {
+	return sae.Type
+}
+
+func (sae *SurrealAuthEvent) GetUserID() string {
+	return sae.UserID
+}
+
+func (sae *SurrealAuthEvent) GetUserUUID() string {
+	return sae.UserUUID
+}
+
+func (sae *SurrealAuthEvent) GetUsername() string {
+	return sae.Username
+}
 
-	// And we can later on invalidate the token if desired
-	// defer func(token string) {
-	// 	if err := db.Invalidate(); err != nil {
-	// 		panic(err)
-	// 	}
-	// }(token)
+func (sae *SurrealAuthEvent) GetIP() string {
+	return sae.IP
+}
+
+func (sae *SurrealAuthEvent) GetUserAgent() string {
+	return sae.UserAgent
+}
+
+func (sae *SurrealAuthEvent) GetTraceID() string {
+	return sae.TraceID
+}
+
+func (sae *SurrealAuthEvent) GetCreatedAt() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, sae.CreatedAt)
+	return t
+}
+
+func (sdh SurrealDBHandler) CreateAuthEvent(ctx context.Context, event *AuthEventRequest) error {
+	s := SurrealAuthEvent{
+		Type:      event.Type,
+		UserID:    event.UserID,
+		UserUUID:  event.UserUUID,
+		Username:  event.Username,
+		IP:        event.IP,
+		UserAgent: event.UserAgent,
+		TraceID:   event.TraceID,
+		CreatedAt: surrealTime(time.Now()),
+	}
+	_, err := surrealCall(ctx, func() (*SurrealAuthEvent, error) {
+		return surrealdb.Create[SurrealAuthEvent](sdh.conn.get(), models.Table("auth_events"), s)
+	})
+	if err != nil {
+		logger.WithError(err).Error("Error when trying to create the auth event")
+	}
 	return err
 }
+
+func (sdh SurrealDBHandler) GetAuthEvents(ctx context.Context, filter *AuthEventFilter) ([]AuthEventDTO, error) {
+	conditions := []string{}
+	vars := map[string]interface{}{}
+	for field, value := range map[string]string{
+		"type":     filter.Type,
+		"userId":   filter.UserID,
+		"userUuid": filter.UserUUID,
+		"username": filter.Username,
+		"ip":       filter.IP,
+	} {
+		if value != "" {
+			conditions = append(conditions, fmt.Sprintf("%v = $%v", field, field))
+			vars[field] = value
+		}
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "createdAt >= $since")
+		vars["since"] = surrealTime(filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "createdAt < $until")
+		vars["until"] = surrealTime(filter.Until)
+	}
+
+	sql := "SELECT * FROM auth_events"
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += " ORDER BY createdAt DESC"
+	if filter.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	events, err := querySurreal[SurrealAuthEvent](ctx, sdh.conn.get(), sql, vars)
+	if err != nil {
+		return nil, err
+	}
+	authEvents := make([]AuthEventDTO, len(events))
+	for i := range events {
+		authEvents[i] = &events[i]
+	}
+	return authEvents, nil
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSurrealTime(t *testing.T) {
+	second := time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	dates := []time.Time{
+		second.Add(time.Second),
+		second.Add(500 * time.Millisecond),
+		second,
+		second.Add(-time.Nanosecond),
+	}
+	formatted := make([]string, len(dates))
+	for i, date := range dates {
+		formatted[i] = surrealTime(date)
+	}
+	if !sort.IsSorted(sort.Reverse(sort.StringSlice(formatted))) {
+		t.Fatalf("Expected the dates to sort as strings, got %v", formatted)
+	}
+	if formatted[2] != "2024-03-01T11:00:00.000000000Z" {
+		t.Fatalf("Expected a fixed width date in UTC, got %v", formatted[2])
+	}
+	parsed := (&SurrealAuthEvent{CreatedAt: formatted[1]}).GetCreatedAt()
+	if !parsed.Equal(dates[1]) {
+		t.Fatalf("Expected %v once parsed, got %v", dates[1], parsed)
+	}
+}
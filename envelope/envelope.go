@@ -0,0 +1,145 @@
+package envelope
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"gateway/configuration"
+	"gateway/utils"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithFields(logrus.Fields{
+	"context": "envelope",
+})
+
+// fieldPrefix marks the encrypted fields, the fields written before the encryption are kept in plaintext until rewritten
+const fieldPrefix = "enc:"
+
+// derivedKeyID is the master key derived from the JWT secret when no master key is configured
+const derivedKeyID = "jwt-secret"
+
+var ErrUnknownKey = errors.New("unknown master key")
+
+// ErrNoMasterKey is returned outside development when ENCRYPTION_MASTER_KEYS is empty
+var ErrNoMasterKey = errors.New("ENCRYPTION_MASTER_KEYS is required outside development")
+
+// Envelope wraps the data key of each user with a master key, the data key encrypts the fields of the user.
+// Every configured master key unwraps the data keys, only the current one wraps them. Adding a new master key
+// as the current one and rewrapping the data keys allows to rotate it without downtime.
+type Envelope struct {
+	keys      map[string]string
+	currentID string
+}
+
+// New loads the base64 AES-256 master keys of ENCRYPTION_MASTER_KEYS, a comma separated list of id:key.
+// When no key is configured a key is derived from the JWT secret, which is only allowed in development.
+func New(conf *configuration.Configuration) (*Envelope, error) {
+	keys := map[string]string{}
+	for _, entry := range strings.Split(conf.MasterKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid master key %q, expected id:key", id)
+		}
+		keys[id] = key
+	}
+
+	if len(keys) == 0 {
+		if conf.Environment != "development" {
+			return nil, ErrNoMasterKey
+		}
+		logger.Warn("ENCRYPTION_MASTER_KEYS is not set, deriving the master key from JWT_SECRET")
+		sum := sha256.Sum256([]byte(conf.JWTSecret))
+		keys[derivedKeyID] = base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	// Without explicit configuration, the last key by name is the current one
+	currentID := conf.MasterKeyID
+	if currentID == "" {
+		ids := make([]string, 0, len(keys))
+		for id := range keys {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		currentID = ids[len(ids)-1]
+	}
+	return NewEnvelope(keys, currentID)
+}
+
+// NewEnvelope checks the master keys, they are indexed by ID
+func NewEnvelope(keys map[string]string, currentID string) (*Envelope, error) {
+	for id, key := range keys {
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid master key ID %q", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("master key %v must be 32 bytes encoded in base64", id)
+		}
+	}
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, currentID)
+	}
+	logger.WithField("currentKey", currentID).Info("Loaded the master keys")
+	return &Envelope{keys: keys, currentID: currentID}, nil
+}
+
+// Wrap encrypts the data key with the current master key, the ID of the master key prefixes the result
+func (e *Envelope) Wrap(dataKey string) (string, error) {
+	wrapped, err := utils.Encrypt(dataKey, e.keys[e.currentID])
+	if err != nil {
+		return "", err
+	}
+	return e.currentID + ":" + wrapped, nil
+}
+
+// Unwrap decrypts the data key with the master key it was wrapped with.
+// A data key stored before the envelope encryption is returned as is.
+func (e *Envelope) Unwrap(wrapped string) (string, error) {
+	id, ciphertext, ok := strings.Cut(wrapped, ":")
+	if !ok {
+		return wrapped, nil
+	}
+	key, ok := e.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %v", ErrUnknownKey, id)
+	}
+	return utils.Decrypt(ciphertext, key)
+}
+
+// NeedsRewrap tells if the data key isn't wrapped with the current master key
+func (e *Envelope) NeedsRewrap(wrapped string) bool {
+	return !strings.HasPrefix(wrapped, e.currentID+":")
+}
+
+// EncryptField encrypts a field with the data key of the user, an empty field stays empty
+func EncryptField(plaintext string, dataKey string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	ciphertext, err := utils.Encrypt(plaintext, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return fieldPrefix + ciphertext, nil
+}
+
+// DecryptField decrypts a field of EncryptField, a field that isn't encrypted is returned as is
+func DecryptField(value string, dataKey string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	return utils.Decrypt(strings.TrimPrefix(value, fieldPrefix), dataKey)
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, fieldPrefix)
+}
@@ -0,0 +1,138 @@
+package envelope
+
+import (
+	"errors"
+	"gateway/configuration"
+	"gateway/utils"
+	"strings"
+	"testing"
+)
+
+func newKey(t *testing.T) string {
+	t.Helper()
+	key, err := utils.GenerateSecretKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return key
+}
+
+func TestEnvelope(t *testing.T) {
+	oldKey, newMasterKey, dataKey := newKey(t), newKey(t), newKey(t)
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "Wrap and unwrap a data key",
+			test: func(t *testing.T) {
+				e, err := New(&configuration.Configuration{MasterKeys: "2024:" + oldKey + ",2025:" + newMasterKey})
+				if err != nil {
+					t.Fatalf("Failed to create envelope: %v", err)
+				}
+				wrapped, err := e.Wrap(dataKey)
+				if err != nil {
+					t.Fatalf("Failed to wrap: %v", err)
+				}
+				if !strings.HasPrefix(wrapped, "2025:") || strings.Contains(wrapped, dataKey) {
+					t.Fatalf("Expected the key to be wrapped with the last key, got %v", wrapped)
+				}
+				unwrapped, err := e.Unwrap(wrapped)
+				if err != nil || unwrapped != dataKey {
+					t.Fatalf("Failed to unwrap: %v", err)
+				}
+			},
+		},
+		{
+			name: "Rotate the master key",
+			test: func(t *testing.T) {
+				before, _ := NewEnvelope(map[string]string{"old": oldKey}, "old")
+				after, _ := NewEnvelope(map[string]string{"old": oldKey, "new": newMasterKey}, "new")
+				retired, _ := NewEnvelope(map[string]string{"new": newMasterKey}, "new")
+
+				wrapped, _ := before.Wrap(dataKey)
+				if !after.NeedsRewrap(wrapped) {
+					t.Fatalf("Expected the key to need a rewrap")
+				}
+				unwrapped, err := after.Unwrap(wrapped)
+				if err != nil || unwrapped != dataKey {
+					t.Fatalf("Failed to unwrap with the previous key: %v", err)
+				}
+				if _, err := retired.Unwrap(wrapped); !errors.Is(err, ErrUnknownKey) {
+					t.Fatalf("Expected %v, got %v", ErrUnknownKey, err)
+				}
+				rewrapped, _ := after.Wrap(unwrapped)
+				if unwrapped, err := retired.Unwrap(rewrapped); err != nil || unwrapped != dataKey {
+					t.Fatalf("Failed to unwrap the rewrapped key: %v", err)
+				}
+			},
+		},
+		{
+			name: "Legacy plaintext data key",
+			test: func(t *testing.T) {
+				e, _ := NewEnvelope(map[string]string{"key": oldKey}, "key")
+				unwrapped, err := e.Unwrap(dataKey)
+				if err != nil || unwrapped != dataKey || !e.NeedsRewrap(dataKey) {
+					t.Fatalf("Expected the plaintext key to be returned and rewrapped, got %v", err)
+				}
+			},
+		},
+		{
+			name: "Derived key without configuration",
+			test: func(t *testing.T) {
+				if _, err := New(&configuration.Configuration{JWTSecret: "secret", Environment: "production"}); !errors.Is(err, ErrNoMasterKey) {
+					t.Fatalf("Expected ErrNoMasterKey outside development, got %v", err)
+				}
+				e, err := New(&configuration.Configuration{JWTSecret: "secret", Environment: "development"})
+				if err != nil {
+					t.Fatalf("Failed to create envelope: %v", err)
+				}
+				wrapped, _ := e.Wrap(dataKey)
+				if !strings.HasPrefix(wrapped, derivedKeyID+":") {
+					t.Fatalf("Expected the derived key, got %v", wrapped)
+				}
+			},
+		},
+		{
+			name: "Invalid configuration",
+			test: func(t *testing.T) {
+				confs := []*configuration.Configuration{
+					{MasterKeys: oldKey},
+					{MasterKeys: "short:c2hvcnQ="},
+					{MasterKeys: "key:" + oldKey, MasterKeyID: "other"},
+				}
+				for _, conf := range confs {
+					if _, err := New(conf); err == nil {
+						t.Fatalf("Expected an error for %v", conf.MasterKeys)
+					}
+				}
+			},
+		},
+		{
+			name: "Encrypt fields",
+			test: func(t *testing.T) {
+				encrypted, err := EncryptField("Jean", dataKey)
+				if err != nil || !IsEncrypted(encrypted) || strings.Contains(encrypted, "Jean") {
+					t.Fatalf("Failed to encrypt: %v %v", encrypted, err)
+				}
+				if decrypted, err := DecryptField(encrypted, dataKey); err != nil || decrypted != "Jean" {
+					t.Fatalf("Failed to decrypt: %v", err)
+				}
+				if _, err := DecryptField(encrypted, oldKey); err == nil {
+					t.Fatalf("Expected an error with another key")
+				}
+				if empty, _ := EncryptField("", dataKey); empty != "" {
+					t.Fatalf("Expected an empty field to stay empty, got %v", empty)
+				}
+				if plaintext, _ := DecryptField("Jean", dataKey); plaintext != "Jean" {
+					t.Fatalf("Expected a plaintext field to be returned as is, got %v", plaintext)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.test)
+	}
+}
@@ -0,0 +1,232 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gateway/configuration"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithFields(logrus.Fields{
+	"context": "keyring",
+})
+
+var (
+	ErrUnknownKey     = errors.New("unknown signing key")
+	ErrUnsupportedKey = errors.New("unsupported key type, only RSA and Ed25519 keys are allowed")
+)
+
+// Key is a private key used to sign the JWTs, identified by the kid header
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+}
+
+// NewKey wraps a RSA or Ed25519 private key and picks the matching signing method
+func NewKey(id string, private crypto.Signer) (*Key, error) {
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		return &Key{ID: id, Method: jwt.SigningMethodRS256, Private: private}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, Method: jwt.SigningMethodEdDSA, Private: private}, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// Keyring holds every key accepted to verify a token, only one of them is used to sign new tokens.
+// Keeping the previous keys in the keyring allows to rotate the signing key without invalidating
+// the tokens that are still in use.
+type Keyring struct {
+	mu           sync.RWMutex
+	keys         map[string]*Key
+	signingKeyID string
+}
+
+// New loads the PEM encoded private keys of the configured directory, the file name without its
+// extension is the kid of the key. When no directory is configured an ephemeral Ed25519 key is
+// generated, which is only suitable for a single instance in development.
+func New(conf *configuration.Configuration) (*Keyring, error) {
+	k := &Keyring{keys: map[string]*Key{}}
+
+	if conf.JWTKeysDir == "" {
+		logger.Warn("JWT_KEYS_DIR is not set, generating an ephemeral signing key")
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key, _ := NewKey("ephemeral", private)
+		k.AddKey(key)
+		return k, k.SetSigningKey(key.ID)
+	}
+
+	files, err := filepath.Glob(filepath.Join(conf.JWTKeysDir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no key found in %v", conf.JWTKeysDir)
+	}
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		key, err := loadKey(id, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %v: %w", file, err)
+		}
+		k.AddKey(key)
+		ids = append(ids, id)
+	}
+
+	// Without explicit configuration, the last key by name is the signing one
+	signingKeyID := conf.JWTSigningKeyID
+	if signingKeyID == "" {
+		sort.Strings(ids)
+		signingKeyID = ids[len(ids)-1]
+	}
+	logger.WithFields(logrus.Fields{"keys": ids, "signingKey": signingKeyID}).Info("Loaded JWT keyring")
+	return k, k.SetSigningKey(signingKeyID)
+}
+
+func loadKey(id string, file string) (*Key, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var private any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %v", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	return NewKey(id, signer)
+}
+
+// AddKey adds a key to verify the tokens, it replaces the key with the same ID
+func (k *Keyring) AddKey(key *Key) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.ID] = key
+}
+
+// RemoveKey removes a retired key, the tokens it signed are not accepted anymore
+func (k *Keyring) RemoveKey(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.signingKeyID {
+		return errors.New("the signing key can't be removed")
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// SetSigningKey selects the key used to sign the new tokens
+func (k *Keyring) SetSigningKey(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownKey, id)
+	}
+	k.signingKeyID = id
+	return nil
+}
+
+// Sign signs the claims with the current signing key and sets the kid header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key := k.keys[k.signingKeyID]
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc returns the public key matching the kid header of the token, it's meant to be used by the jwt parsers
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("missing kid header")
+	}
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, kid)
+	}
+	// Prevent an attacker from switching to another algorithm with the same key
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Method.Alg())
+	}
+	return key.Private.Public(), nil
+}
+
+// JWK is the public part of a key as defined in RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the keyring, sorted by kid
+func (k *Keyring) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	jwks := JWKS{Keys: make([]JWK, 0, len(k.keys))}
+	for _, key := range k.keys {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+	return jwks
+}
@@ -0,0 +1,127 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"gateway/configuration"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writeRSAKey(t *testing.T, dir string, id string) {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})
+	if err := os.WriteFile(filepath.Join(dir, id+".pem"), content, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+func parse(k *Keyring, token string) error {
+	_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, k.Keyfunc)
+	return err
+}
+
+func TestKeyring(t *testing.T) {
+	claims := &jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "Ephemeral key signs and verifies tokens",
+			test: func(t *testing.T) {
+				k, err := New(&configuration.Configuration{})
+				if err != nil {
+					t.Fatalf("Failed to create keyring: %v", err)
+				}
+				token, err := k.Sign(claims)
+				if err != nil {
+					t.Fatalf("Failed to sign: %v", err)
+				}
+				if err := parse(k, token); err != nil {
+					t.Fatalf("Failed to verify: %v", err)
+				}
+				jwks := k.JWKS()
+				if len(jwks.Keys) != 1 || jwks.Keys[0].Kty != "OKP" || jwks.Keys[0].Alg != "EdDSA" {
+					t.Fatalf("Unexpected JWKS: %v", jwks)
+				}
+			},
+		},
+		{
+			name: "Tokens signed by a previous key stay valid after a rotation",
+			test: func(t *testing.T) {
+				dir := t.TempDir()
+				writeRSAKey(t, dir, "2024-01")
+				writeRSAKey(t, dir, "2024-02")
+				k, err := New(&configuration.Configuration{JWTKeysDir: dir, JWTSigningKeyID: "2024-01"})
+				if err != nil {
+					t.Fatalf("Failed to create keyring: %v", err)
+				}
+				old, err := k.Sign(claims)
+				if err != nil {
+					t.Fatalf("Failed to sign: %v", err)
+				}
+
+				if err := k.SetSigningKey("2024-02"); err != nil {
+					t.Fatalf("Failed to rotate: %v", err)
+				}
+				token, _ := k.Sign(claims)
+				parsed, _, _ := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+				if parsed.Header["kid"] != "2024-02" || parsed.Method.Alg() != "RS256" {
+					t.Fatalf("Unexpected header: %v", parsed.Header)
+				}
+				if err := parse(k, old); err != nil {
+					t.Fatalf("Failed to verify a token of the previous key: %v", err)
+				}
+
+				if err := k.RemoveKey("2024-01"); err != nil {
+					t.Fatalf("Failed to remove key: %v", err)
+				}
+				if err := parse(k, old); err == nil {
+					t.Fatalf("Token of a removed key is still valid")
+				}
+				if len(k.JWKS().Keys) != 1 {
+					t.Fatalf("Removed key still published: %v", k.JWKS())
+				}
+			},
+		},
+		{
+			name: "Tokens of an unknown key or algorithm are rejected",
+			test: func(t *testing.T) {
+				k, _ := New(&configuration.Configuration{})
+				hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+				hmac.Header["kid"] = "ephemeral"
+				token, _ := hmac.SignedString([]byte("secret"))
+				if err := parse(k, token); err == nil {
+					t.Fatalf("HS256 token accepted")
+				}
+
+				other, _ := New(&configuration.Configuration{})
+				other.AddKey(&Key{ID: "other", Method: other.keys["ephemeral"].Method, Private: other.keys["ephemeral"].Private})
+				_ = other.SetSigningKey("other")
+				token, _ = other.Sign(claims)
+				if err := parse(k, token); err == nil {
+					t.Fatalf("Token of an unknown key accepted")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt // capture range variable
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tt.test(t)
+		})
+	}
+}
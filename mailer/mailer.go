@@ -0,0 +1,97 @@
+package mailer
+
+import (
+	"fmt"
+	"gateway/configuration"
+	"net/smtp"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithFields(logrus.Fields{
+	"context": "mailer",
+})
+
+const (
+	SMTPMailerType = "smtp"
+	LogMailerType  = "log"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// New returns the mailer selected by the MAILER configuration, the log mailer is used by default
+func New(conf *configuration.Configuration) Mailer {
+	if conf.Mailer == SMTPMailerType {
+		return NewSMTPMailer(conf)
+	}
+	return NewLogMailer(conf.MailFile)
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(conf *configuration.Configuration) *SMTPMailer {
+	m := &SMTPMailer{
+		addr: fmt.Sprintf("%v:%v", conf.SMTPHost, conf.SMTPPort),
+		from: conf.MailFrom,
+	}
+	// Some relays, like the local development ones, don't need any authentication
+	if conf.SMTPUsername != "" {
+		m.auth = smtp.PlainAuth("", conf.SMTPUsername, conf.SMTPPassword, conf.SMTPHost)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	content := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%v",
+		m.from, msg.To, msg.Subject, msg.Body)
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(content))
+	if err != nil {
+		logger.WithError(err).WithField("to", msg.To).Error("Failed to send mail")
+	}
+	return err
+}
+
+// LogMailer doesn't send anything, the messages are appended to a file or logged when no file is set.
+// It allows to run the mail flows in development and tests without a mail server.
+type LogMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewLogMailer(path string) *LogMailer {
+	return &LogMailer{path: path}
+}
+
+func (m *LogMailer) Send(msg *Message) error {
+	if m.path == "" {
+		logger.WithFields(logrus.Fields{
+			"to":      msg.To,
+			"subject": msg.Subject,
+		}).Info(msg.Body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "To: %v\nSubject: %v\n\n%v\n---\n", msg.To, msg.Subject, msg.Body)
+	return err
+}
@@ -0,0 +1,32 @@
+package mailer
+
+import (
+	"gateway/configuration"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mails")
+	m := New(&configuration.Configuration{Mailer: LogMailerType, MailFile: path})
+
+	for _, to := range []string{"user1@test.me", "user2@test.me"} {
+		if err := m.Send(&Message{To: to, Subject: "Hello", Body: "Body of the mail"}); err != nil {
+			t.Fatalf("Failed to send mail: %v", err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read mail file: %v", err)
+	}
+	mails := strings.Split(strings.TrimSuffix(string(content), "---\n"), "---\n")
+	if len(mails) != 2 {
+		t.Fatalf("Expected 2 mails, got %v", len(mails))
+	}
+	if !strings.HasPrefix(mails[1], "To: user2@test.me\nSubject: Hello\n\nBody of the mail") {
+		t.Fatalf("Unexpected mail: %v", mails[1])
+	}
+}
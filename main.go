@@ -9,6 +9,8 @@ import (
 	"gateway/messages"
 	"gateway/validation"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -22,15 +24,21 @@ func main() {
 	logger.Info("Choucroute API Gateway Starting...")
 
 	conf := configuration.New()
-	pg, err := db.NewSurrealDBHandler(conf)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(conf, os.Args[2:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
 
+	pg, err := db.New(conf)
 	if err != nil {
 		logger.Fatal(err)
 		os.Exit(1)
 	}
 
 	val := validation.New(conf)
-	r := api.New(val)
+	r := api.New(val, conf)
 	v1 := r.Group(conf.ListenRoute)
 	amqp := messages.New(conf)
 	h := api.NewApiHandler(pg, amqp, conf)
@@ -38,6 +46,14 @@ func main() {
 	h.Register(v1, conf)
 	tp := api.InitOtel()
 	ctx, cancel := context.WithCancel(context.Background())
+	// The data keys wrapped with a retired master key are rewrapped with the current one
+	go h.RotateEncryptionKeys(ctx)
+	if conf.UserPurgeInterval > 0 {
+		go h.RunUserPurge(ctx)
+	}
+	if conf.TokenPurgeInterval > 0 {
+		go h.RunTokenPurge(ctx)
+	}
 
 	defer func() {
 		cancel()
@@ -53,3 +69,53 @@ func main() {
 	r.Logger.Fatal(r.Start(fmt.Sprintf("%v:%v", conf.ListenAddress, conf.ListenPort)))
 
 }
+
+// migrate runs `migrate up`, `migrate down [steps]` or `migrate status` on the SurrealDB schema
+func migrate(conf *configuration.Configuration, args []string) error {
+	conf.SurrealDBMigrate = false
+	sdh, err := db.NewSurrealDBHandler(conf)
+	if err != nil {
+		return err
+	}
+	defer sdh.Close()
+	migrator, err := sdh.Migrator()
+	if err != nil {
+		return err
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		applied, err := migrator.Up()
+		logger.WithField("migrations", applied).Info("Applied the migrations")
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(steps)
+		logger.WithField("migrations", reverted).Info("Reverted the migrations")
+		return err
+	case "status":
+		status, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			state := "pending"
+			if !s.AppliedAt.IsZero() {
+				state = "applied at " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%v\t%v\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+	}
+}
@@ -1,7 +1,9 @@
 package messages
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"gateway/configuration"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -12,8 +14,13 @@ const (
 	AddIngredientShoppingList = "inventory-add-ingredient-shopping-list"
 	DeadLetterQueueName       = "dead-letter-queue"
 	AddPriceCatalogQueueName  = "catalog-add-price"
+	UserDeletedQueueName      = "user-deleted"
+	TokenRevokedExchangeName  = "gateway-token-revoked"
 )
 
+// ErrNotConfirmed is returned when the broker nacks a message published with confirms
+var ErrNotConfirmed = errors.New("the message was not confirmed by the broker")
+
 var logger = logrus.WithFields(logrus.Fields{
 	"context": "messages",
 })
@@ -179,6 +186,159 @@ func GetIngredientShoppingListQueue(conn *amqp.Connection) (*amqp.Queue, *amqp.C
 	return &q, ch, nil
 }
 
+func GetUserDeletedQueue(conn *amqp.Connection) (*amqp.Queue, *amqp.Channel, error) {
+	ch, err := OpenChannel(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := ch.QueueDeclare(
+		UserDeletedQueueName, // name
+		true,                 // durable
+		false,                // delete when unused
+		false,                // exclusive
+		false,                // no-wait
+		nil,                  // arguments
+	)
+	if err != nil {
+		logger.WithError(err).Error("Failed to declare a queue")
+		ch.Close()
+		return nil, nil, err
+	}
+	return &q, ch, nil
+}
+
+// PublishUserDeleted asks the other services to delete the data of the user, the message outlives a broker restart.
+// It returns once the broker has confirmed the message, ErrNotConfirmed if the broker refused it.
+func PublishUserDeleted(ctx context.Context, l *logrus.Entry, conn *amqp.Connection, user *UserDeleted) error {
+	q, ch, err := GetUserDeletedQueue(conn)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.Confirm(false); err != nil {
+		logger.WithError(err).Error("Failed to enable the publisher confirms")
+		return err
+	}
+
+	jsonMessage, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		"",     // exchange
+		q.Name, // routing key
+		false,  // mandatory
+		false,  // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         jsonMessage,
+		})
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return ErrNotConfirmed
+	}
+	l.WithFields(logrus.Fields{"message": string(jsonMessage), "queue": q.Name}).Info("Published the UserDeleted message")
+	return nil
+}
+
+func declareTokenRevokedExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		TokenRevokedExchangeName, // name
+		"fanout",                 // type
+		false,                    // durable
+		false,                    // auto-deleted
+		false,                    // internal
+		false,                    // no-wait
+		nil,                      // arguments
+	)
+}
+
+// PublishTokenRevoked tells every replica of the gateway that the sessions of the user are revoked
+func PublishTokenRevoked(l *logrus.Entry, conn *amqp.Connection, revoked *TokenRevoked) error {
+	ch, err := OpenChannel(conn)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := declareTokenRevokedExchange(ch); err != nil {
+		logger.WithError(err).Error("Failed to declare an exchange")
+		return err
+	}
+
+	jsonMessage, err := json.Marshal(revoked)
+	if err != nil {
+		return err
+	}
+	err = ch.Publish(
+		TokenRevokedExchangeName, // exchange
+		"",                       // routing key
+		false,                    // mandatory
+		false,                    // immediate
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        jsonMessage,
+		})
+	l.WithField("message", string(jsonMessage)).Debug("Published the TokenRevoked message")
+	return err
+}
+
+// ConsumeTokenRevoked calls the handler for every revocation published by the replicas, including this one.
+// Each replica has its own exclusive queue, the messages sent while it's down are not needed.
+func ConsumeTokenRevoked(conn *amqp.Connection, handler func(*TokenRevoked)) error {
+	ch, err := OpenChannel(conn)
+	if err != nil {
+		return err
+	}
+	if err := declareTokenRevokedExchange(ch); err != nil {
+		logger.WithError(err).Error("Failed to declare an exchange")
+		ch.Close()
+		return err
+	}
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err == nil {
+		err = ch.QueueBind(q.Name, "", TokenRevokedExchangeName, false, nil)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to declare a queue")
+		ch.Close()
+		return err
+	}
+	deliveries, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	go func() {
+		for delivery := range deliveries {
+			revoked := new(TokenRevoked)
+			if err := json.Unmarshal(delivery.Body, revoked); err != nil {
+				logger.WithError(err).Warn("Failed to decode the TokenRevoked message")
+				continue
+			}
+			handler(revoked)
+		}
+		logger.Warn("Stopped consuming the token revocations")
+	}()
+	return nil
+}
+
 func OpenChannel(conn *amqp.Connection) (*amqp.Channel, error) {
 	ch, err := conn.Channel()
 	if err != nil {
@@ -16,3 +16,17 @@ type AddPriceCatalog struct {
 	Devise    string    `json:"devise"`
 	Date      time.Time `json:"date"`
 }
+
+// UserDeleted is sent when a user deletes its account, the services delete what the user owns
+type UserDeleted struct {
+	UserID    string    `json:"userId"`
+	UUID      string    `json:"uuid"`
+	Username  string    `json:"username"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// TokenRevoked invalidates the cached sessions of the user on every replica, an empty SessionID means all of them
+type TokenRevoked struct {
+	UserID    string `json:"userId"`
+	SessionID string `json:"sessionId,omitempty"`
+}
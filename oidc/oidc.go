@@ -0,0 +1,356 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/configuration"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithFields(logrus.Fields{
+	"context": "oidc",
+})
+
+var ErrUnknownKey = errors.New("unknown ID token signing key")
+
+// jwksRefreshInterval limits how often the JWKS is fetched again when a token has an unknown kid
+const jwksRefreshInterval = time.Minute
+
+// Metadata is the subset of the provider discovery document used by the gateway
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDTokenClaims are the claims of the ID token used to link the identity to a user
+type IDTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	GivenName         string `json:"given_name"`
+	FamilyName        string `json:"family_name"`
+	jwt.RegisteredClaims
+}
+
+// Provider is an OpenID Connect provider used with the authorization code flow and PKCE
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	mu          sync.RWMutex
+	metadata    *Metadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+func NewProvider(conf *configuration.Configuration) *Provider {
+	scopes := strings.Fields(conf.OIDCScopes)
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{
+		issuer:       strings.TrimSuffix(conf.OIDCIssuer, "/"),
+		clientID:     conf.OIDCClientID,
+		clientSecret: conf.OIDCClientSecret,
+		redirectURL:  conf.OIDCRedirectURL,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+// GenerateVerifier returns a random PKCE code verifier, also used for the state and the nonce
+func GenerateVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// S256Challenge returns the PKCE code challenge of the verifier
+func S256Challenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// discover fetches the discovery document once and keeps it for the life of the process
+func (p *Provider) discover(ctx context.Context) (*Metadata, error) {
+	p.mu.RLock()
+	metadata := p.metadata
+	p.mu.RUnlock()
+	if metadata != nil {
+		return metadata, nil
+	}
+
+	metadata = new(Metadata)
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Issuer != p.issuer {
+		return nil, fmt.Errorf("discovery issuer %v doesn't match %v", metadata.Issuer, p.issuer)
+	}
+	p.mu.Lock()
+	p.metadata = metadata
+	p.mu.Unlock()
+	return metadata, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %v from %v", resp.StatusCode, u)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// AuthCodeURL returns the URL of the provider where the user is redirected to sign in
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.clientID)
+	v.Set("redirect_uri", p.redirectURL)
+	v.Set("scope", strings.Join(p.scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", S256Challenge(verifier))
+	v.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + v.Encode(), nil
+}
+
+// Exchange trades the authorization code for the tokens and returns the raw ID token
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("client_id", p.clientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token exchange failed: %v %v", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("no ID token in the token response")
+	}
+	return tokens.IDToken, nil
+}
+
+// VerifyIDToken checks the signature of the ID token against the provider JWKS, its issuer,
+// audience, expiration and nonce
+func (p *Provider) VerifyIDToken(ctx context.Context, raw string, nonce string) (*IDTokenClaims, error) {
+	claims := new(IDTokenClaims)
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token without subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// publicKey returns the key of the kid, the JWKS is fetched again when the provider rotated its keys
+func (p *Provider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.RLock()
+	key, ok := p.keys[kid]
+	fetched := p.keysFetched
+	p.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if time.Since(fetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, kid)
+	}
+
+	if err := p.fetchKeys(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	key, ok = p.keys[kid]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, kid)
+	}
+	return key, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (p *Provider) fetchKeys(ctx context.Context) error {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, metadata.JWKSURI, &jwks); err != nil {
+		return err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logger.WithError(err).WithField("kid", k.Kid).Warn("Ignoring provider key")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+}
@@ -0,0 +1,204 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"gateway/configuration"
+	"gateway/oidc"
+	"gateway/oidc/oidctest"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	clientID    = "gateway"
+	redirectURL = "http://gateway.test/api/oidc/callback"
+)
+
+func setup(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	t.Helper()
+	idp, err := oidctest.NewServer(clientID)
+	if err != nil {
+		t.Fatalf("Failed to start the stub provider: %v", err)
+	}
+	t.Cleanup(idp.Close)
+	idp.SetUser(oidctest.User{Subject: "alice-sub", Email: "alice@example.com", EmailVerified: true})
+	provider := oidc.NewProvider(&configuration.Configuration{
+		OIDCIssuer:      idp.URL,
+		OIDCClientID:    clientID,
+		OIDCRedirectURL: redirectURL,
+	})
+	return idp, provider
+}
+
+// authorize follows the redirect of the provider and returns the query of the callback
+func authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("Failed to authorize: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected a redirect, got %v", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect: %v", err)
+	}
+	return location.Query()
+}
+
+func idTokenClaims(idp *oidctest.Server, nonce string) *oidc.IDTokenClaims {
+	now := time.Now()
+	return &oidc.IDTokenClaims{
+		Nonce: nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.URL,
+			Subject:   "alice-sub",
+			Audience:  jwt.ClaimStrings{clientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	_, provider := setup(t)
+	ctx := context.Background()
+	verifier, _ := oidc.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatalf("Failed to build the authorization URL: %v", err)
+	}
+	u, _ := url.Parse(authURL)
+	if got := u.Query().Get("code_challenge"); got != oidc.S256Challenge(verifier) {
+		t.Errorf("Expected the S256 challenge of the verifier, got %v", got)
+	}
+
+	callback := authorize(t, authURL)
+	if callback.Get("state") != "state" {
+		t.Errorf("Expected the state to be sent back, got %v", callback.Get("state"))
+	}
+	raw, err := provider.Exchange(ctx, callback.Get("code"), verifier)
+	if err != nil {
+		t.Fatalf("Failed to exchange the code: %v", err)
+	}
+	claims, err := provider.VerifyIDToken(ctx, raw, "nonce")
+	if err != nil {
+		t.Fatalf("Failed to verify the ID token: %v", err)
+	}
+	if claims.Subject != "alice-sub" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	// The code can only be used once
+	if _, err := provider.Exchange(ctx, callback.Get("code"), verifier); err == nil {
+		t.Error("Expected the code to be rejected the second time")
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	_, provider := setup(t)
+	ctx := context.Background()
+	verifier, _ := oidc.GenerateVerifier()
+	other, _ := oidc.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatalf("Failed to build the authorization URL: %v", err)
+	}
+	callback := authorize(t, authURL)
+	if _, err := provider.Exchange(ctx, callback.Get("code"), other); err == nil {
+		t.Error("Expected the exchange to fail without the right verifier")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp, provider := setup(t)
+	ctx := context.Background()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(c *oidc.IDTokenClaims)
+		sign   func(c *oidc.IDTokenClaims) (string, error)
+		nonce  string
+		valid  bool
+	}{
+		{name: "valid", nonce: "nonce", valid: true},
+		{name: "wrong nonce", nonce: "other"},
+		{name: "wrong audience", nonce: "nonce", mutate: func(c *oidc.IDTokenClaims) {
+			c.Audience = jwt.ClaimStrings{"another-client"}
+		}},
+		{name: "wrong issuer", nonce: "nonce", mutate: func(c *oidc.IDTokenClaims) {
+			c.Issuer = "https://evil.example.com"
+		}},
+		{name: "expired", nonce: "nonce", mutate: func(c *oidc.IDTokenClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+		}},
+		{name: "no subject", nonce: "nonce", mutate: func(c *oidc.IDTokenClaims) {
+			c.Subject = ""
+		}},
+		{name: "signed by another key", nonce: "nonce", sign: func(c *oidc.IDTokenClaims) (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+			token.Header["kid"] = idp.KeyID
+			return token.SignedString(otherKey)
+		}},
+		{name: "none algorithm", nonce: "nonce", sign: func(c *oidc.IDTokenClaims) (string, error) {
+			return jwt.NewWithClaims(jwt.SigningMethodNone, c).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idTokenClaims(idp, "nonce")
+			if tt.mutate != nil {
+				tt.mutate(claims)
+			}
+			sign := func(c *oidc.IDTokenClaims) (string, error) { return idp.SignIDToken(c) }
+			if tt.sign != nil {
+				sign = tt.sign
+			}
+			raw, err := sign(claims)
+			if err != nil {
+				t.Fatalf("Failed to sign: %v", err)
+			}
+			_, err = provider.VerifyIDToken(ctx, raw, tt.nonce)
+			if tt.valid && err != nil {
+				t.Errorf("Expected the token to be valid, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("Expected the token to be rejected")
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenUnknownKey(t *testing.T) {
+	idp, provider := setup(t)
+	ctx := context.Background()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, idTokenClaims(idp, "nonce"))
+	token.Header["kid"] = "rotated"
+	raw, err := token.SignedString(idp.Key)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if _, err := provider.VerifyIDToken(ctx, raw, "nonce"); !errors.Is(err, oidc.ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
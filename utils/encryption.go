@@ -5,12 +5,14 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 
 	"github.com/sirupsen/logrus"
 )
 
 var logger = logrus.WithField("context", "utils/encryption")
 
+// GenerateSecretKey returns a random AES-256 key encoded in base64 so it can be stored as text
 func GenerateSecretKey() (string, error) {
 	l := logger.WithField("request", "generateSecretKey")
 	secret := make([]byte, 32)
@@ -20,8 +22,7 @@ func GenerateSecretKey() (string, error) {
 		return "", err
 	}
 
-	key := string(secret[:])
-	return key, nil
+	return encode(secret), nil
 }
 
 func encode(b []byte) string {
@@ -34,7 +35,12 @@ func decode(s string) ([]byte, error) {
 
 func Encrypt(plaintext, secretKey string) (string, error) {
 	l := logger.WithField("request", "encrypt")
-	aes, err := aes.NewCipher([]byte(secretKey))
+	key, err := decode(secretKey)
+	if err != nil {
+		l.WithError(err).Error("Error decoding key")
+		return "", err
+	}
+	aes, err := aes.NewCipher(key)
 	if err != nil {
 		l.WithError(err).Error("Error creating cipher")
 		return "", err
@@ -65,7 +71,12 @@ func Encrypt(plaintext, secretKey string) (string, error) {
 
 func Decrypt(ciphertext, secretKey string) (string, error) {
 	l := logger.WithField("request", "decrypt")
-	aes, err := aes.NewCipher([]byte(secretKey))
+	key, err := decode(secretKey)
+	if err != nil {
+		l.WithError(err).Error("Error decoding key")
+		return "", err
+	}
+	aes, err := aes.NewCipher(key)
 	if err != nil {
 		l.WithError(err).Error("Error creating cipher")
 		return "", err
@@ -85,6 +96,11 @@ func Decrypt(ciphertext, secretKey string) (string, error) {
 		l.WithError(err).Error("Error decoding ciphertext")
 		return "", err
 	}
+	if len(cypherTextBytes) < nonceSize {
+		err = errors.New("ciphertext too short")
+		l.WithError(err).Error("Error decoding ciphertext")
+		return "", err
+	}
 	ciphertext = string(cypherTextBytes)
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
 
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+// PasswordHasher hashes the passwords in the PHC string format, like $argon2id$v=19$m=19456,t=2,p=1$salt$hash
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Identify tells if the hash was made by the algorithm of the hasher
+	Identify(encoded string) bool
+	Verify(password string, encoded string) (bool, error)
+	// NeedsRehash tells if the hash was made with other parameters than the current ones
+	NeedsRehash(encoded string) bool
+}
+
+// phcID returns the identifier of the algorithm of the PHC string
+func phcID(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	return parts[1]
+}
+
+type Argon2idHasher struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// NewArgon2idHasher uses the OWASP recommended parameters when they're zero
+func NewArgon2idHasher(memory uint32, iterations uint32, parallelism uint8) *Argon2idHasher {
+	if memory == 0 {
+		memory = 19 * 1024
+	}
+	if iterations == 0 {
+		iterations = 2
+	}
+	if parallelism == 0 {
+		parallelism = 1
+	}
+	return &Argon2idHasher{
+		Memory:      memory,
+		Iterations:  iterations,
+		Parallelism: parallelism,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Identify(encoded string) bool {
+	return phcID(encoded) == "argon2id"
+}
+
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func decodeArgon2id(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrUnknownPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, err
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %v", version)
+	}
+	h := new(argon2idHash)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.parallelism); err != nil {
+		return nil, err
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Argon2idHasher) Verify(password string, encoded string) (bool, error) {
+	decoded, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), decoded.salt, decoded.iterations, decoded.memory, decoded.parallelism, uint32(len(decoded.key)))
+	return subtle.ConstantTimeCompare(key, decoded.key) == 1, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	decoded, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return decoded.memory != h.Memory || decoded.iterations != h.Iterations || decoded.parallelism != h.Parallelism ||
+		uint32(len(decoded.salt)) != h.SaltLength || uint32(len(decoded.key)) != h.KeyLength
+}
+
+// BcryptHasher handles the hashes made before argon2id, their modular crypt format is close to PHC
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return &BcryptHasher{Cost: cost}
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (h *BcryptHasher) Identify(encoded string) bool {
+	switch phcID(encoded) {
+	case "2a", "2b", "2y":
+		return true
+	}
+	return false
+}
+
+func (h *BcryptHasher) Verify(password string, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// Passwords hashes the new passwords with its default hasher and verifies the hashes of all its hashers
+type Passwords struct {
+	current PasswordHasher
+	hashers []PasswordHasher
+}
+
+func NewPasswords(current PasswordHasher, others ...PasswordHasher) *Passwords {
+	return &Passwords{
+		current: current,
+		hashers: append([]PasswordHasher{current}, others...),
+	}
+}
+
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.current.Hash(password)
+}
+
+// Verify checks the password against the hash, rehash tells if the password must be hashed again
+// because it was hashed with another algorithm or other parameters than the current ones
+func (p *Passwords) Verify(password string, encoded string) (ok bool, rehash bool, err error) {
+	for _, h := range p.hashers {
+		if !h.Identify(encoded) {
+			continue
+		}
+		ok, err := h.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, h != p.current || h.NeedsRehash(encoded), nil
+	}
+	return false, false, ErrUnknownPasswordHash
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	h := NewArgon2idHasher(8*1024, 1, 1)
+
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=8192,t=1,p=1$") {
+		t.Fatalf("Unexpected PHC string %v", encoded)
+	}
+	if ok, err := h.Verify("correct horse", encoded); !ok || err != nil {
+		t.Errorf("Expected the password to match, got %v %v", ok, err)
+	}
+	if ok, _ := h.Verify("wrong horse", encoded); ok {
+		t.Error("Expected the wrong password not to match")
+	}
+	if h.NeedsRehash(encoded) {
+		t.Error("Expected no rehash with the same parameters")
+	}
+	if !NewArgon2idHasher(8*1024, 2, 1).NeedsRehash(encoded) {
+		t.Error("Expected a rehash with other parameters")
+	}
+}
+
+func TestPasswords(t *testing.T) {
+	argon := NewArgon2idHasher(8*1024, 1, 1)
+	passwords := NewPasswords(argon, NewBcryptHasher(bcrypt.MinCost))
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	current, err := passwords.Hash("password")
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		encoded  string
+		ok       bool
+		rehash   bool
+		err      bool
+	}{
+		{name: "current hash", password: "password", encoded: current, ok: true},
+		{name: "legacy bcrypt hash", password: "password", encoded: string(legacy), ok: true, rehash: true},
+		{name: "wrong password on bcrypt", password: "other", encoded: string(legacy)},
+		{name: "wrong password on argon2id", password: "other", encoded: current},
+		{name: "unknown format", password: "password", encoded: "plaintext", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := passwords.Verify(tt.password, tt.encoded)
+			if ok != tt.ok || rehash != tt.rehash || (err != nil) != tt.err {
+				t.Errorf("Expected %v %v %v, got %v %v %v", tt.ok, tt.rehash, tt.err, ok, rehash, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// GenerateToken returns a random url-safe token built from size random bytes
+func GenerateToken(size int) (string, error) {
+	l := logger.WithField("request", "generateToken")
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		l.WithError(err).Error("Error generating token")
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 of the token, used to store opaque tokens
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters of RFC 6238, these are the defaults supported by every authenticator app
+const (
+	TOTPPeriod = 30
+	TOTPDigits = 6
+	// TOTPSkew is the number of periods accepted before and after the current one to allow clock drift
+	TOTPSkew = 1
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random base32 secret of 160 bits as recommended by RFC 4226
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		logger.WithError(err).Error("Error generating TOTP secret")
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth URI to enroll the secret in an authenticator app
+func TOTPURI(issuer string, account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", TOTPDigits))
+	v.Set("period", fmt.Sprintf("%d", TOTPPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// TOTPCode returns the code of the secret at the given time
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return hotp(secret, uint64(t.Unix()/TOTPPeriod))
+}
+
+// ValidateTOTP checks the code against the periods around the given time
+func ValidateTOTP(secret string, code string, t time.Time) bool {
+	_, ok := MatchTOTP(secret, code, t)
+	return ok
+}
+
+// MatchTOTP checks the code against the periods around the given time and returns the time step it belongs to
+func MatchTOTP(secret string, code string, t time.Time) (int64, bool) {
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	counter := t.Unix() / TOTPPeriod
+	for i := -TOTPSkew; i <= TOTPSkew; i++ {
+		step := counter + int64(i)
+		expected, err := hotp(secret, uint64(step))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// hotp implements the HOTP algorithm of RFC 4226
+func hotp(secret string, counter uint64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vectors of RFC 6238 appendix B for SHA1, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, v := range vectors {
+		code, err := TOTPCode(secret, time.Unix(v.time, 0))
+		if err != nil {
+			t.Fatalf("Failed to generate code: %v", err)
+		}
+		if code != v.code {
+			t.Fatalf("Expected %v at %v, got %v", v.code, v.time, code)
+		}
+	}
+
+	now := time.Now()
+	code, _ := TOTPCode(secret, now.Add(-TOTPPeriod*time.Second))
+	if !ValidateTOTP(secret, code, now) {
+		t.Fatalf("Code of the previous period refused")
+	}
+	code, _ = TOTPCode(secret, now.Add(-3*TOTPPeriod*time.Second))
+	if ValidateTOTP(secret, code, now) {
+		t.Fatalf("Outdated code accepted")
+	}
+	code, _ = TOTPCode(secret, now.Add(TOTPPeriod*time.Second))
+	if step, ok := MatchTOTP(secret, code, now); !ok || step != now.Unix()/TOTPPeriod+1 {
+		t.Fatalf("Expected the code of the next period to match its step, got %v", step)
+	}
+}
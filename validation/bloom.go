@@ -0,0 +1,56 @@
+package validation
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter tells if a value may be in a set, with false positives but no false negatives.
+// It keeps a large list of breached passwords in a few bits per password.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes uint64
+}
+
+// newBloomFilter sizes the filter for n values with the false positive rate
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{
+		bits:   make([]uint64, (m+63)/64),
+		m:      m,
+		hashes: k,
+	}
+}
+
+// locations uses the double hashing of Kirsch and Mitzenmacher to derive the k locations from two hashes
+func (b *bloomFilter) locations(value string) (uint64, uint64) {
+	h1 := fnv.New64a()
+	h1.Write([]byte(value))
+	h2 := fnv.New64()
+	h2.Write([]byte(value))
+	return h1.Sum64(), h2.Sum64() | 1
+}
+
+func (b *bloomFilter) Add(value string) {
+	h1, h2 := b.locations(value)
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) Test(value string) bool {
+	h1, h2 := b.locations(value)
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package validation
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+)
+
+const breachedFalsePositiveRate = 0.001
+
+// PasswordEntropy estimates the entropy in bits of the password from the size of its character pool.
+// The characters repeating or following the previous one, like in aaa, abc or 321, don't count.
+func PasswordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	length := 0
+	var previous rune
+	for i, r := range []rune(password) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+		if i == 0 || math.Abs(float64(r-previous)) > 1 {
+			length++
+		}
+		previous = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// passwordPolicy checks the passwords of the requests with the password_strength,
+// password_personal and password_breached tags
+type passwordPolicy struct {
+	minEntropy float64
+	breached   *bloomFilter
+}
+
+// loadBreachedPasswords builds the bloom filter of the file, one password per line
+func loadBreachedPasswords(path string) (*bloomFilter, error) {
+	count := 0
+	if err := readLines(path, func(string) { count++ }); err != nil {
+		return nil, err
+	}
+	filter := newBloomFilter(count, breachedFalsePositiveRate)
+	if err := readLines(path, filter.Add); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func readLines(path string, fn func(string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			fn(line)
+		}
+	}
+	return scanner.Err()
+}
+
+func (p *passwordPolicy) strength(fl validator.FieldLevel) bool {
+	return PasswordEntropy(fl.Field().String()) >= p.minEntropy
+}
+
+// personal refuses the passwords containing the username or the email of the same request
+func (p *passwordPolicy) personal(fl validator.FieldLevel) bool {
+	password := strings.ToLower(fl.Field().String())
+	parent := fl.Parent()
+	if parent.Kind() == reflect.Ptr {
+		parent = parent.Elem()
+	}
+	if parent.Kind() != reflect.Struct {
+		return true
+	}
+
+	var personal []string
+	for _, name := range []string{"Username", "Email"} {
+		field := parent.FieldByName(name)
+		if !field.IsValid() || field.Kind() != reflect.String {
+			continue
+		}
+		value := strings.ToLower(field.String())
+		personal = append(personal, value)
+		if local, _, ok := strings.Cut(value, "@"); ok {
+			personal = append(personal, local)
+		}
+	}
+	for _, value := range personal {
+		// Very short values would refuse too many passwords
+		if len(value) >= 3 && strings.Contains(password, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *passwordPolicy) notBreached(fl validator.FieldLevel) bool {
+	return p.breached == nil || !p.breached.Test(fl.Field().String())
+}
@@ -0,0 +1,104 @@
+package validation
+
+import (
+	"fmt"
+	"gateway/configuration"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+)
+
+type signupRequest struct {
+	Username string `validate:"required"`
+	Email    string `validate:"required"`
+	Password string `validate:"required,password_strength,password_personal,password_breached"`
+}
+
+func TestPasswordEntropy(t *testing.T) {
+	tests := []struct {
+		password string
+		min      float64
+		max      float64
+	}{
+		{password: "", max: 0},
+		{password: "aaaaaaaaaaaa", max: 5},
+		{password: "abcdefgh12", max: 15},
+		{password: "password", min: 30, max: 35},
+		{password: "Tr0ub4dor&3", min: 70},
+		{password: "correct horse battery staple", min: 120},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			entropy := PasswordEntropy(tt.password)
+			if entropy < tt.min || (tt.max > 0 && entropy > tt.max) {
+				t.Errorf("Expected an entropy between %v and %v, got %v", tt.min, tt.max, entropy)
+			}
+		})
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(1000, breachedFalsePositiveRate)
+	for i := 0; i < 1000; i++ {
+		filter.Add(fmt.Sprintf("password%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !filter.Test(fmt.Sprintf("password%d", i)) {
+			t.Fatalf("Expected password%d to be in the filter", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.Test(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("Too many false positives: %v", falsePositives)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(breached, []byte("123456\nG0lden-Retr1ever!\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the breached passwords: %v", err)
+	}
+	v := New(&configuration.Configuration{
+		TranslateValidation: true,
+		PasswordMinEntropy:  50,
+		BreachedPasswords:   breached,
+	})
+
+	tests := []struct {
+		name     string
+		password string
+		message  string
+	}{
+		{name: "strong", password: "Winter-Plum-Kettle-42"},
+		{name: "weak", password: "abcdefgh12", message: "too weak"},
+		{name: "username", password: "Xx-alice-Secure-9!", message: "must not contain the username"},
+		{name: "email", password: "Wonder!ALICE@example.com", message: "must not contain the username"},
+		{name: "breached", password: "G0lden-Retr1ever!", message: "breached"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Validate.Struct(&signupRequest{Username: "alice", Email: "alice@example.com", Password: tt.password})
+			if tt.message == "" {
+				if err != nil {
+					t.Fatalf("Expected the password to be accepted, got %v", err)
+				}
+				return
+			}
+			errs, ok := err.(validator.ValidationErrors)
+			if !ok || len(errs) != 1 {
+				t.Fatalf("Expected one validation error, got %v", err)
+			}
+			if message := errs[0].Translate(v.Trans); !strings.Contains(message, tt.message) {
+				t.Errorf("Expected the message to contain %q, got %q", tt.message, message)
+			}
+		})
+	}
+}
@@ -6,25 +6,52 @@ import (
 	"github.com/go-playground/locales/en"
 	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
+	"github.com/sirupsen/logrus"
 
 	en_translations "github.com/go-playground/validator/v10/translations/en"
 )
 
+var logger = logrus.WithFields(logrus.Fields{
+	"context": "validation",
+})
+
 type Validation struct {
 	Validate *validator.Validate
 	Trans    ut.Translator
 }
 
+// passwordTranslations are the messages of the password policy tags
+var passwordTranslations = map[string]string{
+	"password_strength": "{0} is too weak, use a longer password with more kinds of characters",
+	"password_personal": "{0} must not contain the username or the email",
+	"password_breached": "{0} appears in a list of breached passwords, choose another one",
+}
+
 func New(conf *configuration.Configuration) *Validation {
 
 	var trans ut.Translator
 	validate := validator.New()
 
+	policy := &passwordPolicy{minEntropy: float64(conf.PasswordMinEntropy)}
+	if conf.BreachedPasswords != "" {
+		breached, err := loadBreachedPasswords(conf.BreachedPasswords)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load the breached passwords")
+		}
+		policy.breached = breached
+	}
+	validate.RegisterValidation("password_strength", policy.strength)
+	validate.RegisterValidation("password_personal", policy.personal)
+	validate.RegisterValidation("password_breached", policy.notBreached)
+
 	if conf.TranslateValidation {
 		en := en.New()
 		uni := ut.New(en, en)
 		trans, _ = uni.GetTranslator("en")
 		en_translations.RegisterDefaultTranslations(validate, trans)
+		for tag, message := range passwordTranslations {
+			registerTranslation(validate, trans, tag, message)
+		}
 	}
 
 	return &Validation{
@@ -32,3 +59,12 @@ func New(conf *configuration.Configuration) *Validation {
 		Trans:    trans,
 	}
 }
+
+func registerTranslation(validate *validator.Validate, trans ut.Translator, tag string, message string) {
+	validate.RegisterTranslation(tag, trans, func(ut ut.Translator) error {
+		return ut.Add(tag, message, true)
+	}, func(ut ut.Translator, fe validator.FieldError) string {
+		t, _ := ut.T(tag, fe.Field())
+		return t
+	})
+}